@@ -0,0 +1,118 @@
+package lm2
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+const backupMagic = 0x4C4D3242 // "LM2B"
+
+// backupHeader starts a backup. It's followed by the first
+// Header.LastCommit bytes of the data file and then by a WAL stream
+// of the commits made while the data file was copied.
+type backupHeader struct {
+	Magic  uint32
+	Header fileHeader
+}
+
+// Backup writes a consistent copy of the collection to w without blocking
+// updates. The data file is copied up to the last committed version.
+// Commits made during the copy can rewrite record headers that were
+// already copied, so they're appended to the backup as a WAL stream
+// (see StreamWAL), and RestoreBackup replays them. The backup reflects
+// the collection as of the last commit before Backup returns.
+// ErrWALGap is returned if so many commits are made during the copy
+// that some are no longer available; the backup can be retried.
+// The blob file isn't copied, so ErrBlobsUnsupported is returned if the
+// collection stores values in one.
+func (c *Collection) Backup(w io.Writer) error {
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return ErrInternal
+	}
+	if c.hasBlobs() {
+		return ErrBlobsUnsupported
+	}
+
+	c.metaLock.RLock()
+	atomic.AddInt32(&c.shipper.streams, 1)
+	header := c.fileHeader
+	f := c.f
+	c.metaLock.RUnlock()
+	defer atomic.AddInt32(&c.shipper.streams, -1)
+
+	err := binary.Write(w, binary.LittleEndian, backupHeader{
+		Magic:  backupMagic,
+		Header: header,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, io.NewSectionReader(f, 0, header.LastCommit))
+	if err != nil {
+		return err
+	}
+
+	from := header.LastCommit
+	for from != c.Version() {
+		sh, _ := c.shipper.next(from)
+		if sh == nil {
+			return ErrWALGap
+		}
+		_, err = w.Write(sh.bytes)
+		if err != nil {
+			return err
+		}
+		from = sh.to
+	}
+	return nil
+}
+
+// RestoreBackup creates a collection with a data file at file from
+// a backup written by Backup, and opens it. Any existing data file
+// at file is replaced.
+// cacheSize represents the size of the collection cache.
+func RestoreBackup(file string, cacheSize int, r io.Reader) (*Collection, error) {
+	header := backupHeader{}
+	err := binary.Read(r, binary.LittleEndian, &header)
+	if err != nil {
+		return nil, err
+	}
+	if header.Magic != backupMagic {
+		return nil, errors.New("lm2: invalid backup magic")
+	}
+
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.CopyN(f, r, header.Header.LastCommit)
+	if err == nil {
+		// The copied header may be from a later commit.
+		_, err = f.WriteAt(header.Header.bytes(), 0)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(file)
+		return nil, err
+	}
+
+	// Don't replay a WAL left over from another collection.
+	os.Remove(file + ".wal")
+	c, err := OpenCollection(file, cacheSize)
+	if err != nil {
+		os.Remove(file)
+		return nil, err
+	}
+	err = c.ApplyWALStream(r)
+	if err != nil {
+		c.Destroy()
+		return nil, err
+	}
+	return c, nil
+}
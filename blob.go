@@ -0,0 +1,234 @@
+package lm2
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+	"time"
+)
+
+// blobRefSize is the size of a blobRef, which is stored in place of the
+// value of a record with recordFlagBlob set.
+const blobRefSize = 16
+
+// blobRef is the location of a value in the blob file.
+type blobRef struct {
+	Offset int64
+	Len    int64
+}
+
+func (r blobRef) bytes() []byte {
+	b := make([]byte, blobRefSize)
+	binary.LittleEndian.PutUint64(b, uint64(r.Offset))
+	binary.LittleEndian.PutUint64(b[8:], uint64(r.Len))
+	return b
+}
+
+func decodeBlobRef(b []byte) (blobRef, error) {
+	if len(b) != blobRefSize {
+		return blobRef{}, ErrCorruptRecord
+	}
+	return blobRef{
+		Offset: int64(binary.LittleEndian.Uint64(b)),
+		Len:    int64(binary.LittleEndian.Uint64(b[8:])),
+	}, nil
+}
+
+// blobFile holds the values a collection stores out of line. Values are
+// only appended; a commit that's rolled back truncates what it appended.
+// The file is created by the first value written to it, so collections
+// that don't use blobs don't have one.
+type blobFile struct {
+	name     string
+	readOnly bool
+	perm     os.FileMode
+	// exactPerm is true if perm is applied whatever the umask.
+	exactPerm bool
+	timeout   time.Duration
+
+	// lock protects f and size. Reads only hold it to get f.
+	lock sync.Mutex
+	f    blockFile
+	size int64
+}
+
+func newBlobFile(name string, opts Options, readOnly bool) *blobFile {
+	return &blobFile{
+		name:      name,
+		readOnly:  readOnly,
+		perm:      opts.fileMode().Perm(),
+		exactPerm: opts.FileMode != 0,
+		timeout:   opts.OpTimeout,
+	}
+}
+
+// open opens the blob file if it exists and isn't open yet. It creates
+// the file if create is true. lock must be held.
+func (b *blobFile) open(create bool) error {
+	if b.f != nil {
+		return nil
+	}
+	flag := os.O_RDWR
+	if b.readOnly {
+		flag = os.O_RDONLY
+	} else if create {
+		flag |= os.O_CREATE
+	}
+	f, err := openDataFile(b.name, flag, b.perm, b.timeout)
+	if err != nil {
+		if os.IsNotExist(err) && !create {
+			return nil
+		}
+		return err
+	}
+	if create && b.exactPerm {
+		// The umask applied if the file was created.
+		err = os.Chmod(b.name, b.perm)
+	}
+	var fi os.FileInfo
+	if err == nil {
+		fi, err = f.Stat()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	b.f = f
+	b.size = fi.Size()
+	return nil
+}
+
+// exists returns true if the blob file exists.
+func (b *blobFile) exists() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.f != nil {
+		return true
+	}
+	_, err := os.Stat(b.name)
+	return err == nil
+}
+
+// end returns the size of the blob file, where the next append writes.
+func (b *blobFile) end() (int64, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	err := b.open(false)
+	return b.size, err
+}
+
+// append writes data at the end of the blob file. Only one append can
+// run at a time.
+func (b *blobFile) append(data []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	err := b.open(true)
+	if err != nil {
+		return err
+	}
+	offset := b.size
+	n, err := b.f.WriteAt(data, offset)
+	b.size += int64(n)
+	if err != nil {
+		return Error{Op: "append blobs", Offset: offset, Err: err}
+	}
+	return nil
+}
+
+// read returns the value at ref.
+func (b *blobFile) read(ref blobRef) (string, error) {
+	value := make([]byte, ref.Len)
+	err := b.readInto(value, ref)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// readInto reads the value at ref into value, which must be ref.Len
+// bytes long.
+func (b *blobFile) readInto(value []byte, ref blobRef) error {
+	b.lock.Lock()
+	err := b.open(false)
+	f := b.f
+	b.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		return Error{Op: "read blob", Offset: ref.Offset, Err: ErrCorruptRecord}
+	}
+	n, err := f.ReadAt(value, ref.Offset)
+	if err != nil && n != len(value) {
+		return Error{Op: "read blob", Offset: ref.Offset, Err: err}
+	}
+	return nil
+}
+
+// truncate drops everything after size.
+func (b *blobFile) truncate(size int64) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.f == nil {
+		return nil
+	}
+	err := b.f.Truncate(size)
+	if err != nil {
+		return err
+	}
+	b.size = size
+	return nil
+}
+
+// sync syncs the blob file if it's open.
+func (b *blobFile) sync() error {
+	b.lock.Lock()
+	f := b.f
+	b.lock.Unlock()
+	if f == nil {
+		return nil
+	}
+	return f.Sync()
+}
+
+func (b *blobFile) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.f != nil {
+		b.f.Close()
+		b.f = nil
+	}
+}
+
+// recordValue returns the value of rec, reading it from the blob file if
+// it's stored out of line.
+func (c *Collection) recordValue(rec *record) (string, error) {
+	if rec.Flags&recordFlagBlob == 0 {
+		return rec.Value, nil
+	}
+	return c.blobs.read(rec.blob)
+}
+
+// readBlobInto replaces the blobRef after the key in buf, which holds a
+// record's key and value as they are in the data file, with the value
+// it refers to. buf is grown if needed and returned.
+func (c *Collection) readBlobInto(buf []byte, keyLen int) ([]byte, error) {
+	ref, err := decodeBlobRef(buf[keyLen:])
+	if err != nil {
+		return buf, err
+	}
+	size := keyLen + int(ref.Len)
+	if cap(buf) < size {
+		grown := make([]byte, size)
+		copy(grown, buf[:keyLen])
+		buf = grown
+	}
+	buf = buf[:size]
+	return buf, c.blobs.readInto(buf[keyLen:], ref)
+}
+
+// hasBlobs returns true if the collection stores or may store values in
+// the blob file.
+func (c *Collection) hasBlobs() bool {
+	return c.options.BlobThreshold > 0 || c.blobs.exists()
+}
@@ -0,0 +1,146 @@
+package lm2
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func blobFileSize(t *testing.T, file string) int64 {
+	fi, err := os.Stat(file + ".blob")
+	if os.IsNotExist(err) {
+		return -1
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func TestBlobThreshold(t *testing.T) {
+	const file = "/tmp/test_blobthreshold.lm2"
+	opts := Options{CacheSize: 100, BlobThreshold: 100}
+	var c *Collection
+	var err error
+	files := withFaultFile(func() {
+		c, err = NewCollectionWithOptions(file, opts)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	large := strings.Repeat("x", 1000)
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	wb.Set("b", large)
+	wb.Set("c", strings.Repeat("y", 100))
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := blobFileSize(t, file); size != 1000 {
+		t.Errorf("expected a blob file of 1000 bytes, got %d", size)
+	}
+	if size := c.Stats().DataFileSize; size > 1000 {
+		t.Errorf("expected the large value to be out of line, got a data file of %d bytes", size)
+	}
+
+	// A rolled back commit leaves nothing in the blob file.
+	files[0].writeLimit = 10
+	wb = NewWriteBatch()
+	wb.Set("d", large)
+	_, err = c.Update(wb)
+	if !IsRollbackError(err) {
+		t.Fatalf("expected a rollback, got %v", err)
+	}
+	files[0].writeLimit = -1
+	if size := blobFileSize(t, file); size != 1000 {
+		t.Errorf("expected the blob file to be truncated to 1000 bytes, got %d", size)
+	}
+
+	check := func(expected map[string]string) {
+		t.Helper()
+		for key, value := range expected {
+			cur, err := c.NewCursor()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := cur.Get(key)
+			if err != nil || got != value {
+				t.Errorf("expected %s to have a %d byte value, got %d bytes (%v)", key, len(value), len(got), err)
+			}
+		}
+		count := 0
+		err := c.ScanBuffer("", nil, func(key, value []byte) bool {
+			count++
+			if string(value) != expected[string(key)] {
+				t.Errorf("ScanBuffer: unexpected %d byte value for %s", len(value), key)
+			}
+			return true
+		})
+		if err != nil || count != len(expected) {
+			t.Errorf("expected ScanBuffer to find %d keys, got %d (%v)", len(expected), count, err)
+		}
+	}
+	expected := map[string]string{"a": "1", "b": large, "c": strings.Repeat("y", 100)}
+	check(expected)
+
+	if err := c.Backup(&bytes.Buffer{}); err != ErrBlobsUnsupported {
+		t.Errorf("expected ErrBlobsUnsupported from Backup, got %v", err)
+	}
+
+	// Automatic compaction keeps the blob file.
+	wb = NewWriteBatch()
+	wb.Set("b", strings.Repeat("z", 500))
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected["b"] = strings.Repeat("z", 500)
+	c.writeLock.Lock()
+	_, err = c.compactOnline(nil)
+	c.writeLock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := blobFileSize(t, file); size != 1500 {
+		t.Errorf("expected a blob file of 1500 bytes, got %d", size)
+	}
+	check(expected)
+
+	// Compact rewrites the blob file with the live values.
+	c.Close()
+	c, err = OpenCollectionWithOptions(file, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := blobFileSize(t, file); size != 500 {
+		t.Errorf("expected a compacted blob file of 500 bytes, got %d", size)
+	}
+	c, err = OpenCollection(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(expected)
+
+	// Values stay readable without a threshold, and compacting
+	// moves them inline.
+	err = c.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := blobFileSize(t, file); size != -1 {
+		t.Errorf("expected the blob file to be removed, got %d bytes", size)
+	}
+	c, err = OpenCollection(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(expected)
+}
@@ -0,0 +1,117 @@
+package lm2
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// blockFile is the data file of a collection. *os.File implements it.
+type blockFile interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Writer
+	io.Seeker
+	Sync() error
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+	Name() string
+	Close() error
+}
+
+// openBlockFile opens data files. Tests replace it to inject faults.
+var openBlockFile = func(name string, flag int, perm os.FileMode) (blockFile, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+// openDataFile opens a data file whose reads, writes and syncs fail
+// with ErrTimeout after timeout, if it's positive.
+func openDataFile(name string, flag int, perm os.FileMode, timeout time.Duration) (blockFile, error) {
+	f, err := openBlockFile(name, flag, perm)
+	if err != nil || timeout <= 0 {
+		return f, err
+	}
+	return &timeoutFile{blockFile: f, timeout: timeout}, nil
+}
+
+// withTimeout runs fn and returns its error, or ErrTimeout if it takes
+// longer than timeout. fn keeps running in the background after a
+// timeout.
+func withTimeout(timeout time.Duration, fn func() error) error {
+	if timeout <= 0 {
+		return fn()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return ErrTimeout
+	}
+}
+
+// timeoutFile is a blockFile whose blocking operations time out.
+// Buffers are copied, since an operation that timed out may still
+// use them.
+type timeoutFile struct {
+	blockFile
+	timeout time.Duration
+}
+
+func (f *timeoutFile) ReadAt(b []byte, off int64) (int, error) {
+	buf := make([]byte, len(b))
+	n := 0
+	err := withTimeout(f.timeout, func() error {
+		var err error
+		n, err = f.blockFile.ReadAt(buf, off)
+		return err
+	})
+	if err == ErrTimeout {
+		return 0, err
+	}
+	copy(b, buf[:n])
+	return n, err
+}
+
+func (f *timeoutFile) WriteAt(b []byte, off int64) (int, error) {
+	buf := append([]byte(nil), b...)
+	n := 0
+	err := withTimeout(f.timeout, func() error {
+		var err error
+		n, err = f.blockFile.WriteAt(buf, off)
+		return err
+	})
+	if err == ErrTimeout {
+		return 0, err
+	}
+	return n, err
+}
+
+func (f *timeoutFile) Write(b []byte) (int, error) {
+	buf := append([]byte(nil), b...)
+	n := 0
+	err := withTimeout(f.timeout, func() error {
+		var err error
+		n, err = f.blockFile.Write(buf)
+		return err
+	})
+	if err == ErrTimeout {
+		return 0, err
+	}
+	return n, err
+}
+
+func (f *timeoutFile) Sync() error {
+	return withTimeout(f.timeout, f.blockFile.Sync)
+}
+
+func (f *timeoutFile) Truncate(size int64) error {
+	return withTimeout(f.timeout, func() error {
+		return f.blockFile.Truncate(size)
+	})
+}
@@ -0,0 +1,199 @@
+package lm2
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+var errInjected = errors.New("injected fault")
+
+// faultFile is a data file that fails writes and syncs on demand.
+type faultFile struct {
+	*os.File
+	// writeLimit, if nonnegative, is the number of bytes Write and
+	// WriteAt write before failing.
+	writeLimit int
+	failSync   bool
+	// hang, if set, blocks reads and syncs until it's closed.
+	hang chan struct{}
+}
+
+func (f *faultFile) limit(b []byte) ([]byte, error) {
+	if f.writeLimit < 0 || len(b) <= f.writeLimit {
+		if f.writeLimit >= 0 {
+			f.writeLimit -= len(b)
+		}
+		return b, nil
+	}
+	b = b[:f.writeLimit]
+	f.writeLimit = 0
+	return b, errInjected
+}
+
+func (f *faultFile) Write(b []byte) (int, error) {
+	b, fault := f.limit(b)
+	n, err := f.File.Write(b)
+	if err == nil {
+		err = fault
+	}
+	return n, err
+}
+
+func (f *faultFile) WriteAt(b []byte, off int64) (int, error) {
+	b, fault := f.limit(b)
+	n, err := f.File.WriteAt(b, off)
+	if err == nil {
+		err = fault
+	}
+	return n, err
+}
+
+func (f *faultFile) ReadAt(b []byte, off int64) (int, error) {
+	if f.hang != nil {
+		<-f.hang
+	}
+	return f.File.ReadAt(b, off)
+}
+
+func (f *faultFile) Sync() error {
+	if f.hang != nil {
+		<-f.hang
+	}
+	if f.failSync {
+		return errInjected
+	}
+	return f.File.Sync()
+}
+
+// withFaultFile makes collections opened by fn use faultFiles,
+// which are returned as they're opened.
+func withFaultFile(fn func()) []*faultFile {
+	files := []*faultFile{}
+	open := openBlockFile
+	openBlockFile = func(name string, flag int, perm os.FileMode) (blockFile, error) {
+		f, err := os.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		ff := &faultFile{File: f, writeLimit: -1}
+		files = append(files, ff)
+		return ff, nil
+	}
+	defer func() {
+		openBlockFile = open
+	}()
+	fn()
+	return files
+}
+
+func TestDataFileFaults(t *testing.T) {
+	const file = "/tmp/test_datafilefaults.lm2"
+	var c *Collection
+	var err error
+	files := withFaultFile(func() {
+		c, err = NewCollection(file, 100)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	f := files[0]
+
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	version, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed sync before the WAL is written rolls back.
+	f.failSync = true
+	wb = NewWriteBatch()
+	wb.Set("b", "2")
+	_, err = c.Update(wb)
+	if !IsRollbackError(err) || !errors.Is(err, errInjected) {
+		t.Fatalf("expected a rollback, got %v", err)
+	}
+	f.failSync = false
+	if c.Version() != version {
+		t.Errorf("expected version %d, got %d", version, c.Version())
+	}
+
+	// So does a partial append.
+	f.writeLimit = 10
+	_, err = c.Update(wb)
+	if !IsRollbackError(err) || !errors.Is(err, errInjected) {
+		t.Fatalf("expected a rollback, got %v", err)
+	}
+	f.writeLimit = -1
+	if fi, err := f.Stat(); err != nil || fi.Size() != version {
+		t.Errorf("expected the data file to be truncated to %d, got %v (%v)", version, fi.Size(), err)
+	}
+
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	c, err = OpenCollection(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := verifyOrder(t, c, nil); count != 2 {
+		t.Errorf("expected 2 keys, got %d", count)
+	}
+}
+
+func TestOpTimeout(t *testing.T) {
+	const file = "/tmp/test_optimeout.lm2"
+	var c *Collection
+	var err error
+	files := withFaultFile(func() {
+		c, err = NewCollectionWithOptions(file, Options{CacheSize: 100, OpTimeout: 50 * time.Millisecond})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	f := files[0]
+
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	version, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hang := make(chan struct{})
+	f.hang = hang
+	wb = NewWriteBatch()
+	wb.Set("b", "2")
+	_, err = c.Update(wb)
+	if !IsRollbackError(err) || !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected a rollback after a timeout, got %v", err)
+	}
+	if c.Version() != version {
+		t.Errorf("expected version %d, got %d", version, c.Version())
+	}
+
+	c.cache.reset()
+	cur, err := c.NewCursor()
+	if err == nil {
+		_, err = cur.Get("a")
+	}
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected ErrTimeout, got %v", err)
+	}
+
+	close(hang)
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := verifyOrder(t, c, nil); count != 2 {
+		t.Errorf("expected 2 keys, got %d", count)
+	}
+}
@@ -0,0 +1,132 @@
+package lm2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// bulkLoadFlushSize is the amount of record data BulkLoadSorted
+// buffers before writing it out.
+const bulkLoadFlushSize = 1 << 20
+
+// BulkLoadSorted creates a new collection with a data file at file and
+// loads the key-value pairs returned by pairs until it returns false.
+// Keys must be strictly increasing. Because the input is sorted, records
+// are written sequentially in a single pass and committed once at the end,
+// which is much faster than calling Update repeatedly.
+// cacheSize represents the size of the collection cache.
+func BulkLoadSorted(file string, cacheSize int, pairs func() (key, value string, ok bool)) (*Collection, error) {
+	c, err := NewCollection(file, cacheSize)
+	if err != nil {
+		return nil, err
+	}
+	err = c.bulkLoad(pairs)
+	if err != nil {
+		c.Destroy()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Collection) bulkLoad(pairs func() (key, value string, ok bool)) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+
+	header := c.fileHeader
+	buf := bytes.NewBuffer(nil)
+	bufStart := c.LastCommit
+	// last holds the offset of the last record written at each level.
+	last := [maxLevels]int64{}
+
+	// link points the Next pointer at level of the record at offset to next.
+	link := func(offset int64, level int, next int64) error {
+		// Next pointers follow the flags and reserved bytes of the record header.
+		pos := offset + 2 + int64(level)*8
+		if offset >= bufStart {
+			binary.LittleEndian.PutUint64(buf.Bytes()[pos-bufStart:], uint64(next))
+			return nil
+		}
+		b := [8]byte{}
+		binary.LittleEndian.PutUint64(b[:], uint64(next))
+		_, err := c.writeAt(b[:], pos)
+		return err
+	}
+
+	prevKey := ""
+	count := 0
+	for {
+		key, value, ok := pairs()
+		if !ok {
+			break
+		}
+		if count > 0 && c.compare(key, prevKey) <= 0 {
+			return fmt.Errorf("lm2: bulk load keys are not sorted (`%s` after `%s`)", key, prevKey)
+		}
+		if err := checkRecordSize(key, value); err != nil {
+			return err
+		}
+		prevKey = key
+		count++
+
+		offset := bufStart + int64(buf.Len())
+		level := generateLevel()
+		for i := 0; i <= level; i++ {
+			if last[i] == 0 {
+				header.Next[i] = offset
+			} else if err := link(last[i], i, offset); err != nil {
+				return err
+			}
+			last[i] = offset
+		}
+
+		err := writeRecord(&record{Key: key, Value: value}, buf)
+		if err != nil {
+			return err
+		}
+
+		if buf.Len() >= bulkLoadFlushSize {
+			if _, err = c.writeAt(buf.Bytes(), bufStart); err != nil {
+				return err
+			}
+			bufStart += int64(buf.Len())
+			buf.Reset()
+		}
+	}
+	if count == 0 {
+		return nil
+	}
+	if _, err := c.writeAt(buf.Bytes(), bufStart); err != nil {
+		return err
+	}
+
+	lastCommit, err := c.writeSentinel()
+	if err != nil {
+		return err
+	}
+	err = c.syncData()
+	if err != nil {
+		return err
+	}
+
+	header.LastCommit = lastCommit
+	walEntry := newWALEntry()
+	walEntry.Push(newWALRecord(0, header.bytes()))
+	_, err = c.wal.Append(walEntry)
+	if err != nil {
+		return err
+	}
+	_, err = c.writeAt(header.bytes(), 0)
+	if err != nil {
+		return err
+	}
+	err = c.syncData()
+	if err != nil {
+		return err
+	}
+	c.fileHeader = header
+	c.stats.incRecordsWritten(uint64(count))
+	return nil
+}
@@ -1,16 +1,47 @@
 package lm2
 
 import (
+	"errors"
 	"math/rand"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type recordCache struct {
-	cache        map[int64]*record
+	cache map[int64]*record
+	// maxKeyRecord is the record with the largest key that has been
+	// cached. It's only used for its key and offset, which don't change.
+	// Deleted and overwritten records stay linked until the data file is
+	// rewritten, which resets the cache, so it's a valid place to start
+	// a search even once it's no longer live.
 	maxKeyRecord *record
 	size         int
 	preventPurge bool
 	lock         sync.RWMutex
+
+	// index holds the records in cache sorted by key and offset.
+	index *cacheIndex
+	// compare orders keys.
+	compare func(a, b string) int
+
+	// shared, if set, is the budget the cache shares with other
+	// collections, and size is its total size.
+	shared *SharedCache
+	// records is the number of records in cache. It's only written
+	// while holding lock, but it's read atomically by shared.
+	records int64
+
+	// epoch is incremented by reset, so that caches that look up
+	// records in this one can tell it's been emptied.
+	epoch uint64
+	// source, if set, is the cache of the collection a Reader reads.
+	// Records are looked up in it rather than in cache, and nothing is
+	// added to it, as long as its epoch is sourceEpoch. Once source is
+	// reset, its records may be from another data file, so nothing is
+	// found until follow is called again.
+	source      *recordCache
+	sourceEpoch uint64
 }
 
 func newCache(size int) *recordCache {
@@ -18,41 +49,108 @@ func newCache(size int) *recordCache {
 		cache:        map[int64]*record{},
 		maxKeyRecord: nil,
 		size:         size,
+		index:        newCacheIndex(),
+		compare:      strings.Compare,
 	}
 }
 
-func (rc *recordCache) findLastLessThan(key string) int64 {
+// follow makes rc look up records in source, which must be for the
+// same data file.
+func (rc *recordCache) follow(source *recordCache) {
+	source.lock.RLock()
+	epoch := source.epoch
+	source.lock.RUnlock()
+	rc.lock.Lock()
+	rc.source = source
+	rc.sourceEpoch = epoch
+	rc.lock.Unlock()
+}
+
+// rlock read-locks the cache that records are looked up in, which is rc
+// or its source, and returns it. It returns nil if the source has been
+// reset since rc started following it.
+func (rc *recordCache) rlock() *recordCache {
 	rc.lock.RLock()
+	source, epoch := rc.source, rc.sourceEpoch
+	if source == nil {
+		return rc
+	}
+	rc.lock.RUnlock()
+	source.lock.RLock()
+	if source.epoch != epoch {
+		source.lock.RUnlock()
+		return nil
+	}
+	return source
+}
+
+// get returns the cached record at offset, or nil if there isn't one.
+func (rc *recordCache) get(offset int64) *record {
+	src := rc.rlock()
+	if src == nil {
+		return nil
+	}
+	defer src.lock.RUnlock()
+	return src.cache[offset]
+}
+
+func (rc *recordCache) findLastLessThan(key string) int64 {
+	rc = rc.rlock()
+	if rc == nil {
+		return 0
+	}
 	defer rc.lock.RUnlock()
 
 	if rc.maxKeyRecord != nil {
-		if rc.maxKeyRecord.Key < key {
+		if rc.compare(rc.maxKeyRecord.Key, key) < 0 {
 			return rc.maxKeyRecord.Offset
 		}
 	}
-	max := ""
-	maxOffset := int64(0)
 
-	for offset, record := range rc.cache {
-		if record.Key >= key {
-			continue
-		}
-		if record.Key > max {
-			max = record.Key
-			maxOffset = offset
-		}
+	rec := rc.index.lastLessThan(key, rc.compare)
+	if rec == nil {
+		return 0
+	}
+	return rec.Offset
+}
+
+// lookup returns the cached record of key with the largest offset,
+// or nil if none is cached.
+func (rc *recordCache) lookup(key string) *record {
+	rc = rc.rlock()
+	if rc == nil {
+		return nil
 	}
-	return maxOffset
+	defer rc.lock.RUnlock()
+	return rc.index.last(key, rc.compare)
+}
+
+// maxKeyOffset returns the offset of the record with the largest key
+// that has been cached, or 0 if there isn't one.
+func (rc *recordCache) maxKeyOffset() int64 {
+	rc = rc.rlock()
+	if rc == nil {
+		return 0
+	}
+	defer rc.lock.RUnlock()
+	if rc.maxKeyRecord == nil {
+		return 0
+	}
+	return rc.maxKeyRecord.Offset
 }
 
 func (rc *recordCache) push(rec *record) {
 	rc.lock.RLock()
+	if rc.source != nil {
+		rc.lock.RUnlock()
+		return
+	}
 
-	if rc.maxKeyRecord == nil || rc.maxKeyRecord.Key < rec.Key {
+	if rc.maxKeyRecord == nil || rc.compare(rc.maxKeyRecord.Key, rec.Key) < 0 {
 		rc.lock.RUnlock()
 
 		rc.lock.Lock()
-		if rc.maxKeyRecord == nil || rc.maxKeyRecord.Key < rec.Key {
+		if rc.maxKeyRecord == nil || rc.compare(rc.maxKeyRecord.Key, rec.Key) < 0 {
 			rc.maxKeyRecord = rec
 		}
 		rc.lock.Unlock()
@@ -60,7 +158,7 @@ func (rc *recordCache) push(rec *record) {
 		return
 	}
 
-	if len(rc.cache) == rc.size && rand.Float32() >= cacheProb {
+	if rc.full() && rand.Float32() >= cacheProb {
 		rc.lock.RUnlock()
 		return
 	}
@@ -68,34 +166,247 @@ func (rc *recordCache) push(rec *record) {
 	rc.lock.RUnlock()
 	rc.lock.Lock()
 
-	rc.cache[rec.Offset] = rec
+	rc.insert(rec)
 	if !rc.preventPurge {
 		rc.purge()
 	}
 
 	rc.lock.Unlock()
+
+	if rc.shared != nil && !rc.preventPurge {
+		// If the budget is still exceeded, this cache is within
+		// its fair share, so make room in the others.
+		rc.shared.evict(rc)
+	}
+}
+
+// pushWarm adds rec to the cache like push, but it's always added
+// rather than by chance once the cache is full.
+func (rc *recordCache) pushWarm(rec *record) {
+	rc.lock.Lock()
+	if rc.source != nil {
+		rc.lock.Unlock()
+		return
+	}
+	if rc.maxKeyRecord == nil || rc.compare(rc.maxKeyRecord.Key, rec.Key) < 0 {
+		rc.maxKeyRecord = rec
+	} else {
+		rc.insert(rec)
+		if !rc.preventPurge {
+			rc.purge()
+		}
+	}
+	rc.lock.Unlock()
+
+	if rc.shared != nil && !rc.preventPurge {
+		rc.shared.evict(rc)
+	}
+}
+
+// full returns true if the cache is at its size. rc.lock must be held.
+func (rc *recordCache) full() bool {
+	if rc.shared != nil {
+		return atomic.LoadInt64(&rc.shared.records) >= int64(rc.size)
+	}
+	return len(rc.cache) >= rc.size
 }
 
 func (rc *recordCache) purge() {
-	purged := 0
-	for len(rc.cache) > rc.size {
-		deletedKey := int64(0)
-		for k := range rc.cache {
-			if k == rc.maxKeyRecord.Offset {
-				continue
+	if rc.shared != nil {
+		share := rc.shared.fairShare()
+		for atomic.LoadInt64(&rc.shared.records) > int64(rc.size) && len(rc.cache) > share {
+			if !rc.evictOne() {
+				return
 			}
-			deletedKey = k
-			break
 		}
-		delete(rc.cache, deletedKey)
-		purged++
+		return
+	}
+	for len(rc.cache) > rc.size {
+		if !rc.evictOne() {
+			return
+		}
 	}
 }
 
+// evictOne removes a record other than maxKeyRecord from the cache.
+// It returns false if there isn't one. rc.lock must be held.
+func (rc *recordCache) evictOne() bool {
+	for k := range rc.cache {
+		if rc.maxKeyRecord != nil && k == rc.maxKeyRecord.Offset {
+			continue
+		}
+		rc.remove(k)
+		return true
+	}
+	return false
+}
+
 func (rc *recordCache) flushOffsets(offsets []int64) {
 	rc.lock.Lock()
 	for _, offset := range offsets {
-		delete(rc.cache, offset)
+		rc.remove(offset)
+	}
+	rc.lock.Unlock()
+}
+
+// reset removes all records from the cache.
+func (rc *recordCache) reset() {
+	rc.lock.Lock()
+	rc.setRecords(0)
+	rc.cache = map[int64]*record{}
+	rc.index = newCacheIndex()
+	rc.maxKeyRecord = nil
+	rc.epoch++
+	rc.lock.Unlock()
+}
+
+// setRecords updates the number of records in the cache, and the
+// shared budget if there is one. rc.lock must be held.
+func (rc *recordCache) setRecords(n int) {
+	delta := int64(n) - rc.records
+	atomic.StoreInt64(&rc.records, int64(n))
+	if rc.shared != nil {
+		atomic.AddInt64(&rc.shared.records, delta)
+	}
+}
+
+// insert adds rec to the cache, replacing any record at the same offset.
+// rc.lock must be held.
+func (rc *recordCache) insert(rec *record) {
+	rc.remove(rec.Offset)
+	rc.cache[rec.Offset] = rec
+	rc.setRecords(len(rc.cache))
+	rc.index.insert(rec, rc.compare)
+}
+
+// remove removes the record at offset from the cache.
+// rc.lock must be held.
+func (rc *recordCache) remove(offset int64) {
+	rec := rc.cache[offset]
+	if rec == nil {
+		return
+	}
+	delete(rc.cache, offset)
+	rc.setRecords(len(rc.cache))
+	rc.index.remove(rec, rc.compare)
+}
+
+// SharedCache is a cache budget shared by collections opened with it in
+// Options.SharedCache, so that many small collections don't each need a
+// cache of their own. Each collection caches its own records, but once
+// the budget is used up, a collection that has more than its fair share
+// of the budget (the size divided by the number of collections) evicts
+// its own records to make room, and one that has less evicts records of
+// the collection with the most.
+type SharedCache struct {
+	size int
+
+	lock    sync.Mutex
+	members map[*recordCache]struct{}
+	// numMembers is len(members), read without lock.
+	numMembers int64
+	// records is the number of records cached by all members.
+	records int64
+}
+
+// NewSharedCache returns a SharedCache that holds up to size records.
+func NewSharedCache(size int) *SharedCache {
+	return &SharedCache{
+		size:    size,
+		members: map[*recordCache]struct{}{},
+	}
+}
+
+// newCache returns a cache that's part of the shared budget.
+func (sc *SharedCache) newCache() *recordCache {
+	rc := newCache(sc.size)
+	rc.shared = sc
+	sc.lock.Lock()
+	sc.members[rc] = struct{}{}
+	atomic.StoreInt64(&sc.numMembers, int64(len(sc.members)))
+	sc.lock.Unlock()
+	return rc
+}
+
+// release removes rc from the shared budget.
+func (sc *SharedCache) release(rc *recordCache) {
+	sc.lock.Lock()
+	delete(sc.members, rc)
+	atomic.StoreInt64(&sc.numMembers, int64(len(sc.members)))
+	sc.lock.Unlock()
+	rc.reset()
+}
+
+// fairShare returns the number of records each member may keep
+// once the budget is used up.
+func (sc *SharedCache) fairShare() int {
+	n := atomic.LoadInt64(&sc.numMembers)
+	if n < 1 {
+		n = 1
+	}
+	share := sc.size / int(n)
+	if share < 1 {
+		share = 1
+	}
+	return share
+}
+
+// evict removes records from the member with the most records while
+// the budget is exceeded. No member's lock may be held.
+func (sc *SharedCache) evict(except *recordCache) {
+	for atomic.LoadInt64(&sc.records) > int64(sc.size) {
+		var victim *recordCache
+		sc.lock.Lock()
+		for rc := range sc.members {
+			if rc == except {
+				continue
+			}
+			if victim == nil || atomic.LoadInt64(&rc.records) > atomic.LoadInt64(&victim.records) {
+				victim = rc
+			}
+		}
+		sc.lock.Unlock()
+		if victim == nil {
+			return
+		}
+
+		victim.lock.Lock()
+		evicted := !victim.preventPurge && victim.evictOne()
+		victim.lock.Unlock()
+		if !evicted {
+			return
+		}
+	}
+}
+
+// release removes the cache from its shared budget, if it has one.
+func (rc *recordCache) release() {
+	if rc.shared != nil {
+		rc.shared.release(rc)
+	}
+}
+
+// resize sets the size of the cache and evicts records down to it.
+func (rc *recordCache) resize(size int) {
+	rc.lock.Lock()
+	rc.size = size
+	if !rc.preventPurge {
+		rc.purge()
 	}
 	rc.lock.Unlock()
 }
+
+// ResizeCache changes the number of records the collection's cache holds,
+// evicting records right away if it shrinks. It returns an error for
+// a negative size or a collection opened with Options.SharedCache, whose
+// size is that of the shared budget.
+func (c *Collection) ResizeCache(size int) error {
+	if size < 0 {
+		return errors.New("lm2: negative cache size")
+	}
+	if c.cache.shared != nil {
+		return errors.New("lm2: can't resize a shared cache")
+	}
+	c.cache.resize(size)
+	return nil
+}
@@ -0,0 +1,108 @@
+package lm2
+
+import (
+	"math"
+	"math/rand"
+)
+
+// cacheIndexMaxLevel is the number of levels of a cacheIndex, which is
+// plenty for caches of millions of records with a branching factor of 4.
+const cacheIndexMaxLevel = 16
+
+// cacheIndex is an in-memory skip list of the records in a recordCache,
+// sorted by key and then offset, so that inserts, removals and lookups
+// take O(log n) time.
+type cacheIndex struct {
+	head  cacheIndexNode
+	level int
+	len   int
+}
+
+type cacheIndexNode struct {
+	rec  *record
+	next []*cacheIndexNode
+}
+
+func newCacheIndex() *cacheIndex {
+	return &cacheIndex{
+		head:  cacheIndexNode{next: make([]*cacheIndexNode, cacheIndexMaxLevel)},
+		level: 1,
+	}
+}
+
+// before returns the last node that sorts before key and offset, or the
+// head if there isn't one. If prev is set, it gets the last such node at
+// each level.
+func (idx *cacheIndex) before(key string, offset int64, compare func(a, b string) int,
+	prev []*cacheIndexNode) *cacheIndexNode {
+	n := &idx.head
+	for level := idx.level - 1; level >= 0; level-- {
+		for next := n.next[level]; next != nil; next = n.next[level] {
+			cmp := compare(next.rec.Key, key)
+			if cmp > 0 || (cmp == 0 && next.rec.Offset >= offset) {
+				break
+			}
+			n = next
+		}
+		if prev != nil {
+			prev[level] = n
+		}
+	}
+	return n
+}
+
+// insert adds rec, which mustn't be in the index already.
+func (idx *cacheIndex) insert(rec *record, compare func(a, b string) int) {
+	var prev [cacheIndexMaxLevel]*cacheIndexNode
+	idx.before(rec.Key, rec.Offset, compare, prev[:])
+	level := 1
+	for level < cacheIndexMaxLevel && rand.Intn(4) == 0 {
+		level++
+	}
+	for ; idx.level < level; idx.level++ {
+		prev[idx.level] = &idx.head
+	}
+	n := &cacheIndexNode{rec: rec, next: make([]*cacheIndexNode, level)}
+	for i := range n.next {
+		n.next[i] = prev[i].next[i]
+		prev[i].next[i] = n
+	}
+	idx.len++
+}
+
+// remove removes rec if it's in the index.
+func (idx *cacheIndex) remove(rec *record, compare func(a, b string) int) {
+	var prev [cacheIndexMaxLevel]*cacheIndexNode
+	idx.before(rec.Key, rec.Offset, compare, prev[:])
+	n := prev[0].next[0]
+	if n == nil || n.rec != rec {
+		return
+	}
+	for i := range n.next {
+		prev[i].next[i] = n.next[i]
+	}
+	idx.len--
+}
+
+// lastLessThan returns the record with the largest key less than key,
+// or nil if there isn't one.
+func (idx *cacheIndex) lastLessThan(key string, compare func(a, b string) int) *record {
+	return idx.before(key, math.MinInt64, compare, nil).rec
+}
+
+// last returns the record of key with the largest offset, or nil if
+// there isn't one.
+func (idx *cacheIndex) last(key string, compare func(a, b string) int) *record {
+	rec := idx.before(key, math.MaxInt64, compare, nil).rec
+	if rec == nil || rec.Key != key {
+		return nil
+	}
+	return rec
+}
+
+// each calls f with the records in order.
+func (idx *cacheIndex) each(f func(rec *record)) {
+	for n := idx.head.next[0]; n != nil; n = n.next[0] {
+		f(n.rec)
+	}
+}
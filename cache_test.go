@@ -0,0 +1,173 @@
+package lm2
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestCacheFindLastLessThan(t *testing.T) {
+	rc := newCache(100)
+	for i, n := range rand.Perm(50) {
+		rc.push(&record{
+			Offset: int64(i + 1),
+			Key:    fmt.Sprintf("%03d", n*2),
+		})
+	}
+
+	for n := 0; n < 100; n++ {
+		key := fmt.Sprintf("%03d", n)
+		expected := ""
+		for _, rec := range rc.cache {
+			if rec.Key < key && rec.Key > expected {
+				expected = rec.Key
+			}
+		}
+		if rc.maxKeyRecord.Key < key {
+			expected = rc.maxKeyRecord.Key
+		}
+
+		offset := rc.findLastLessThan(key)
+		if expected == "" {
+			if offset != 0 {
+				t.Errorf("expected no result for %s, got offset %d", key, offset)
+			}
+			continue
+		}
+		rec := rc.cache[offset]
+		if rec == nil && offset == rc.maxKeyRecord.Offset {
+			rec = rc.maxKeyRecord
+		}
+		if rec == nil || rec.Key != expected {
+			t.Errorf("expected %s for %s, got offset %d", expected, key, offset)
+		}
+	}
+
+	// Evicted records must not be returned.
+	for offset := range rc.cache {
+		rc.flushOffsets([]int64{offset})
+	}
+	if offset := rc.findLastLessThan("050"); offset != 0 {
+		t.Errorf("expected no result after flush, got offset %d", offset)
+	}
+}
+
+// BenchmarkCacheFindLastLessThan measures a lookup along with the push
+// and eviction that keep a full cache of 100k records turning over.
+func BenchmarkCacheFindLastLessThan(b *testing.B) {
+	const size = 100000
+	rc := newCache(size)
+	keys := make([]string, 2*size)
+	for i, n := range rand.Perm(len(keys)) {
+		keys[i] = fmt.Sprintf("%08d", n)
+	}
+	for i := 0; i < size; i++ {
+		rc.pushWarm(&record{
+			Offset: int64(i + 1),
+			Key:    keys[i],
+		})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rc.pushWarm(&record{
+			Offset: int64(size + i + 1),
+			Key:    keys[(size+i)%len(keys)],
+		})
+		rc.findLastLessThan(keys[i%len(keys)])
+	}
+}
+
+func TestSharedCache(t *testing.T) {
+	sc := NewSharedCache(100)
+	a := sc.newCache()
+	b := sc.newCache()
+	push := func(rc *recordCache, n int) {
+		for i, k := range rand.Perm(n) {
+			rc.push(&record{
+				Offset: int64(i + 1),
+				Key:    fmt.Sprintf("%06d", k),
+			})
+		}
+	}
+
+	push(a, 10000)
+	if n := len(a.cache); n < 90 || n > 100 {
+		t.Errorf("expected the first cache to use the budget, got %d records", n)
+	}
+
+	push(b, 10000)
+	if n := len(a.cache); n != 50 {
+		t.Errorf("expected the first cache to shrink to its fair share, got %d records", n)
+	}
+	if n := len(b.cache); n != 50 {
+		t.Errorf("expected the second cache to get its fair share, got %d records", n)
+	}
+	if n := sc.records; n != 100 {
+		t.Errorf("expected 100 shared records, got %d", n)
+	}
+
+	sc.release(b)
+	if n := sc.records; n != 50 {
+		t.Errorf("expected 50 shared records after release, got %d", n)
+	}
+	push(a, 10000)
+	if n := len(a.cache); n < 90 || n > 100 {
+		t.Errorf("expected the remaining cache to use the budget, got %d records", n)
+	}
+}
+
+func TestResizeCache(t *testing.T) {
+	c, err := NewCollection("/tmp/test_resizecache.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 1000; i++ {
+		wb.Set(fmt.Sprintf("%04d", i), "value")
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Warmup("", ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.Stats().CacheRecords; n < 90 {
+		t.Fatalf("expected a warm cache, got %d records", n)
+	}
+	maxKeyOffset := c.cache.maxKeyOffset()
+
+	if err = c.ResizeCache(10); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.Stats().CacheRecords; n > 10 {
+		t.Errorf("expected at most 10 records after shrinking, got %d", n)
+	}
+	if offset := c.cache.maxKeyOffset(); offset != maxKeyOffset {
+		t.Errorf("expected the max key record to be kept, got offset %d instead of %d", offset, maxKeyOffset)
+	}
+
+	if err = c.ResizeCache(500); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Warmup("", ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.Stats().CacheRecords; n <= 100 {
+		t.Errorf("expected more than 100 records after growing, got %d", n)
+	}
+
+	if err = c.ResizeCache(-1); err == nil {
+		t.Error("expected an error for a negative size")
+	}
+	shared, err := NewCollectionWithOptions("/tmp/test_resizecache_shared.lm2", Options{SharedCache: NewSharedCache(100)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shared.Destroy()
+	if err = shared.ResizeCache(10); err == nil {
+		t.Error("expected an error for a shared cache")
+	}
+}
@@ -0,0 +1,87 @@
+package lm2
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// CompareAndSwap sets key to new if its current value is old. A missing key
+// is treated as having an empty value, so an old value of "" also matches
+// a key that doesn't exist. The comparison and the update happen atomically
+// with respect to other updates. It returns whether the swap happened and
+// the version of the collection after the call.
+func (c *Collection) CompareAndSwap(key, old, new string) (bool, int64, error) {
+	if c.readOnly {
+		return false, 0, ErrReadOnly
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return false, 0, ErrInternal
+	}
+
+	c.metaLock.RLock()
+	rec, err := c.get(key)
+	version := c.LastCommit
+	c.metaLock.RUnlock()
+	if err != nil {
+		return false, 0, err
+	}
+
+	current := ""
+	if rec != nil {
+		current, err = c.recordValue(rec)
+		if err != nil {
+			return false, 0, err
+		}
+	}
+	if current != old {
+		return false, version, nil
+	}
+
+	wb := NewWriteBatch()
+	wb.Set(key, new)
+	version, err = c.apply(context.Background(), wb)
+	if err != nil {
+		return false, 0, err
+	}
+	return true, version, nil
+}
+
+// PutIfAbsent sets key to value if key doesn't exist. The check and the
+// update happen atomically with respect to other updates. It returns
+// whether value was inserted and the version of the collection after
+// the call.
+func (c *Collection) PutIfAbsent(key, value string) (bool, int64, error) {
+	if c.readOnly {
+		return false, 0, ErrReadOnly
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return false, 0, ErrInternal
+	}
+
+	c.metaLock.RLock()
+	rec, err := c.get(key)
+	version := c.LastCommit
+	c.metaLock.RUnlock()
+	if err != nil {
+		return false, 0, err
+	}
+	if rec != nil {
+		return false, version, nil
+	}
+
+	wb := NewWriteBatch()
+	wb.Set(key, value)
+	version, err = c.apply(context.Background(), wb)
+	if err != nil {
+		return false, 0, err
+	}
+	return true, version, nil
+}
@@ -0,0 +1,157 @@
+package lm2
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// ChangeType is the kind of a Change.
+type ChangeType int
+
+const (
+	// ChangePut means a key was set.
+	ChangePut ChangeType = iota
+	// ChangeDelete means a key was deleted.
+	ChangeDelete
+)
+
+// Change is a modification made by an Update.
+type Change struct {
+	Type ChangeType
+	Key  string
+	// Value is the value that was set. It's empty for deletes.
+	Value string
+	// Version is the version returned by the Update that made the change.
+	Version int64
+}
+
+// pendingChange is a change found by ChangesSince whose value
+// hasn't been read yet.
+type pendingChange struct {
+	Change
+	offset int64
+}
+
+// ChangesSince calls fn with each change made after version, up to the
+// version the collection had when ChangesSince was called, until fn
+// returns false. Changes are ordered by version, and changes made by
+// the same Update are ordered by key. Overwriting a key is reported as
+// a put. ErrInvalidVersion is returned if version is newer than the last
+// committed version.
+//
+// Changes are found by reading the whole data file, so they're only
+// available until the collection is compacted; ErrStale is returned if
+// that happens during the call.
+func (c *Collection) ChangesSince(version int64, fn func(change Change) bool) error {
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return ErrInternal
+	}
+
+	c.metaLock.RLock()
+	end := c.LastCommit
+	generation := c.generation
+	c.metaLock.RUnlock()
+	if version > end || version < 0 {
+		return ErrInvalidVersion
+	}
+
+	changes, err := c.findChanges(version, end, generation)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		if change.Type == ChangePut {
+			c.metaLock.RLock()
+			if c.generation != generation {
+				c.metaLock.RUnlock()
+				return ErrStale
+			}
+			rec, err := c.readRecord(change.offset, false)
+			c.metaLock.RUnlock()
+			if err == nil {
+				change.Value, err = c.recordValue(rec)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if !fn(change.Change) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// findChanges reads the data file up to end and returns the changes made
+// after version, in order.
+func (c *Collection) findChanges(version, end int64, generation uint64) ([]pendingChange, error) {
+	type putKey struct {
+		key     string
+		version int64
+	}
+	changes := []pendingChange{}
+	deletes := []pendingChange{}
+	puts := map[putKey]bool{}
+
+	// The version of a commit is only known once its sentinel is read.
+	commit := []*record{}
+	c.metaLock.RLock()
+	offset := c.firstRecord
+	c.metaLock.RUnlock()
+	for offset < end {
+		c.metaLock.RLock()
+		if c.generation != generation {
+			c.metaLock.RUnlock()
+			return nil, ErrStale
+		}
+		rec, next, err := c.readPhysical(offset)
+		c.metaLock.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		offset = next
+
+		if rec != nil {
+			if len(commit) > 0 && commit[len(commit)-1].Key == rec.Key {
+				// A copy of the previous record for another level.
+				continue
+			}
+			commit = append(commit, rec)
+			continue
+		}
+
+		commitVersion := next
+		for _, rec := range commit {
+			if commitVersion > version {
+				changes = append(changes, pendingChange{
+					Change: Change{Type: ChangePut, Key: rec.Key, Version: commitVersion},
+					offset: rec.Offset,
+				})
+				puts[putKey{rec.Key, commitVersion}] = true
+			}
+			deleted := atomic.LoadInt64(&rec.Deleted)
+			if deleted > version && deleted <= end {
+				deletes = append(deletes, pendingChange{
+					Change: Change{Type: ChangeDelete, Key: rec.Key, Version: deleted},
+				})
+			}
+		}
+		commit = commit[:0]
+	}
+
+	// A record is also marked deleted when it's overwritten,
+	// which is reported as the put of the new record.
+	for _, change := range deletes {
+		if !puts[putKey{change.Key, change.Version}] {
+			changes = append(changes, change)
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].Version != changes[j].Version {
+			return changes[i].Version < changes[j].Version
+		}
+		return c.compare(changes[i].Key, changes[j].Key) < 0
+	})
+	return changes, nil
+}
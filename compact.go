@@ -0,0 +1,328 @@
+package lm2
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultAutoCompactRatio is used if Options.AutoCompactRatio isn't set.
+const defaultAutoCompactRatio = 0.5
+
+var errCompactionCanceled = errors.New("lm2: compaction canceled")
+
+// autoCompactor tracks automatic compactions.
+type autoCompactor struct {
+	lock      sync.Mutex
+	running   bool
+	last      time.Time
+	reclaimed int64
+	// retained is the number of dead bytes the last compaction kept
+	// for snapshots, which don't count towards AutoCompactRatio. It's
+	// protected by metaLock.
+	retained int64
+}
+
+// writeCompacted writes the live records of the collection, transformed
+// by f, to a new data file next to the current one and returns its name.
+// The new data file gets an index file if Options.IndexCheckpointInterval
+// is set.
+// Values are stored out of line by Options.BlobThreshold in a new blob
+// file, unless keepBlobs is true, in which case f isn't called for values
+// that are already in the blob file and the new data file refers to them
+// there. If retain is set, the records visible at each of its versions,
+// which must be in ascending order and before the last commit, are kept
+// as well: the new data file gets the changes from one version to the
+// next as commits of their own, and the new versions are returned in the
+// same order. f must keep every record as it is then. It gives up if stop
+// is closed. writeLock must be held.
+func (c *Collection) writeCompacted(f func(key, value string) (string, string, bool),
+	keepBlobs bool, retain []int64, stop <-chan struct{}) (string, []int64, error) {
+	blobThreshold := c.options.BlobThreshold
+	if keepBlobs {
+		blobThreshold = 0
+	}
+	newCollection, err := NewCollectionWithOptions(c.f.Name()+".compact", Options{
+		CacheSize:      10,
+		FileMode:       c.options.FileMode,
+		Comparator:     c.options.Comparator,
+		ComparatorName: c.options.ComparatorName,
+		BlobThreshold:  blobThreshold,
+
+		IndexCheckpointInterval: c.options.IndexCheckpointInterval,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	versions := []int64{}
+	from := int64(0)
+	for _, to := range append(append([]int64{}, retain...), c.LastCommit) {
+		err = c.writeChanges(newCollection, from, to, f, keepBlobs, stop)
+		if err != nil {
+			newCollection.Destroy()
+			return "", nil, err
+		}
+		versions = append(versions, newCollection.Version())
+		from = to
+	}
+	newCollection.Close()
+	return newCollection.f.Name(), versions[:len(retain)], nil
+}
+
+// writeChanges updates dst with the changes to the collection from
+// version from to version to, transformed by f, in batches. From
+// version 0 every record visible at to is set.
+// See writeCompacted.
+func (c *Collection) writeChanges(dst *Collection, from, to int64,
+	f func(key, value string) (string, string, bool), keepBlobs bool, stop <-chan struct{}) error {
+	// Without anything to compare, the cursor at from is empty.
+	old := &Cursor{collection: c}
+	c.metaLock.RLock()
+	cur, err := c.newCursor(to)
+	if err == nil && from > 0 {
+		old, err = c.newCursor(from)
+	}
+	c.metaLock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	const batchSize = 1000
+	remaining := batchSize
+	wb := NewWriteBatch()
+	oldOK, curOK := old.Next(), cur.Next()
+	for oldOK || curOK {
+		cmp := 1
+		if !curOK {
+			cmp = -1
+		} else if oldOK {
+			cmp = c.compare(old.Key(), cur.Key())
+		}
+		if cmp < 0 {
+			wb.Delete(old.Key())
+			oldOK = old.Next()
+		} else {
+			if cmp == 0 {
+				unchanged := old.current.Offset == cur.current.Offset
+				oldOK = old.Next()
+				if unchanged {
+					curOK = cur.Next()
+					continue
+				}
+			}
+			keep := true
+			if keepBlobs && cur.current.Flags&recordFlagBlob != 0 {
+				wb.setBlob(cur.Key(), cur.current.blob, cur.current.ExpiresAt)
+			} else {
+				var key, val string
+				key, val, keep = f(cur.Key(), cur.Value())
+				if keep && cur.current.ExpiresAt != 0 {
+					wb.setExpiresAt(key, val, cur.current.ExpiresAt)
+				} else if keep {
+					wb.Set(key, val)
+				}
+			}
+			curOK = cur.Next()
+			if !keep {
+				continue
+			}
+		}
+		remaining--
+
+		if remaining == 0 {
+			select {
+			case <-stop:
+				return errCompactionCanceled
+			default:
+			}
+			_, err := dst.Update(wb)
+			if err != nil {
+				return err
+			}
+			remaining = batchSize
+			wb = NewWriteBatch()
+		}
+	}
+	if err = old.Err(); err != nil {
+		return err
+	}
+	if err = cur.Err(); err != nil {
+		return err
+	}
+	if remaining < batchSize {
+		_, err := dst.Update(wb)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactOnline compacts the collection and switches to the new data file
+// while keeping the collection open. It returns the number of bytes
+// reclaimed. Cursors and snapshots created before the switch return
+// ErrStale, except for snapshots kept with Options.RetainSnapshots.
+// writeLock must be held.
+func (c *Collection) compactOnline(stop <-chan struct{}) (int64, error) {
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return 0, ErrInternal
+	}
+
+	oldSize := c.LastCommit
+	snapshots, retain := c.retainedSnapshots()
+	compacted, versions, err := c.writeCompacted(func(key, value string) (string, string, bool) {
+		return key, value, true
+	}, true, retain, stop)
+	if err != nil {
+		return 0, err
+	}
+
+	// Everything is in the current data file, so the WAL can be emptied.
+	// It must be, or recovery would apply it to the compacted file.
+	err = c.sync()
+	if err == nil {
+		err = c.wal.Truncate()
+	}
+	if err == nil {
+		err = c.wal.sync()
+	}
+	if err != nil {
+		os.Remove(compacted)
+		return 0, err
+	}
+
+	// Lock the new data file before it replaces the old one, so no other
+	// process can open it in between.
+	lock, err := os.Open(compacted)
+	if err == nil {
+		err = tryLock(lock, true)
+		if err != nil {
+			lock.Close()
+		}
+	}
+	if err != nil {
+		os.Remove(compacted)
+		return 0, err
+	}
+
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+	err = renameCompanion(indexFile(compacted), indexFile(c.f.Name()))
+	if err == nil {
+		err = os.Rename(compacted, c.f.Name())
+	}
+	if err != nil {
+		lock.Close()
+		os.Remove(compacted)
+		os.Remove(indexFile(compacted))
+		return 0, err
+	}
+	if c.lock != nil {
+		c.lock.replace(lock)
+	} else {
+		lock.Close()
+	}
+	f, err := openDataFile(c.f.Name(), os.O_RDWR, 0, c.options.OpTimeout)
+	if err != nil {
+		return 0, c.markInconsistent(err)
+	}
+	c.f.Close()
+	c.f = f
+	c.readAt = f.ReadAt
+	c.writeAt = f.WriteAt
+	err = c.readFileHeader()
+	if err != nil {
+		return 0, c.markInconsistent(err)
+	}
+	c.cache.reset()
+	c.shipper.reset()
+	c.lastCommitInfo = CommitInfo{}
+	c.generation++
+	c.indexCount = 0
+	c.loadIndex()
+	c.remapSnapshots(snapshots, oldSize, retain, versions)
+	c.autoCompactor.retained = 0
+	if len(retain) > 0 {
+		c.autoCompactor.retained = c.DeadBytes
+	}
+	return oldSize - c.LastCommit, nil
+}
+
+// maybeAutoCompact starts a background compaction if automatic compaction
+// is enabled, enough of the data file is dead and none is running.
+// metaLock must be held.
+func (c *Collection) maybeAutoCompact() {
+	if !c.options.AutoCompact || c.LastCommit == 0 {
+		return
+	}
+	ratio := c.options.AutoCompactRatio
+	if ratio <= 0 {
+		ratio = defaultAutoCompactRatio
+	}
+	if float64(c.DeadBytes-c.autoCompactor.retained)/float64(c.LastCommit) <= ratio {
+		return
+	}
+
+	c.autoCompactor.lock.Lock()
+	defer c.autoCompactor.lock.Unlock()
+	if c.autoCompactor.running {
+		return
+	}
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+	c.autoCompactor.running = true
+	c.background.Add(1)
+	go c.runAutoCompaction()
+}
+
+func (c *Collection) runAutoCompaction() {
+	defer c.background.Done()
+	defer func() {
+		c.autoCompactor.lock.Lock()
+		c.autoCompactor.running = false
+		c.autoCompactor.lock.Unlock()
+	}()
+
+	if !c.lockWriteBackground() {
+		return
+	}
+	defer c.writeLock.Unlock()
+	c.logf("starting automatic compaction")
+	reclaimed, err := c.compactOnline(c.closed)
+	if err != nil {
+		if err != errCompactionCanceled {
+			c.logf("automatic compaction failed: %v", err)
+		}
+		return
+	}
+	c.logf("automatic compaction reclaimed %d bytes", reclaimed)
+	c.autoCompactor.lock.Lock()
+	c.autoCompactor.last = time.Now()
+	c.autoCompactor.reclaimed = reclaimed
+	c.autoCompactor.lock.Unlock()
+}
+
+// lockWriteBackground acquires writeLock for a background goroutine.
+// It returns false without the lock once the collection is closed,
+// since Close may be waiting for the goroutine while writeLock is held.
+func (c *Collection) lockWriteBackground() bool {
+	for !c.writeLock.TryLock() {
+		select {
+		case <-c.closed:
+			return false
+		case <-time.After(time.Millisecond):
+		}
+	}
+	select {
+	case <-c.closed:
+		c.writeLock.Unlock()
+		return false
+	default:
+	}
+	return true
+}
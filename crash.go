@@ -0,0 +1,43 @@
+package lm2
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// crashPoint is a point in an update where tests can simulate a crash.
+type crashPoint int
+
+const (
+	// crashAfterAppend is after the records are appended to the data
+	// file and before the sentinel is.
+	crashAfterAppend crashPoint = iota
+	// crashAfterSentinel is after the sentinel is written and synced
+	// and before the WAL entry is written.
+	crashAfterSentinel
+	// crashAfterPrepared is after an UpdateAll decides to commit and
+	// before the WAL entry is written.
+	crashAfterPrepared
+	// crashAfterWAL is after the WAL entry is written and before it's
+	// applied to the data file.
+	crashAfterWAL
+	// crashDuringApply is after the first header of the WAL entry is
+	// written to the data file.
+	crashDuringApply
+	// crashAfterApply is after the WAL entry is applied and synced
+	// and before the new version is visible.
+	crashAfterApply
+)
+
+var errSimulatedCrash = errors.New("lm2: simulated crash")
+
+// crashed returns true if c.crashHook asks for a crash at point. The
+// collection then stops, leaving its files as a crash there would, and
+// Close leaves the WAL in place for recovery.
+func (c *Collection) crashed(point crashPoint) bool {
+	if c.crashHook == nil || !c.crashHook(point) {
+		return false
+	}
+	atomic.StoreUint32(&c.internalState, 1)
+	return true
+}
@@ -0,0 +1,309 @@
+package lm2
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestCrashRecovery(t *testing.T) {
+	// The batch below overwrites the even keys, deletes 5 and adds "new".
+	kvs := []KV{}
+	for i := 0; i < 20; i++ {
+		if i%2 == 0 {
+			kvs = append(kvs, KV{fmt.Sprint(i), "new"})
+		} else if i != 5 {
+			kvs = append(kvs, KV{fmt.Sprint(i), "old"})
+		}
+	}
+	kvs = append(kvs, KV{"new", "new"})
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	after := fmt.Sprint(kvs)
+
+	for _, test := range []struct {
+		point     crashPoint
+		committed bool
+	}{
+		{crashAfterAppend, false},
+		{crashAfterSentinel, false},
+		{crashAfterWAL, true},
+		{crashDuringApply, true},
+		{crashAfterApply, true},
+	} {
+		testCrashRecovery(t, test.point, test.committed, after, false)
+		testCrashRecovery(t, test.point, test.committed, after, true)
+	}
+}
+
+// testCrashRecovery crashes an update at point and checks the collection
+// after recovery, reopening it or, if reload is set, with Reload. after is
+// the collection's contents if the update committed.
+func testCrashRecovery(t *testing.T, point crashPoint, committed bool, after string, reload bool) {
+	const file = "/tmp/test_crashrecovery.lm2"
+	contents := func(c *Collection) string {
+		kvs, err := c.Range("", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(kvs)
+	}
+
+	c, err := NewCollection(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb := NewWriteBatch()
+	for i := 0; i < 20; i++ {
+		wb.Set(fmt.Sprint(i), "old")
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := contents(c)
+
+	wb = NewWriteBatch()
+	for i := 0; i < 20; i += 2 {
+		wb.Set(fmt.Sprint(i), "new")
+	}
+	wb.Delete("5")
+	wb.Set("new", "new")
+	c.crashHook = func(at crashPoint) bool {
+		return at == point
+	}
+	_, err = c.Update(wb)
+	if err != errSimulatedCrash {
+		t.Fatalf("crash point %d: expected a simulated crash, got %v", point, err)
+	}
+	if reload {
+		c.crashHook = nil
+		err = c.Reload()
+	} else {
+		c.Close()
+		c, err = OpenCollection(file, 100)
+	}
+	if err != nil {
+		t.Fatalf("crash point %d: %v", point, err)
+	}
+	expected := before
+	if committed {
+		expected = after
+	}
+	if got := contents(c); got != expected {
+		t.Errorf("crash point %d: expected %s, got %s", point, expected, got)
+	}
+	if err = c.Verify(); err != nil {
+		t.Errorf("crash point %d: %v", point, err)
+	}
+
+	wb = NewWriteBatch()
+	wb.Set("after", "crash")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Errorf("crash point %d: %v", point, err)
+	}
+	c.Destroy()
+}
+
+func TestCrashRecoveryMultipleEntries(t *testing.T) {
+	const file = "/tmp/test_crashrecovery_multiple.lm2"
+	c, err := NewCollection(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.Destroy()
+	}()
+	update := func(keys ...string) error {
+		wb := NewWriteBatch()
+		for _, key := range keys {
+			wb.Set(key, key)
+		}
+		_, err := c.Update(wb)
+		return err
+	}
+
+	if err = update("a", "c", "e"); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = update("b", "d"); err != nil {
+		t.Fatal(err)
+	}
+	first, err := os.ReadFile(file + ".wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.crashHook = func(point crashPoint) bool {
+		return point == crashDuringApply
+	}
+	if err = update("f"); err != errSimulatedCrash {
+		t.Fatalf("expected a simulated crash, got %v", err)
+	}
+	c.Close()
+
+	// Undo what the first entry wrote over the records that were there
+	// before it, as if it was only partially applied, and put both
+	// entries in the WAL.
+	second, err := os.ReadFile(file + ".wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(file+".wal", append(first, second...), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt(before, 0)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = OpenCollection(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvs, err := c.Range("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := fmt.Sprint(kvs), "[{a a} {b b} {c c} {d d} {e e} {f f}]"; got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+	if err = c.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCrashRecoveryLeftoverEntry(t *testing.T) {
+	const file = "/tmp/test_crashrecovery_leftover.lm2"
+	c, err := NewCollection(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.Destroy()
+	}()
+	update := func(keys ...string) []byte {
+		t.Helper()
+		wb := NewWriteBatch()
+		for _, key := range keys {
+			wb.Set(key, key)
+		}
+		if _, err := c.Update(wb); err != nil {
+			t.Fatal(err)
+		}
+		entry, err := os.ReadFile(file + ".wal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entry
+	}
+
+	first := update("a", "c")
+	second := update("b")
+	c.Close()
+
+	// The entry of an older commit follows the last one, as if the WAL
+	// couldn't be shrunk after it. It mustn't be applied again.
+	err = os.WriteFile(file+".wal", append(second, first...), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = OpenCollection(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvs, err := c.Range("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := fmt.Sprint(kvs), "[{a a} {b b} {c c}]"; got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+	if err = c.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCrashRecoveryHeaderOnly(t *testing.T) {
+	const file = "/tmp/test_crashrecovery_headeronly.lm2"
+	c, err := NewCollection(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.Destroy()
+	}()
+	update := func(keys ...string) {
+		t.Helper()
+		wb := NewWriteBatch()
+		for _, key := range keys {
+			wb.Set(key, key)
+		}
+		if _, err := c.Update(wb); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	update("a", "c")
+	before, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update("b")
+	data, err := os.ReadFile(file + ".wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// Undo the rewrites of existing records but keep the new header, as
+	// if only the header reached the disk before a power loss.
+	err = os.WriteFile(file+".wal", data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := readWALEntry(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range entry.records {
+		if rec.Offset == 0 || rec.Offset >= int64(len(before)) {
+			continue
+		}
+		end := rec.Offset + int64(len(rec.Data))
+		if _, err := f.WriteAt(before[rec.Offset:end], rec.Offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	c, err = OpenCollection(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvs, err := c.Range("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := fmt.Sprint(kvs), "[{a a} {b b} {c c}]"; got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+	if err = c.Verify(); err != nil {
+		t.Error(err)
+	}
+}
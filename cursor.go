@@ -1,6 +1,14 @@
 package lm2
 
-import "sync/atomic"
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"strings"
+	"sync/atomic"
+)
 
 // Cursor represents a snapshot cursor.
 type Cursor struct {
@@ -9,6 +17,14 @@ type Cursor struct {
 	first      bool
 	snapshot   int64
 	err        error
+
+	// generation is the collection generation the cursor was created in.
+	generation uint64
+
+	// prefix, if set, limits the cursor to keys with this prefix.
+	prefix string
+	// includeDeleted makes the cursor land on deleted records too.
+	includeDeleted bool
 }
 
 // NewCursor returns a new cursor with a snapshot view of the
@@ -20,36 +36,80 @@ func (c *Collection) NewCursor() (*Cursor, error) {
 
 	c.metaLock.RLock()
 	defer c.metaLock.RUnlock()
+	return c.newCursor(c.LastCommit)
+}
+
+// newCursor returns a cursor that only sees records visible
+// at snapshot. metaLock must be held.
+func (c *Collection) newCursor(snapshot int64) (*Cursor, error) {
+	cur := &Cursor{}
+	if err := cur.reset(c, snapshot); err != nil {
+		return nil, err
+	}
+	return cur, nil
+}
+
+// NewCursorWithDeleted is like NewCursor, but the cursor also lands on
+// records that were deleted or overwritten by the snapshot, so that
+// tombstones can be inspected until compaction removes them. The records
+// of a key come oldest first. Deleted and DeletedVersion tell deleted
+// records from live ones. Expired records are still skipped.
+func (c *Collection) NewCursorWithDeleted() (*Cursor, error) {
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return nil, ErrInternal
+	}
+
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	cur := &Cursor{}
+	if err := cur.resetWith(c, c.LastCommit, true); err != nil {
+		return nil, err
+	}
+	return cur, nil
+}
+
+// reset positions cur at the start of c as of snapshot, clearing
+// everything else. metaLock must be held.
+func (cur *Cursor) reset(c *Collection, snapshot int64) error {
+	return cur.resetWith(c, snapshot, false)
+}
+
+// resetWith is reset for a cursor that includes deleted records
+// if includeDeleted is true.
+func (cur *Cursor) resetWith(c *Collection, snapshot int64, includeDeleted bool) error {
+	*cur = Cursor{
+		collection:     c,
+		snapshot:       snapshot,
+		generation:     c.generation,
+		includeDeleted: includeDeleted,
+	}
 	if c.Next[0] == 0 {
-		return &Cursor{
-			collection: c,
-			current:    nil,
-			first:      false,
-			snapshot:   c.LastCommit,
-		}, nil
+		return nil
 	}
 
 	head, err := c.readRecord(c.Next[0], false)
 	if err != nil {
-		return nil, err
-	}
-	cur := &Cursor{
-		collection: c,
-		current:    head,
-		first:      true,
-		snapshot:   c.LastCommit,
+		return err
 	}
+	cur.current = head
+	cur.first = true
 
 	var rec *record
 	cur.current.lock.RLock()
-	for (cur.current.Deleted != 0 && cur.current.Deleted <= cur.snapshot) ||
-		(cur.current.Offset >= cur.snapshot) {
+	for !cur.visible(cur.current) {
+		if atomic.LoadInt64(&cur.current.Next[0]) == 0 {
+			// Nothing is visible in this snapshot.
+			cur.current.lock.RUnlock()
+			cur.current = nil
+			cur.first = false
+			return nil
+		}
 		rec, err = cur.collection.readRecord(atomic.LoadInt64(&cur.current.Next[0]), false)
 		if err != nil {
 			cur.current.lock.RUnlock()
 			cur.current = nil
 			cur.err = err
-			return cur, nil
+			return nil
 		}
 		cur.current.lock.RUnlock()
 		cur.current = rec
@@ -57,9 +117,74 @@ func (c *Collection) NewCursor() (*Cursor, error) {
 	}
 	cur.current.lock.RUnlock()
 
+	return nil
+}
+
+// Reset makes cur a new cursor over c, as if it was returned by
+// c.NewCursor, so that it can be reused instead of allocating a new one.
+// On error the cursor isn't valid.
+func (cur *Cursor) Reset(c *Collection) error {
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		*cur = Cursor{collection: c, err: ErrInternal}
+		return ErrInternal
+	}
+
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	err := cur.reset(c, c.LastCommit)
+	if err != nil {
+		*cur = Cursor{collection: c, err: err}
+	}
+	return err
+}
+
+// GetCursor is like NewCursor but it reuses a cursor returned by
+// PutCursor if there is one. An error creating the cursor is
+// returned by its Err method.
+func (c *Collection) GetCursor() *Cursor {
+	cur, _ := c.cursors.Get().(*Cursor)
+	if cur == nil {
+		cur = &Cursor{}
+	}
+	cur.Reset(c)
+	return cur
+}
+
+// PutCursor returns cur to c to be reused by GetCursor.
+// cur must not be used afterwards.
+func (c *Collection) PutCursor(cur *Cursor) {
+	*cur = Cursor{}
+	c.cursors.Put(cur)
+}
+
+// NewPrefixCursor returns a new snapshot cursor positioned before the
+// first key with the given prefix. Next returns false once the cursor
+// moves past the keys that share the prefix. An empty prefix iterates
+// over the whole collection. With Options.Comparator, keys with the
+// prefix have to sort together.
+func (c *Collection) NewPrefixCursor(prefix string) (*Cursor, error) {
+	cur, err := c.NewCursor()
+	if err != nil {
+		return nil, err
+	}
+	cur.prefix = prefix
+	if prefix != "" {
+		cur.Seek(prefix)
+		if err = cur.Err(); err != nil {
+			return nil, err
+		}
+	}
 	return cur, nil
 }
 
+// visible returns true if the cursor can land on rec.
+func (c *Cursor) visible(rec *record) bool {
+	if c.includeDeleted {
+		return rec.Offset < c.snapshot && !rec.expired()
+	}
+	return rec.visible(c.snapshot)
+}
+
 // Valid returns true if the cursor's Key() and Value()
 // methods can be called. It returns false if the cursor
 // isn't at a valid record position.
@@ -70,14 +195,58 @@ func (c *Cursor) Valid() bool {
 // Next moves the cursor to the next record. It returns true
 // if it lands on a valid record.
 func (c *Cursor) Next() bool {
+	for c.next() {
+		if c.prefix == "" {
+			return true
+		}
+		if c.collection.compare(c.current.Key, c.prefix) < 0 {
+			continue
+		}
+		if strings.HasPrefix(c.current.Key, c.prefix) {
+			return true
+		}
+		// Keys are ordered, so there's nothing left with the prefix.
+		c.current = nil
+		return false
+	}
+	return false
+}
+
+// NextN moves the cursor over up to n records and returns them, as if
+// Next was called n times. Fewer records are returned once the cursor
+// reaches the end, and none if it's already there. If the cursor stops
+// because of an error, the records read before it are returned with
+// the error, which Err keeps reporting.
+func (c *Cursor) NextN(n int) ([]KV, error) {
+	kvs := []KV{}
+	for len(kvs) < n && c.Next() {
+		key := c.current.Key
+		value := c.Value()
+		if c.err != nil {
+			break
+		}
+		kvs = append(kvs, KV{Key: key, Value: value})
+	}
+	return kvs, c.err
+}
+
+func (c *Cursor) next() bool {
 	if atomic.LoadUint32(&c.collection.internalState) != 0 {
 		c.current = nil
 		return false
 	}
 
+	c.collection.metaLock.RLock()
+	defer c.collection.metaLock.RUnlock()
+
 	if !c.Valid() {
 		return false
 	}
+	if c.generation != c.collection.generation {
+		c.err = ErrStale
+		c.current = nil
+		return false
+	}
 
 	if c.first {
 		c.first = false
@@ -98,8 +267,7 @@ func (c *Cursor) Next() bool {
 	c.current = rec
 
 	c.current.lock.RLock()
-	for (atomic.LoadInt64(&c.current.Deleted) != 0 && atomic.LoadInt64(&c.current.Deleted) <= c.snapshot) ||
-		(c.current.Offset >= c.snapshot) {
+	for !c.visible(c.current) {
 		rec, err = c.collection.readRecord(atomic.LoadInt64(&c.current.Next[0]), false)
 		if err != nil {
 			c.current.lock.RUnlock()
@@ -128,12 +296,40 @@ func (c *Cursor) Key() string {
 }
 
 // Value returns the value of the current record. It returns an
-// empty string if the cursor is not valid.
+// empty string if the cursor is not valid. A value stored in the blob
+// file is read from it; if that fails, the cursor stops and Err returns
+// the error.
 func (c *Cursor) Value() string {
-	if c.Valid() {
-		return c.current.Value
+	if !c.Valid() {
+		return ""
 	}
-	return ""
+	value, err := c.collection.recordValue(c.current)
+	if err != nil {
+		c.err = err
+		c.current = nil
+		return ""
+	}
+	return value
+}
+
+// Deleted returns true if the current record was deleted or overwritten
+// by the cursor's snapshot. Only cursors from NewCursorWithDeleted land
+// on such records.
+func (c *Cursor) Deleted() bool {
+	return c.DeletedVersion() != 0
+}
+
+// DeletedVersion returns the version at which the current record was
+// deleted or overwritten, or 0 if it's live in the cursor's snapshot.
+func (c *Cursor) DeletedVersion() int64 {
+	if !c.Valid() {
+		return 0
+	}
+	deleted := atomic.LoadInt64(&c.current.Deleted)
+	if deleted > c.snapshot {
+		return 0
+	}
+	return deleted
 }
 
 // Seek positions the cursor at the last key less than
@@ -143,6 +339,14 @@ func (c *Cursor) Seek(key string) {
 		return
 	}
 
+	c.collection.metaLock.RLock()
+	defer c.collection.metaLock.RUnlock()
+	if c.generation != c.collection.generation {
+		c.err = ErrStale
+		c.current = nil
+		return
+	}
+
 	var err error
 	offset := int64(0)
 	for level := maxLevels - 1; level >= 0; level-- {
@@ -153,10 +357,7 @@ func (c *Cursor) Seek(key string) {
 		}
 	}
 	if offset == 0 {
-		c.collection.metaLock.RLock()
 		offset = c.collection.Next[0]
-		c.collection.metaLock.RUnlock()
-
 		if offset == 0 {
 			c.current = nil
 			return
@@ -172,8 +373,8 @@ func (c *Cursor) Seek(key string) {
 	c.first = true
 	for rec != nil {
 		rec.lock.RLock()
-		if rec.Key >= key {
-			if (rec.Deleted > 0 && rec.Deleted <= c.snapshot) || (rec.Offset >= c.snapshot) {
+		if c.collection.compare(rec.Key, key) >= 0 {
+			if !c.visible(rec) {
 				oldRec := rec
 				rec, err = c.collection.nextRecord(rec, 0, false)
 				if err != nil {
@@ -190,7 +391,7 @@ func (c *Cursor) Seek(key string) {
 			rec.lock.RUnlock()
 			break
 		}
-		if (rec.Deleted > 0 && rec.Deleted <= c.snapshot) || (rec.Offset >= c.snapshot) {
+		if !c.visible(rec) {
 			oldRec := rec
 			rec, err = c.collection.nextRecord(rec, 0, false)
 			if err != nil {
@@ -203,7 +404,7 @@ func (c *Cursor) Seek(key string) {
 			oldRec.lock.RUnlock()
 			continue
 		}
-		if rec.Key < key {
+		if c.collection.compare(rec.Key, key) < 0 {
 			c.current = rec
 		}
 		oldRec := rec
@@ -219,6 +420,19 @@ func (c *Cursor) Seek(key string) {
 	}
 }
 
+// SeekAfter positions the cursor so that the next call to Next
+// moves to the first key greater than key. This is useful for
+// resuming iteration after the last key that was returned.
+func (c *Cursor) SeekAfter(key string) error {
+	c.Seek(key)
+	for c.err == nil && c.Valid() && c.collection.compare(c.current.Key, key) <= 0 {
+		c.first = false
+		c.next()
+	}
+	c.first = c.Valid()
+	return c.err
+}
+
 // Err returns the error encountered during iteration, if any.
 func (c *Cursor) Err() error {
 	return c.err
@@ -230,11 +444,15 @@ func (c *Cursor) Err() error {
 func (c *Cursor) Get(key string) (string, error) {
 	c.Seek(key)
 	for c.Next() {
-		if c.Key() > key {
+		if c.collection.compare(c.Key(), key) > 0 {
 			break
 		}
 		if c.Key() == key {
-			return c.Value(), nil
+			value := c.Value()
+			if c.err != nil {
+				return "", c.err
+			}
+			return value, nil
 		}
 	}
 	if err := c.Err(); err != nil {
@@ -242,3 +460,307 @@ func (c *Cursor) Get(key string) (string, error) {
 	}
 	return "", ErrKeyNotFound
 }
+
+// KV is a key-value pair.
+type KV struct {
+	Key   string
+	Value string
+}
+
+// Range returns the live key-value pairs with keys in [start, end),
+// in key order. An empty end means there is no upper bound.
+// At most limit pairs are returned; limit <= 0 means no limit.
+func (c *Collection) Range(start, end string, limit int) ([]KV, error) {
+	result := []KV{}
+	err := c.Scan(start, func(key, value string) bool {
+		if end != "" && c.compare(key, end) >= 0 {
+			return false
+		}
+		result = append(result, KV{Key: key, Value: value})
+		return limit <= 0 || len(result) < limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ReverseRange returns the live key-value pairs with keys in [end, start),
+// in descending key order. An empty start means there is no upper bound.
+// At most limit pairs are returned; limit <= 0 means no limit.
+// Records are only linked forward, so the range is scanned from end and
+// the last limit pairs are kept. Without a limit, the whole range is
+// held in memory.
+func (c *Collection) ReverseRange(start, end string, limit int) ([]KV, error) {
+	kept := []KV{}
+	// Once limit pairs are kept, they're overwritten oldest first,
+	// starting at oldest.
+	oldest := 0
+	err := c.Scan(end, func(key, value string) bool {
+		if start != "" && c.compare(key, start) >= 0 {
+			return false
+		}
+		kv := KV{Key: key, Value: value}
+		if limit > 0 && len(kept) == limit {
+			kept[oldest] = kv
+			oldest = (oldest + 1) % limit
+			return true
+		}
+		kept = append(kept, kv)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]KV, len(kept))
+	for i := range result {
+		result[i] = kept[(oldest+len(kept)-1-i)%len(kept)]
+	}
+	return result, nil
+}
+
+// ListKeys returns up to limit live keys in key order, starting after the
+// page that returned the token after, or from the first key if after is
+// empty. nextToken is passed back as after to get the next page, and it's
+// empty once there are no more keys. Tokens are opaque and only valid for
+// the collection that returned them. limit <= 0 means no limit.
+func (c *Collection) ListKeys(after string, limit int) (keys []string, nextToken string, err error) {
+	cur, err := c.NewCursor()
+	if err != nil {
+		return nil, "", err
+	}
+	if after != "" {
+		token, err := base64.RawURLEncoding.DecodeString(after)
+		if err != nil || len(token) == 0 || token[0] != 'k' {
+			return nil, "", ErrInvalidPageToken
+		}
+		if err = cur.SeekAfter(string(token[1:])); err != nil {
+			return nil, "", err
+		}
+	}
+
+	keys = []string{}
+	for cur.Next() {
+		if limit > 0 && len(keys) == limit {
+			// There's at least one more key. The prefix keeps
+			// the token of an empty key from being empty.
+			nextToken = base64.RawURLEncoding.EncodeToString([]byte("k" + keys[len(keys)-1]))
+			break
+		}
+		keys = append(keys, cur.Key())
+	}
+	if err = cur.Err(); err != nil {
+		return nil, "", err
+	}
+	return keys, nextToken, nil
+}
+
+// Scan calls fn with each live key-value pair with a key greater than or
+// equal to start, in key order, until fn returns false. It uses a single
+// snapshot cursor, so fn sees the collection as of when Scan was called.
+// Errors reading records are returned.
+func (c *Collection) Scan(start string, fn func(key, value string) bool) error {
+	cur, err := c.NewCursor()
+	if err != nil {
+		return err
+	}
+	cur.Seek(start)
+	for cur.Next() {
+		if c.compare(cur.Key(), start) < 0 {
+			continue
+		}
+		if !fn(cur.Key(), cur.Value()) {
+			break
+		}
+	}
+	return cur.Err()
+}
+
+// ScanBuffer is like Scan but it reads each record into buf, which is
+// grown as needed, and passes fn the key and value as slices of it. They
+// are only valid until fn returns and must not be modified; copy them
+// to keep them. Records are read from the data file without going
+// through the cache, so scanning a large collection allocates almost
+// nothing and doesn't evict the records other reads are using.
+func (c *Collection) ScanBuffer(start string, buf []byte, fn func(key, value []byte) bool) error {
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return ErrInternal
+	}
+
+	c.metaLock.RLock()
+	snapshot := c.LastCommit
+	generation := c.generation
+	first, err := c.findLastBefore(start)
+	next := atomic.LoadInt64(&c.Next[0])
+	if first != nil {
+		next = atomic.LoadInt64(&first.Next[0])
+	}
+	c.metaLock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	rec := &record{}
+	header := make([]byte, recordHeaderSize+8)
+	started := false
+	for next != 0 {
+		c.metaLock.RLock()
+		if c.generation != generation {
+			c.metaLock.RUnlock()
+			return ErrStale
+		}
+		err = c.readRecordHeaderInto(rec, next, header)
+		if err == nil && rec.visible(snapshot) {
+			size := int(rec.KeyLen) + int(rec.ValLen)
+			if cap(buf) < size {
+				buf = make([]byte, size)
+			}
+			buf = buf[:size]
+			n, readErr := c.readAt(buf, rec.dataOffset())
+			if readErr != nil && n != size {
+				err = Error{Op: "read record data", Offset: next, Err: readErr}
+			} else if rec.Flags&recordFlagBlob != 0 {
+				buf, err = c.readBlobInto(buf, int(rec.KeyLen))
+			}
+		}
+		c.metaLock.RUnlock()
+		if err != nil {
+			return err
+		}
+
+		if rec.visible(snapshot) {
+			// Keys only need comparing until one is past start.
+			if !started {
+				started = c.compare(string(buf[:rec.KeyLen]), start) >= 0
+			}
+			if started && !fn(buf[:rec.KeyLen], buf[rec.KeyLen:]) {
+				return nil
+			}
+		}
+		next = rec.Next[0]
+	}
+	return nil
+}
+
+// Fingerprint returns a 64-bit FNV-1a hash of the live keys and values
+// in key order. Collections with the same contents have the same
+// fingerprint regardless of how their data files are laid out, so it can
+// check that a copy, like a compacted or replicated collection, matches.
+// It reads the whole collection.
+func (c *Collection) Fingerprint() (uint64, error) {
+	h := fnv.New64a()
+	lenBuf := [binary.MaxVarintLen64]byte{}
+	err := c.Scan("", func(key, value string) bool {
+		// Lengths keep different pairs from hashing the same bytes.
+		h.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(len(key)))])
+		io.WriteString(h, key)
+		h.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(len(value)))])
+		io.WriteString(h, value)
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	return h.Sum64(), nil
+}
+
+// ScanKeys is like Scan but it only reads keys. Values of records that
+// aren't in the cache aren't read, which saves IO when values are large.
+// Records read this way aren't added to the cache.
+func (c *Collection) ScanKeys(start string, fn func(key string) bool) error {
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return ErrInternal
+	}
+
+	c.metaLock.RLock()
+	snapshot := c.LastCommit
+	generation := c.generation
+	rec, err := c.findLastBefore(start)
+	if err == nil && rec == nil && c.Next[0] != 0 {
+		rec, err = c.readRecordKey(c.Next[0])
+	}
+	c.metaLock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	for rec != nil {
+		if c.compare(rec.Key, start) >= 0 && rec.visible(snapshot) {
+			if !fn(rec.Key) {
+				return nil
+			}
+		}
+
+		c.metaLock.RLock()
+		if c.generation != generation {
+			c.metaLock.RUnlock()
+			return ErrStale
+		}
+		next := atomic.LoadInt64(&rec.Next[0])
+		rec = nil
+		if next != 0 {
+			rec, err = c.readRecordKey(next)
+		}
+		c.metaLock.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Warmup reads the records with keys in [start, end) into the cache, so
+// that the first reads of a range known to be hot don't go to disk, for
+// example after Compact. An empty end means there is no upper bound.
+// It stops once it has read as many records as the cache holds, since
+// more would only evict the ones it has read.
+func (c *Collection) Warmup(start, end string) error {
+	return c.WarmupContext(context.Background(), start, end)
+}
+
+// WarmupContext is like Warmup but stops early, returning ctx.Err(),
+// if ctx is canceled.
+func (c *Collection) WarmupContext(ctx context.Context, start, end string) error {
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return ErrInternal
+	}
+
+	c.metaLock.RLock()
+	generation := c.generation
+	rec, err := c.findLastBefore(start)
+	next := atomic.LoadInt64(&c.Next[0])
+	if rec != nil {
+		next = atomic.LoadInt64(&rec.Next[0])
+	}
+	c.metaLock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	for warmed := 0; next != 0 && warmed < c.cache.size; warmed++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		c.metaLock.RLock()
+		if c.generation != generation {
+			c.metaLock.RUnlock()
+			return ErrStale
+		}
+		rec, err = c.readRecord(next, false)
+		if err == nil && end != "" && c.compare(rec.Key, end) >= 0 {
+			c.metaLock.RUnlock()
+			return nil
+		}
+		if err == nil {
+			c.cache.pushWarm(rec)
+		}
+		c.metaLock.RUnlock()
+		if err != nil {
+			return err
+		}
+		next = atomic.LoadInt64(&rec.Next[0])
+	}
+	return nil
+}
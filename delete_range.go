@@ -0,0 +1,60 @@
+package lm2
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// DeleteRange deletes the keys in [start, end) in a single commit and
+// returns how many were deleted. An empty end means there is no upper
+// bound. Like Update, it only marks records deleted; compaction
+// reclaims their space.
+func (c *Collection) DeleteRange(start, end string) (int64, error) {
+	if c.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return 0, ErrInternal
+	}
+
+	wb := NewWriteBatch()
+	c.metaLock.RLock()
+	rec, err := c.findLastBefore(start)
+	if err == nil {
+		next := atomic.LoadInt64(&c.Next[0])
+		if rec != nil {
+			next = atomic.LoadInt64(&rec.Next[0])
+		}
+		for next != 0 {
+			rec, err = c.readRecordKey(next)
+			if err != nil {
+				break
+			}
+			if end != "" && c.compare(rec.Key, end) >= 0 {
+				break
+			}
+			if atomic.LoadInt64(&rec.Deleted) == 0 {
+				wb.Delete(rec.Key)
+			}
+			next = atomic.LoadInt64(&rec.Next[0])
+		}
+	}
+	c.metaLock.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := int64(len(wb.deletes))
+	if deleted == 0 {
+		return 0, nil
+	}
+	_, err = c.apply(context.Background(), wb)
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
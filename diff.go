@@ -0,0 +1,106 @@
+package lm2
+
+import "context"
+
+// DiffEntry is a key that Diff found in only one of two collections, or
+// in both with different values.
+type DiffEntry struct {
+	Key string
+	// A and B are the key's values in each collection. InA and InB
+	// are false if the key isn't in that collection.
+	A, B     string
+	InA, InB bool
+	// Err is set on the last entry if the diff ended with an error.
+	Err error
+}
+
+// Diff compares a and b as of their last commits and sends the keys that
+// differ, in key order, on the returned channel, which is closed at the
+// end. Both collections are walked once, side by side. The channel has to
+// be drained, or the walk never finishes; use DiffContext to stop early.
+// ErrComparatorMismatch is returned if a and b order keys differently.
+func Diff(a, b *Collection) (<-chan DiffEntry, error) {
+	return DiffContext(context.Background(), a, b)
+}
+
+// DiffContext is like Diff but stops, sending ctx.Err() as the last
+// entry if it can, once ctx is canceled.
+func DiffContext(ctx context.Context, a, b *Collection) (<-chan DiffEntry, error) {
+	if a.options.ComparatorName != b.options.ComparatorName {
+		return nil, ErrComparatorMismatch
+	}
+	curA, err := a.NewCursor()
+	if err != nil {
+		return nil, err
+	}
+	curB, err := b.NewCursor()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(chan DiffEntry)
+	go func() {
+		defer close(entries)
+		send := func(entry DiffEntry) bool {
+			select {
+			case entries <- entry:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		// A cursor that stopped with an error mustn't be
+		// mistaken for one at the end.
+		failed := func() bool {
+			err := ctx.Err()
+			if err == nil {
+				err = curA.Err()
+			}
+			if err == nil {
+				err = curB.Err()
+			}
+			if err != nil {
+				send(DiffEntry{Err: err})
+			}
+			return err != nil
+		}
+
+		okA, okB := curA.Next(), curB.Next()
+		for okA || okB {
+			if failed() {
+				return
+			}
+
+			cmp := 0
+			switch {
+			case !okB:
+				cmp = -1
+			case !okA:
+				cmp = 1
+			default:
+				cmp = a.compare(curA.Key(), curB.Key())
+			}
+			var entry DiffEntry
+			switch {
+			case cmp < 0:
+				entry = DiffEntry{Key: curA.Key(), A: curA.Value(), InA: true}
+				okA = curA.Next()
+			case cmp > 0:
+				entry = DiffEntry{Key: curB.Key(), B: curB.Value(), InB: true}
+				okB = curB.Next()
+			default:
+				entry = DiffEntry{Key: curA.Key(), A: curA.Value(), B: curB.Value(), InA: true, InB: true}
+				okA, okB = curA.Next(), curB.Next()
+				if entry.A == entry.B {
+					continue
+				}
+			}
+			if !send(entry) {
+				return
+			}
+		}
+		failed()
+	}()
+	return entries, nil
+}
@@ -0,0 +1,89 @@
+package lm2
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// estimateSampleSize is the number of records EstimateRangeCount reads at
+// a level of the skip list before moving up to a sparser one.
+const estimateSampleSize = 1000
+
+// EstimateRangeCount returns an estimate of the number of live keys in
+// [start, end). An empty end means there is no upper bound. Ranges of up
+// to a thousand records or so are counted exactly. Larger ranges are
+// estimated from the records linked at a higher level of the skip list,
+// which hold a random sample of the keys, so the result is approximate.
+// Updates wait for EstimateRangeCount to finish.
+func (c *Collection) EstimateRangeCount(start, end string) (int64, error) {
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return 0, ErrInternal
+	}
+
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	for level := 0; level < maxLevels; level++ {
+		limit := estimateSampleSize
+		if level == maxLevels-1 {
+			limit = -1
+		}
+		live, done, err := c.countLevel(start, end, level, limit)
+		if err != nil {
+			return 0, err
+		}
+		if done {
+			// Each record is linked at level with probability levelProb^level.
+			return int64(float64(live) * math.Pow(1/levelProb, float64(level))), nil
+		}
+	}
+	return 0, nil
+}
+
+// countLevel counts the live records linked at level with keys in
+// [start, end). It returns false if it gave up after reading limit
+// records, unless limit is negative. metaLock must be held.
+func (c *Collection) countLevel(start, end string, level, limit int) (int64, bool, error) {
+	// Find the offset of the first record at level with a key
+	// that isn't less than start.
+	var rec *record
+	for l := maxLevels - 1; l >= level; l-- {
+		next := atomic.LoadInt64(&c.Next[l])
+		if rec != nil {
+			next = atomic.LoadInt64(&rec.Next[l])
+		}
+		for next != 0 {
+			nextRec, err := c.readRecordKey(next)
+			if err != nil {
+				return 0, false, err
+			}
+			if c.compare(nextRec.Key, start) >= 0 {
+				break
+			}
+			rec = nextRec
+			next = atomic.LoadInt64(&rec.Next[l])
+		}
+	}
+	next := atomic.LoadInt64(&c.Next[level])
+	if rec != nil {
+		next = atomic.LoadInt64(&rec.Next[level])
+	}
+
+	live := int64(0)
+	for read := 0; next != 0; read++ {
+		if read == limit {
+			return 0, false, nil
+		}
+		rec, err := c.readRecordKey(next)
+		if err != nil {
+			return 0, false, err
+		}
+		if end != "" && c.compare(rec.Key, end) >= 0 {
+			break
+		}
+		if rec.visible(c.LastCommit) {
+			live++
+		}
+		next = atomic.LoadInt64(&rec.Next[level])
+	}
+	return live, true, nil
+}
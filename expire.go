@@ -0,0 +1,141 @@
+package lm2
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// expireScanSize is the number of records the expirer reads
+// while holding metaLock.
+const expireScanSize = 1000
+
+// StartExpirer starts a goroutine that deletes expired keys every interval,
+// so they stop taking up cache space and can be dropped by compaction.
+// Expired keys are deleted in batches, and writeLock is released between
+// batches so concurrent updates aren't held up for long. The expirer stops
+// when the collection is closed or when the returned cancel function is called.
+func (c *Collection) StartExpirer(interval time.Duration) (cancel func()) {
+	stop := make(chan struct{})
+	stopOnce := sync.Once{}
+	cancel = func() {
+		stopOnce.Do(func() {
+			close(stop)
+		})
+	}
+
+	if c.readOnly {
+		return cancel
+	}
+	select {
+	case <-c.closed:
+		return cancel
+	default:
+	}
+
+	c.background.Add(1)
+	go func() {
+		defer c.background.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.closed:
+				return
+			case <-stop:
+				return
+			case <-ticker.C:
+				c.expire(stop)
+			}
+		}
+	}()
+	return cancel
+}
+
+// expire deletes expired keys in the collection. It returns early
+// if stop or c.closed is closed.
+func (c *Collection) expire(stop chan struct{}) error {
+	c.metaLock.RLock()
+	offset := c.Next[0]
+	generation := c.generation
+	c.metaLock.RUnlock()
+
+	for offset != 0 {
+		select {
+		case <-c.closed:
+			return nil
+		case <-stop:
+			return nil
+		default:
+		}
+		if atomic.LoadUint32(&c.internalState) != 0 {
+			return ErrInternal
+		}
+
+		keys := []string{}
+		c.metaLock.RLock()
+		if c.generation != generation {
+			// The data file was rewritten. The next run starts over.
+			c.metaLock.RUnlock()
+			return nil
+		}
+		for i := 0; i < expireScanSize && offset != 0; i++ {
+			// Values aren't needed, and caching every record would
+			// evict the working set.
+			rec, err := c.readRecordKey(offset)
+			if err != nil {
+				c.metaLock.RUnlock()
+				return err
+			}
+			if atomic.LoadInt64(&rec.Deleted) == 0 && rec.expired() {
+				keys = append(keys, rec.Key)
+			}
+			offset = atomic.LoadInt64(&rec.Next[0])
+		}
+		c.metaLock.RUnlock()
+
+		if len(keys) == 0 {
+			continue
+		}
+		if err := c.deleteExpired(keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteExpired deletes the keys that are still expired.
+func (c *Collection) deleteExpired(keys []string) error {
+	if !c.lockWriteBackground() {
+		return nil
+	}
+	defer c.writeLock.Unlock()
+
+	// A key may have been set again since it was found.
+	wb := NewWriteBatch()
+	count := uint64(0)
+	c.metaLock.RLock()
+	for _, key := range keys {
+		rec, err := c.findKey(key)
+		if err != nil {
+			c.metaLock.RUnlock()
+			return err
+		}
+		if rec != nil && rec.Key == key && atomic.LoadInt64(&rec.Deleted) == 0 && rec.expired() {
+			wb.Delete(key)
+			count++
+		}
+	}
+	c.metaLock.RUnlock()
+
+	if count == 0 {
+		return nil
+	}
+	_, err := c.apply(context.Background(), wb)
+	if err != nil {
+		return err
+	}
+	c.stats.incExpiredRecords(count)
+	return nil
+}
@@ -0,0 +1,337 @@
+package lm2
+
+import "sync/atomic"
+
+// readRecordKey is like readRecord but it doesn't read the value of
+// records that aren't in the cache. Records read from disk are not
+// added to the cache since they're incomplete.
+func (c *Collection) readRecordKey(offset int64) (*record, error) {
+	if offset == 0 {
+		return nil, Error{Op: "read record", Offset: offset, Err: ErrInvalidOffset}
+	}
+
+	if rec := c.cache.get(offset); rec != nil {
+		c.stats.incRecordsRead(1)
+		c.stats.incCacheHits(1)
+		return rec, nil
+	}
+
+	rec, err := c.readRecordHeader(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	keyBuf := make([]byte, int(rec.KeyLen))
+	n, err := c.readAt(keyBuf, rec.dataOffset())
+	if err != nil && n != len(keyBuf) {
+		return nil, Error{Op: "read record key", Offset: offset, Err: err}
+	}
+	rec.Key = string(keyBuf)
+
+	c.stats.incRecordsRead(1)
+	c.stats.incCacheMisses(1)
+	return rec, nil
+}
+
+// findKey returns the last record in the collection with a key less than
+// or equal to key, reading only keys along the way. If key has been
+// overwritten this is its most recent record. It returns nil if every
+// record has a greater key. metaLock must be held.
+func (c *Collection) findKey(key string) (*record, error) {
+	return c.findLast(c.cache.findLastLessThan(key), func(k string) bool {
+		return c.compare(k, key) <= 0
+	})
+}
+
+// findLastBefore is like findKey but it returns the last record with
+// a key strictly less than key. metaLock must be held.
+func (c *Collection) findLastBefore(key string) (*record, error) {
+	return c.findLast(c.cache.findLastLessThan(key), func(k string) bool {
+		return c.compare(k, key) < 0
+	})
+}
+
+// findLast returns the last record with a key for which match returns true.
+// Keys are ordered, so match must be true for a prefix of the collection.
+// The search starts from the record at start if it's nonzero; that record's
+// key has to match. metaLock must be held.
+func (c *Collection) findLast(start int64, match func(key string) bool) (*record, error) {
+	var rec *record
+	if start != 0 {
+		cached, err := c.readRecordKey(start)
+		if err != nil {
+			return nil, err
+		}
+		rec = cached
+	}
+
+	for level := maxLevels - 1; level >= 0; level-- {
+		if rec == nil {
+			headOffset := atomic.LoadInt64(&c.Next[level])
+			if headOffset == 0 {
+				continue
+			}
+			head, err := c.readRecordKey(headOffset)
+			if err != nil {
+				return nil, err
+			}
+			if !match(head.Key) {
+				continue
+			}
+			rec = head
+		}
+		for {
+			nextOffset := atomic.LoadInt64(&rec.Next[level])
+			if nextOffset == 0 {
+				break
+			}
+			next, err := c.readRecordKey(nextOffset)
+			if err != nil {
+				return nil, err
+			}
+			if !match(next.Key) {
+				break
+			}
+			rec = next
+		}
+	}
+	return rec, nil
+}
+
+// FirstKey returns the smallest key in the collection.
+// It returns false if the collection is empty.
+func (c *Collection) FirstKey() (string, bool, error) {
+	cur, err := c.NewCursor()
+	if err != nil {
+		return "", false, err
+	}
+	if !cur.Next() {
+		return "", false, cur.Err()
+	}
+	return cur.Key(), true, nil
+}
+
+// LastKey returns the largest key in the collection.
+// It returns false if the collection is empty.
+func (c *Collection) LastKey() (string, bool, error) {
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return "", false, ErrInternal
+	}
+
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+
+	rec, err := c.findLast(c.cache.maxKeyOffset(), func(string) bool {
+		return true
+	})
+	for err == nil && rec != nil {
+		// rec is the most recent record of its key, so if it's not
+		// visible the key isn't present.
+		if rec.visible(c.LastCommit) {
+			return rec.Key, true, nil
+		}
+		rec, err = c.findLastBefore(rec.Key)
+	}
+	return "", false, err
+}
+
+// Has returns true if key exists in the collection. Unlike a cursor Get,
+// it doesn't read values from disk.
+func (c *Collection) Has(key string) (bool, error) {
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return false, ErrInternal
+	}
+
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+
+	rec, err := c.findKey(key)
+	if err != nil {
+		return false, err
+	}
+	if rec == nil || rec.Key != key {
+		return false, nil
+	}
+	return atomic.LoadInt64(&rec.Deleted) == 0 && !rec.expired(), nil
+}
+
+// GetCached returns the value of key if its record is in the cache, without
+// reading the data file. ok is false on a miss, whether or not key exists,
+// and if the cached record is deleted or expired, since a newer record of
+// key may not be cached. It can be combined with Warmup or a background Get
+// to read without blocking on IO, except that values stored in the blob
+// file are still read from it.
+func (c *Collection) GetCached(key string) (value string, ok bool, err error) {
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return "", false, ErrInternal
+	}
+
+	// Overwritten and deleted records leave the cache while metaLock
+	// is held for writing.
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	rec := c.cache.lookup(key)
+	if rec == nil || atomic.LoadInt64(&rec.Deleted) != 0 || rec.expired() {
+		return "", false, nil
+	}
+	value, err = c.recordValue(rec)
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// GetInto appends the value of key to *dst, reusing its capacity, and
+// returns true if key exists. Unlike a cursor Get, it doesn't allocate
+// a string for the value: a value that isn't cached is read straight
+// into *dst, and a cached one is copied. *dst is left as it was if key
+// doesn't exist; to reuse a buffer, reset it with (*dst)[:0] first.
+func (c *Collection) GetInto(key string, dst *[]byte) (bool, error) {
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return false, ErrInternal
+	}
+
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+
+	// Overwritten and deleted records leave the cache while metaLock
+	// is held for writing, so a cached live record is the latest one.
+	rec := c.cache.lookup(key)
+	cached := rec != nil && atomic.LoadInt64(&rec.Deleted) == 0
+	if !cached {
+		var err error
+		rec, err = c.findKey(key)
+		if err != nil {
+			return false, err
+		}
+	}
+	if rec == nil || rec.Key != key || atomic.LoadInt64(&rec.Deleted) != 0 || rec.expired() {
+		return false, nil
+	}
+	start := len(*dst)
+	if cached && rec.Flags&recordFlagBlob == 0 {
+		*dst = append(*dst, rec.Value...)
+		return true, nil
+	}
+
+	// Read the value, or its blobRef, straight from the data file.
+	*dst = growBytes(*dst, int(rec.ValLen))
+	n, err := c.readAt((*dst)[start:], rec.dataOffset()+int64(rec.KeyLen))
+	if err != nil && n != int(rec.ValLen) {
+		*dst = (*dst)[:start]
+		return false, Error{Op: "read record value", Offset: rec.Offset, Err: err}
+	}
+	if rec.Flags&recordFlagBlob != 0 {
+		value, err := c.readBlobInto((*dst)[:start+int(rec.ValLen)], start)
+		if err != nil {
+			*dst = (*dst)[:start]
+			return false, err
+		}
+		*dst = value
+	}
+	return true, nil
+}
+
+// growBytes returns b extended by n bytes, which have no particular
+// value, reallocating only if b doesn't have the capacity.
+func growBytes(b []byte, n int) []byte {
+	if cap(b)-len(b) < n {
+		grown := make([]byte, len(b), len(b)+n)
+		copy(grown, b)
+		b = grown
+	}
+	return b[:len(b)+n]
+}
+
+// get returns the live record for key, or nil if there isn't one.
+// metaLock must be held.
+func (c *Collection) get(key string) (*record, error) {
+	rec, err := c.findKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil || rec.Key != key || atomic.LoadInt64(&rec.Deleted) != 0 || rec.expired() {
+		return nil, nil
+	}
+	// findKey may not have read the value.
+	return c.readRecord(rec.Offset, false)
+}
+
+// GetWithVersion returns the value of key and the version at which it was
+// last set, as returned by the Update that set it. found is false if key
+// doesn't exist.
+func (c *Collection) GetWithVersion(key string) (value string, createdVersion int64, found bool, err error) {
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return "", 0, false, ErrInternal
+	}
+
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+
+	rec, err := c.get(key)
+	if err != nil || rec == nil {
+		return "", 0, false, err
+	}
+	createdVersion, err = c.commitVersion(rec)
+	if err != nil {
+		return "", 0, false, err
+	}
+	value, err = c.recordValue(rec)
+	if err != nil {
+		return "", 0, false, err
+	}
+	return value, createdVersion, true, nil
+}
+
+// GetTombstone is like GetWithVersion but it also finds keys that have
+// been deleted. If key's most recent record was deleted, deleted is true,
+// value is the value it had and deletedVersion is the version of the
+// Update that deleted it. found is false if the collection has no record
+// of key, or if key expired without being deleted. Deleted records are
+// only kept until the collection is compacted, after which their keys
+// aren't found.
+func (c *Collection) GetTombstone(key string) (value string, deleted bool, deletedVersion int64, found bool, err error) {
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return "", false, 0, false, ErrInternal
+	}
+
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+
+	rec, err := c.findKey(key)
+	if err != nil || rec == nil || rec.Key != key {
+		return "", false, 0, false, err
+	}
+	deletedVersion = atomic.LoadInt64(&rec.Deleted)
+	if deletedVersion == 0 && rec.expired() {
+		return "", false, 0, false, nil
+	}
+	// findKey may not have read the value.
+	rec, err = c.readRecord(rec.Offset, false)
+	if err != nil {
+		return "", false, 0, false, err
+	}
+	value, err = c.recordValue(rec)
+	if err != nil {
+		return "", false, 0, false, err
+	}
+	return value, deletedVersion != 0, deletedVersion, true, nil
+}
+
+// commitVersion returns the version of the commit that wrote rec.
+// Each commit's records are followed by a sentinel, so it's found by
+// reading past the rest of the commit's records. metaLock must be held.
+func (c *Collection) commitVersion(rec *record) (int64, error) {
+	offset := rec.Offset + int64(rec.size())
+	for offset < c.LastCommit {
+		next, nextOffset, err := c.readPhysical(offset)
+		if err != nil {
+			return 0, err
+		}
+		if next == nil {
+			return nextOffset, nil
+		}
+		offset = nextOffset
+	}
+	return 0, ErrCorruptRecord
+}
@@ -0,0 +1,125 @@
+package lm2
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+)
+
+type commitResult struct {
+	version int64
+	err     error
+}
+
+type commitRequest struct {
+	wb   *WriteBatch
+	done chan commitResult
+}
+
+type groupCommitter struct {
+	lock    sync.Mutex
+	pending []*commitRequest
+	leading bool
+}
+
+// groupUpdate queues wb to be committed with other concurrent updates.
+// The first writer to arrive becomes the leader and commits every batch
+// queued during the group commit window. Each caller gets the version
+// of the commit that included its batch.
+func (c *Collection) groupUpdate(wb *WriteBatch) (int64, error) {
+	req := &commitRequest{
+		wb:   wb,
+		done: make(chan commitResult, 1),
+	}
+
+	c.group.lock.Lock()
+	c.group.pending = append(c.group.pending, req)
+	leader := !c.group.leading
+	c.group.leading = true
+	c.group.lock.Unlock()
+
+	if leader {
+		if c.options.GroupCommitWindow > 0 {
+			time.Sleep(c.options.GroupCommitWindow)
+		}
+		c.group.lock.Lock()
+		reqs := c.group.pending
+		c.group.pending = nil
+		c.group.leading = false
+		c.group.lock.Unlock()
+
+		c.commitGroup(reqs)
+	}
+
+	result := <-req.done
+	return result.version, result.err
+}
+
+// commitGroup applies reqs in order, making as many consecutive batches
+// as possible durable together. Each batch is still a commit of its own.
+func (c *Collection) commitGroup(reqs []*commitRequest) {
+	for len(reqs) > 0 {
+		wbs := []*WriteBatch{reqs[0].wb}
+		touched := map[string]struct{}{}
+		reqs[0].wb.touch(touched)
+		for len(wbs) < len(reqs) && reqs[len(wbs)].wb.joins(wbs[0], touched) {
+			reqs[len(wbs)].wb.touch(touched)
+			wbs = append(wbs, reqs[len(wbs)].wb)
+		}
+		n := len(wbs)
+
+		c.writeLock.Lock()
+		versions, err := c.applyBatches(context.Background(), wbs)
+		c.writeLock.Unlock()
+		if err != nil && n > 1 {
+			// Retry the batches one at a time so that one
+			// bad batch doesn't fail the whole group.
+			for _, req := range reqs[:n] {
+				version, err := c.update(context.Background(), req.wb)
+				req.done <- commitResult{version: version, err: err}
+			}
+		} else if err != nil {
+			reqs[0].done <- commitResult{err: err}
+		} else {
+			for i, req := range reqs[:n] {
+				req.done <- commitResult{version: versions[i]}
+			}
+		}
+		reqs = reqs[n:]
+	}
+}
+
+// touch adds the keys that wb modifies to keys.
+func (wb *WriteBatch) touch(keys map[string]struct{}) {
+	for key := range wb.sets {
+		keys[key] = struct{}{}
+	}
+	for key := range wb.deletes {
+		keys[key] = struct{}{}
+	}
+	for key := range wb.merges {
+		keys[key] = struct{}{}
+	}
+}
+
+// joins reports whether wb can be made durable together with the group
+// started by first, in which touched are modified. Merges and SetIfChanged
+// read the committed values, so they can't follow a batch in the same
+// group that modifies the same key.
+func (wb *WriteBatch) joins(first *WriteBatch, touched map[string]struct{}) bool {
+	if !bytes.Equal(wb.tag, first.tag) {
+		return false
+	}
+	for key := range wb.merges {
+		if _, ok := touched[key]; ok {
+			return false
+		}
+	}
+	for key := range wb.ifChanged {
+		if _, ok := touched[key]; ok {
+			return false
+		}
+	}
+	return true
+}
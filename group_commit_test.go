@@ -0,0 +1,160 @@
+package lm2
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGroupCommit(t *testing.T) {
+	c, err := NewCollectionWithOptions("/tmp/test_groupcommit.lm2", Options{
+		CacheSize:         100,
+		GroupCommit:       true,
+		GroupCommitWindow: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	const N = 50
+	const NumGoroutines = 16
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, NumGoroutines)
+	for i := 0; i < NumGoroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < N; j++ {
+				wb := NewWriteBatch()
+				wb.Set(fmt.Sprintf("%02d-%03d", i, j), fmt.Sprint(j))
+				version, err := c.Update(wb)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if version <= 0 {
+					errs <- fmt.Errorf("invalid version %d", version)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	count := verifyOrder(t, c, nil)
+	if count != N*NumGoroutines {
+		t.Errorf("expected %d records, got %d", N*NumGoroutines, count)
+	}
+}
+
+func TestGroupCommitDeleteThenSet(t *testing.T) {
+	c, err := NewCollectionWithOptions("/tmp/test_groupcommitdeletethenset.lm2", Options{
+		CacheSize:   100,
+		GroupCommit: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	first := NewWriteBatch()
+	first.Set("a", "1")
+	first.Set("b", "1")
+	second := NewWriteBatch()
+	second.Delete("a")
+	third := NewWriteBatch()
+	third.Set("a", "2")
+	third.Delete("b")
+
+	done := make(chan commitResult, 3)
+	c.commitGroup([]*commitRequest{
+		{wb: first, done: done},
+		{wb: second, done: done},
+		{wb: third, done: done},
+	})
+	versions := []int64{}
+	for i := 0; i < 3; i++ {
+		result := <-done
+		if result.err != nil {
+			t.Fatal(result.err)
+		}
+		versions = append(versions, result.version)
+	}
+	if versions[0] >= versions[1] || versions[1] >= versions[2] || versions[2] != c.Version() {
+		t.Fatalf("expected increasing versions ending at %d, got %v", c.Version(), versions)
+	}
+
+	kvs, err := c.Range("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 1 || kvs[0] != (KV{"a", "2"}) {
+		t.Errorf("expected [{a 2}], got %v", kvs)
+	}
+
+	// Each batch is a commit of its own.
+	expected := []Change{
+		{Type: ChangePut, Key: "a", Value: "1", Version: versions[0]},
+		{Type: ChangePut, Key: "b", Value: "1", Version: versions[0]},
+		{Type: ChangeDelete, Key: "a", Version: versions[1]},
+		{Type: ChangePut, Key: "a", Value: "2", Version: versions[2]},
+		{Type: ChangeDelete, Key: "b", Version: versions[2]},
+	}
+	changes := []Change{}
+	err = c.ChangesSince(0, func(change Change) bool {
+		changes = append(changes, change)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(changes) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, changes)
+	}
+}
+
+func benchmarkConcurrentUpdates(b *testing.B, opts Options) {
+	c, err := NewCollectionWithOptions("/tmp/bench_concurrentupdates.lm2", opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Destroy()
+
+	const concurrency = 16
+	b.ResetTimer()
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := i; j < b.N; j += concurrency {
+				wb := NewWriteBatch()
+				wb.Set(fmt.Sprint(j), fmt.Sprint(j))
+				if _, err := c.Update(wb); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func BenchmarkConcurrentUpdates(b *testing.B) {
+	benchmarkConcurrentUpdates(b, Options{CacheSize: 1000})
+}
+
+func BenchmarkConcurrentUpdatesGroupCommit(b *testing.B) {
+	benchmarkConcurrentUpdates(b, Options{
+		CacheSize:         1000,
+		GroupCommit:       true,
+		GroupCommitWindow: 100 * time.Microsecond,
+	})
+}
@@ -0,0 +1,193 @@
+package lm2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// indexMagic starts an index file.
+const indexMagic = sentinelMagic + 4
+
+var errCorruptIndex = errors.New("lm2: corrupt index file")
+
+// checkpoint is the key and offset of a record linked at level 0.
+type checkpoint struct {
+	offset int64
+	key    string
+}
+
+// sparseIndex holds checkpoints sorted by key, so that seeks can start
+// close to their key instead of walking the skip list from the head.
+// With Options.IndexCheckpointInterval set, Update adds a checkpoint for
+// every IndexCheckpointInterval-th record it inserts, and Compact for
+// every IndexCheckpointInterval-th record of the compacted data file.
+//
+// The index is kept in memory and saved by Close and Checkpoint next to
+// the data file with a ".index" suffix:
+//
+//	magic      uint32
+//	lastCommit int64   the last commit when the index was saved
+//	count      uint32
+//	count times:
+//	  offset   int64
+//	  keyLen   uint16
+//	  key      [keyLen]byte
+//	checksum   uint64  FNV-1a of everything before it
+//
+// Records are never moved until the data file is rewritten, which
+// replaces or removes the index file, so checkpoints stay valid as the
+// collection is updated. After a crash the file may miss checkpoints
+// or have some for records that were rolled back, so the index is only
+// a hint: a checkpoint is used if the record at its offset has its key.
+type sparseIndex []checkpoint
+
+// indexFile returns the path of the index file of the data file at file.
+func indexFile(file string) string {
+	return file + ".index"
+}
+
+// add adds cps, replacing the checkpoints of their keys.
+func (idx sparseIndex) add(cps []checkpoint, compare func(a, b string) int) sparseIndex {
+	for _, cp := range cps {
+		i := sort.Search(len(idx), func(i int) bool {
+			return compare(idx[i].key, cp.key) >= 0
+		})
+		if i < len(idx) && idx[i].key == cp.key {
+			idx[i] = cp
+			continue
+		}
+		idx = append(idx, checkpoint{})
+		copy(idx[i+1:], idx[i:])
+		idx[i] = cp
+	}
+	return idx
+}
+
+// lastLessThan returns the last checkpoint with a key less than key,
+// or false if there isn't one.
+func (idx sparseIndex) lastLessThan(key string, compare func(a, b string) int) (checkpoint, bool) {
+	i := sort.Search(len(idx), func(i int) bool {
+		return compare(idx[i].key, key) >= 0
+	})
+	if i == 0 {
+		return checkpoint{}, false
+	}
+	return idx[i-1], true
+}
+
+// save writes the index to the index file of the data file at file.
+func (idx sparseIndex) save(file string, lastCommit int64) error {
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.LittleEndian, uint32(indexMagic))
+	binary.Write(buf, binary.LittleEndian, lastCommit)
+	binary.Write(buf, binary.LittleEndian, uint32(len(idx)))
+	for _, cp := range idx {
+		binary.Write(buf, binary.LittleEndian, cp.offset)
+		binary.Write(buf, binary.LittleEndian, uint16(len(cp.key)))
+		buf.WriteString(cp.key)
+	}
+	return writeChecksummed(indexFile(file), buf.Bytes())
+}
+
+// loadIndex reads the index file of the data file at file. It returns
+// nil if there isn't one or if it was saved after lastCommit, which
+// means it belongs to a data file the current one replaced.
+func loadIndex(file string, lastCommit int64) (sparseIndex, error) {
+	b, err := readChecksummed(indexFile(file))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err == errBadChecksum {
+		return nil, errCorruptIndex
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r := bytes.NewReader(b)
+	var magic, count uint32
+	var saved int64
+	binary.Read(r, binary.LittleEndian, &magic)
+	binary.Read(r, binary.LittleEndian, &saved)
+	err = binary.Read(r, binary.LittleEndian, &count)
+	if err != nil || magic != indexMagic {
+		return nil, errCorruptIndex
+	}
+	if saved > lastCommit {
+		return nil, nil
+	}
+	idx := sparseIndex{}
+	for i := 0; i < int(count); i++ {
+		cp := checkpoint{}
+		var keyLen uint16
+		binary.Read(r, binary.LittleEndian, &cp.offset)
+		err = binary.Read(r, binary.LittleEndian, &keyLen)
+		if err != nil || int(keyLen) > r.Len() {
+			return nil, errCorruptIndex
+		}
+		key := make([]byte, keyLen)
+		io.ReadFull(r, key)
+		cp.key = string(key)
+		idx = append(idx, cp)
+	}
+	return idx, nil
+}
+
+// loadIndex sets c's index from its index file. A file that can't be
+// used is logged and ignored.
+func (c *Collection) loadIndex() {
+	idx, err := loadIndex(c.file, c.LastCommit)
+	if err != nil {
+		c.logf("ignoring index: %v", err)
+	}
+	c.index = idx
+	c.indexDirty = false
+}
+
+// saveIndex saves c's index if it has changed since it was loaded
+// or saved. A failure is logged, since the index is only a hint.
+// writeLock or metaLock must be held.
+func (c *Collection) saveIndex() {
+	if !c.indexDirty {
+		return
+	}
+	err := c.index.save(c.file, c.LastCommit)
+	if err != nil {
+		c.logf("couldn't save the index: %v", err)
+		return
+	}
+	c.indexDirty = false
+}
+
+// indexes returns true if the nth record inserted since the collection
+// was opened, counting from 0, gets a checkpoint.
+func (c *Collection) indexes(n int) bool {
+	interval := c.options.IndexCheckpointInterval
+	return interval > 0 && n%interval == 0
+}
+
+// seekIndex returns the record of the last checkpoint with a key less
+// than key if it's after rec and linked at level, or nil.
+func (c *Collection) seekIndex(key string, rec *record, level int, dirty bool) *record {
+	cp, ok := c.index.lastLessThan(key, c.compare)
+	if !ok || c.compare(cp.key, rec.Key) <= 0 {
+		return nil
+	}
+	// Until its key is checked, the record may be garbage, which
+	// mustn't get into the cache.
+	cpRec, err := c.readRecordCached(cp.offset, dirty, false)
+	if err != nil || cpRec.Key != cp.key {
+		return nil
+	}
+	// A record is linked at level 0, and above it only where it has a
+	// next record.
+	if level > 0 && atomic.LoadInt64(&cpRec.Next[level]) == 0 {
+		return nil
+	}
+	return cpRec
+}
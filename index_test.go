@@ -0,0 +1,177 @@
+package lm2
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestSparseIndex(t *testing.T) {
+	const file = "/tmp/test_sparseindex.lm2"
+	opts := Options{CacheSize: 100, IndexCheckpointInterval: 4}
+	c, err := NewCollectionWithOptions(file, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.Destroy()
+	}()
+
+	const numKeys = 2000
+	for i := 0; i < numKeys; i += 100 {
+		wb := NewWriteBatch()
+		for j := i; j < i+100; j++ {
+			wb.Set(fmt.Sprintf("key%05d", j), fmt.Sprint(j))
+		}
+		_, err = c.Update(wb)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.index) != numKeys/4 {
+		t.Fatalf("expected %d checkpoints, got %d", numKeys/4, len(c.index))
+	}
+
+	// Close saves the index and OpenCollection loads it.
+	c.Close()
+	c, err = OpenCollectionWithOptions(file, Options{CacheSize: 1, SeekCachePolicy: SeekCacheNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.index) != numKeys/4 {
+		t.Fatalf("expected %d checkpoints to be loaded, got %d", numKeys/4, len(c.index))
+	}
+
+	getAll := func() uint64 {
+		t.Helper()
+		reads := c.Stats().RecordsRead
+		for i := 1; i < numKeys; i += 20 {
+			cur, err := c.NewCursor()
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := fmt.Sprintf("key%05d", i)
+			if value, err := cur.Get(key); err != nil || value != fmt.Sprint(i) {
+				t.Fatalf("expected %s=%d, got %q (%v)", key, i, value, err)
+			}
+		}
+		return c.Stats().RecordsRead - reads
+	}
+	withIndex := getAll()
+	idx := c.index
+	c.index = nil
+	withoutIndex := getAll()
+	if withIndex >= withoutIndex {
+		t.Errorf("expected fewer than %d records read with the index, got %d", withoutIndex, withIndex)
+	}
+
+	// A checkpoint that doesn't match its record is ignored.
+	bad := sparseIndex{}
+	for _, cp := range idx {
+		bad = append(bad, checkpoint{offset: cp.offset + 7, key: cp.key})
+	}
+	c.index = bad
+	getAll()
+	c.index = idx
+
+	// Compaction writes an index for the compacted data file.
+	c.Close()
+	c, err = OpenCollectionWithOptions(file, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = OpenCollectionWithOptions(file, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.index) != numKeys/4 {
+		t.Fatalf("expected %d checkpoints after compaction, got %d", numKeys/4, len(c.index))
+	}
+	getAll()
+
+	_, err = c.Clear()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.index != nil {
+		t.Error("expected Clear to drop the index")
+	}
+	if _, err := os.Stat(file + ".index"); !os.IsNotExist(err) {
+		t.Errorf("expected Clear to remove the index file, got %v", err)
+	}
+}
+
+func TestSparseIndexStale(t *testing.T) {
+	const file = "/tmp/test_sparseindex_stale.lm2"
+	opts := Options{CacheSize: 100, IndexCheckpointInterval: 1}
+	c, err := NewCollectionWithOptions(file, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.Destroy()
+	}()
+
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	wb.Set("c", "1")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An update is lost in a crash, but the index was saved with it.
+	lastCommit := c.LastCommit
+	c.crashHook = func(point crashPoint) bool {
+		return point == crashAfterAppend
+	}
+	wb = NewWriteBatch()
+	wb.Set("b", "2")
+	_, err = c.Update(wb)
+	if err != errSimulatedCrash {
+		t.Fatalf("expected a simulated crash, got %v", err)
+	}
+	idx := c.index.add([]checkpoint{{offset: lastCommit, key: "b"}}, c.compare)
+	err = idx.save(file, lastCommit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	c, err = OpenCollectionWithOptions(file, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.index) != 3 {
+		t.Fatalf("expected 3 checkpoints, got %d", len(c.index))
+	}
+	// The checkpoint of b points past the last commit, and then to a
+	// record with another key.
+	wb = NewWriteBatch()
+	wb.Set("bb", "3")
+	wb.Set("d", "3")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur, err := c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{"a": "1", "bb": "3", "c": "1", "d": "3"} {
+		if value, err := cur.Get(key); err != nil || value != expected {
+			t.Errorf("expected %s=%s, got %q (%v)", key, expected, value, err)
+		}
+	}
+	if _, err := cur.Get("b"); err != ErrKeyNotFound {
+		t.Errorf("expected b to be missing, got %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package lm2
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// jsonlBatchSize is the number of lines ImportJSONL commits at a time.
+const jsonlBatchSize = 1000
+
+// jsonlRecord is a line of a JSONL export. JSON strings can't hold
+// invalid UTF-8, so keys and values that aren't valid UTF-8 are written
+// base64-encoded as key_bytes and value_bytes instead.
+type jsonlRecord struct {
+	Key        string `json:"key"`
+	KeyBytes   []byte `json:"key_bytes,omitempty"`
+	Value      string `json:"value"`
+	ValueBytes []byte `json:"value_bytes,omitempty"`
+}
+
+func newJSONLRecord(key, value string) jsonlRecord {
+	rec := jsonlRecord{Key: key, Value: value}
+	if !utf8.ValidString(key) {
+		rec.Key = ""
+		rec.KeyBytes = []byte(key)
+	}
+	if !utf8.ValidString(value) {
+		rec.Value = ""
+		rec.ValueBytes = []byte(value)
+	}
+	return rec
+}
+
+func (rec jsonlRecord) key() string {
+	if rec.KeyBytes != nil {
+		return string(rec.KeyBytes)
+	}
+	return rec.Key
+}
+
+func (rec jsonlRecord) value() string {
+	if rec.ValueBytes != nil {
+		return string(rec.ValueBytes)
+	}
+	return rec.Value
+}
+
+// ExportJSONL writes the live records of the collection to w in key order,
+// one {"key":...,"value":...} JSON object per line. Keys and values that
+// aren't valid UTF-8 are written base64-encoded in "key_bytes" and
+// "value_bytes" instead, so any key or value round trips.
+func (c *Collection) ExportJSONL(w io.Writer) error {
+	cur, err := c.NewCursor()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	for cur.Next() {
+		err = enc.Encode(newJSONLRecord(cur.Key(), cur.Value()))
+		if err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// ImportJSONL creates a new collection with a data file at file and loads
+// the records read from r, in the format written by ExportJSONL.
+// If a key appears more than once, the last value wins.
+// cacheSize represents the size of the collection cache.
+func ImportJSONL(file string, cacheSize int, r io.Reader) (*Collection, error) {
+	c, err := NewCollection(file, cacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(r)
+	wb := NewWriteBatch()
+	pending := 0
+	for line := 1; ; line++ {
+		rec := jsonlRecord{}
+		err = dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.Destroy()
+			return nil, fmt.Errorf("lm2: error decoding record %d: %v", line, err)
+		}
+		wb.Set(rec.key(), rec.value())
+		pending++
+
+		if pending == jsonlBatchSize {
+			if _, err = c.Update(wb); err != nil {
+				c.Destroy()
+				return nil, err
+			}
+			wb = NewWriteBatch()
+			pending = 0
+		}
+	}
+	if pending > 0 {
+		if _, err = c.Update(wb); err != nil {
+			c.Destroy()
+			return nil, err
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,31 @@
+package lm2
+
+import "encoding/binary"
+
+// EncodeUint64 encodes v as 8 big-endian bytes, so that encoded keys
+// sort in numeric order.
+func EncodeUint64(v uint64) string {
+	b := [8]byte{}
+	binary.BigEndian.PutUint64(b[:], v)
+	return string(b[:])
+}
+
+// DecodeUint64 decodes a string encoded by EncodeUint64.
+func DecodeUint64(s string) (uint64, error) {
+	if len(s) != 8 {
+		return 0, ErrInvalidEncoding
+	}
+	return binary.BigEndian.Uint64([]byte(s)), nil
+}
+
+// EncodeInt64 encodes v like EncodeUint64 but with the sign bit flipped,
+// so that negative numbers sort before positive ones.
+func EncodeInt64(v int64) string {
+	return EncodeUint64(uint64(v) ^ 1<<63)
+}
+
+// DecodeInt64 decodes a string encoded by EncodeInt64.
+func DecodeInt64(s string) (int64, error) {
+	v, err := DecodeUint64(s)
+	return int64(v ^ 1<<63), err
+}
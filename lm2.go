@@ -5,10 +5,13 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const sentinelMagic = 0xDEAD10CC
@@ -29,8 +32,59 @@ var (
 	// ErrKeyNotFound is returned when a Cursor.Get() doesn't find
 	// the requested key.
 	ErrKeyNotFound = errors.New("lm2: key not found")
+	// ErrInvalidVersion is returned when a snapshot is requested
+	// at a version that hasn't been committed.
+	ErrInvalidVersion = errors.New("lm2: invalid version")
+	// ErrKeyTooLong is returned when a key is longer than MaxKeyLen bytes.
+	ErrKeyTooLong = errors.New("lm2: key too long")
+	// ErrValueTooLong is returned when a value is longer than
+	// MaxValueLen bytes.
+	ErrValueTooLong = errors.New("lm2: value too long")
+	// ErrStale is returned by cursors and snapshots that were created
+	// before the data file was rewritten by Clear or automatic compaction.
+	ErrStale = errors.New("lm2: stale cursor or snapshot")
+	// ErrCorruptRecord is returned when a record header points past
+	// the last commit, which means it was read at a bad offset or the
+	// data file is corrupt.
+	ErrCorruptRecord = errors.New("lm2: corrupt record")
+	// ErrComparatorMismatch is returned when opening a collection with
+	// a different Options.ComparatorName than it was created with.
+	ErrComparatorMismatch = errors.New("lm2: comparator doesn't match the data file")
+	// ErrReadOnly is returned when modifying a collection
+	// opened with OpenCollectionReadOnly.
+	ErrReadOnly = errors.New("lm2: read-only collection")
+	// ErrInvalidEncoding is returned by DecodeUint64 and DecodeInt64
+	// when a string isn't an encoded integer.
+	ErrInvalidEncoding = errors.New("lm2: invalid encoding")
+	// ErrQuotaExceeded is returned when an Update would grow the data
+	// file past Options.MaxFileSize.
+	ErrQuotaExceeded = errors.New("lm2: quota exceeded")
+	// ErrInvalidPageToken is returned by ListKeys when after isn't
+	// a token it returned.
+	ErrInvalidPageToken = errors.New("lm2: invalid page token")
+	// ErrAlreadyOpen is returned when opening or creating a collection
+	// whose data file is already open for writing in this process.
+	ErrAlreadyOpen = errors.New("lm2: already open")
+	// ErrLocked is returned when opening or creating a collection whose
+	// data file another process has open.
+	ErrLocked = errors.New("lm2: locked by another process")
+	// ErrTimeout is returned when reading, writing or syncing a file
+	// takes longer than Options.OpTimeout.
+	ErrTimeout = errors.New("lm2: operation timed out")
+	// ErrInvalidOffset is returned when there's no record at an offset.
+	ErrInvalidOffset = errors.New("lm2: invalid record offset")
+	// ErrBlobsUnsupported is returned by operations that can't handle
+	// values stored out of line in a blob file.
+	ErrBlobsUnsupported = errors.New("lm2: not supported for collections with blobs")
+	// ErrEmptyFile is returned when opening a collection whose data file
+	// is empty or too short to hold a file header, as an interrupted
+	// NewCollection can leave it. Options.ReinitializeEmpty makes
+	// OpenCollectionWithOptions create an empty collection instead.
+	ErrEmptyFile = errors.New("lm2: empty data file")
 
-	fileVersion = [8]byte{'l', 'm', '2', '_', '0', '0', '1', '\n'}
+	fileVersion = [8]byte{'l', 'm', '2', '_', '0', '0', '2', '\n'}
+	// fileVersion1 data files have no DeadBytes in their header.
+	fileVersion1 = [8]byte{'l', 'm', '2', '_', '0', '0', '1', '\n'}
 )
 
 // RollbackError is the error type returned after rollbacks.
@@ -48,6 +102,29 @@ func (e RollbackError) Error() string {
 	return fmt.Sprintf("lm2: rolled back (%s)", e.Err.Error())
 }
 
+// Unwrap returns the error that caused the rollback, if any.
+func (e RollbackError) Unwrap() error {
+	return e.Err
+}
+
+// Error is the error type returned when reading or writing the data
+// file fails. Op is what was being done, Offset is where in the data file,
+// and Err is the underlying error, which errors.Is and errors.As see.
+type Error struct {
+	Op     string
+	Offset int64
+	Err    error
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("lm2: %s at offset %d (%v)", e.Op, e.Offset, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e Error) Unwrap() error {
+	return e.Err
+}
+
 // IsRollbackError returns true if err is a RollbackError.
 func IsRollbackError(err error) bool {
 	_, ok := err.(RollbackError)
@@ -57,19 +134,79 @@ func IsRollbackError(err error) bool {
 // Collection represents an ordered linked list map.
 type Collection struct {
 	fileHeader
-	f         *os.File
+	// file is the path of the data file, which stays the same
+	// when f is replaced.
+	file      string
+	f         blockFile
 	wal       *wal
+	blobs     *blobFile
 	stats     Stats
 	dirty     map[int64]*record
 	cache     *recordCache
 	dirtyLock sync.Mutex
 
+	// dirtyHeader is the file header of the update in progress.
+	dirtyHeader fileHeader
+
 	// internalState is 0 if OK, 1 if inconsistent.
 	internalState uint32
 
+	// lock is c's hold on its data file in openFiles.
+	// It's released and cleared when c is closed.
+	lock *fileLock
+
+	// readOnly is true if the collection was opened with
+	// OpenCollectionReadOnly. wal is nil in that case.
+	readOnly bool
+	// readOnlySize is the size of a read-only collection's data file
+	// as last seen by readLimit. It's accessed atomically.
+	readOnlySize int64
+
 	metaLock  sync.RWMutex
 	writeLock sync.Mutex
 
+	options       Options
+	compare       func(a, b string) int
+	group         groupCommitter
+	shipper       walShipper
+	autoCompactor autoCompactor
+
+	// lastCommitInfo describes the last commit if it's known.
+	// It's protected by metaLock.
+	lastCommitInfo CommitInfo
+
+	// generation is incremented when the data file is rewritten,
+	// which invalidates record offsets. It's protected by metaLock.
+	generation uint64
+	// firstRecord is the offset of the first record in the data file,
+	// which is recordsStart unless the collection has been cleared.
+	// It's protected by metaLock.
+	firstRecord int64
+	// index is the sparse index of the data file, and indexDirty is true
+	// if it has changed since it was saved. They're modified while
+	// holding both writeLock and metaLock. indexCount is the number of
+	// records inserted since the collection was opened.
+	index      sparseIndex
+	indexDirty bool
+	indexCount int
+
+	// closed is closed when the collection is closed to stop
+	// background goroutines.
+	closed     chan struct{}
+	closeOnce  sync.Once
+	background sync.WaitGroup
+
+	// cursors holds cursors returned by PutCursor.
+	cursors sync.Pool
+
+	// snapshots holds the snapshots that compaction retains with
+	// Options.RetainSnapshots until they're released.
+	snapshots    map[*Snapshot]struct{}
+	snapshotLock sync.Mutex
+
+	// crashHook is set by tests to simulate crashes during updates.
+	crashHook func(point crashPoint) bool
+
 	readAt  func(b []byte, off int64) (n int, err error)
 	writeAt func(b []byte, off int64) (n int, err error)
 }
@@ -78,16 +215,119 @@ type fileHeader struct {
 	Version    [8]byte
 	Next       [maxLevels]int64
 	LastCommit int64
+	// DeadBytes is the space taken up by deleted and overwritten records.
+	// It isn't stored in fileVersion1 data files.
+	DeadBytes int64
 }
 
+const (
+	fileHeaderSize1 = 8 + (maxLevels * 8) + 8
+	fileHeaderSize  = fileHeaderSize1 + 8
+)
+
+// The name of the key comparator is stored after the file header in
+// fileVersion data files, padded with zeros. It's written when the data
+// file is created and never changes.
+const (
+	comparatorNameOffset = fileHeaderSize
+	maxComparatorNameLen = 64
+)
+
+// firstRecordOffset is where fileVersion data files store the offset of
+// their first record, after the comparator name. It's zero, which means
+// recordsStart, until Clear sets it past the last commit before clearing:
+// versions are offsets, and they keep increasing through Clear. The data
+// file is truncated to the header and then extended to the first record,
+// so the space before it is a hole where the file system supports them.
+const firstRecordOffset = comparatorNameOffset + maxComparatorNameLen
+
 func (h fileHeader) bytes() []byte {
 	buf := bytes.NewBuffer(nil)
 	binary.Write(buf, binary.LittleEndian, h)
+	if h.Version != fileVersion {
+		// Older data files may have a record right after the header.
+		return buf.Bytes()[:fileHeaderSize1]
+	}
 	return buf.Bytes()
 }
 
+// decodeFileHeader decodes a file header of any version from b.
+func decodeFileHeader(b []byte) (fileHeader, error) {
+	h := fileHeader{}
+	if len(b) < fileHeaderSize1 {
+		return h, errors.New("lm2: short file header")
+	}
+	padded := [fileHeaderSize]byte{}
+	copy(padded[:], b)
+	err := binary.Read(bytes.NewReader(padded[:]), binary.LittleEndian, &h)
+	if err != nil {
+		return h, err
+	}
+	if h.Version != fileVersion {
+		h.DeadBytes = 0
+	}
+	return h, nil
+}
+
+// checkComparator returns ErrComparatorMismatch if the data file was
+// created with a different comparator than the collection's.
+func (c *Collection) checkComparator() error {
+	name := ""
+	if c.fileHeader.Version == fileVersion {
+		b := [maxComparatorNameLen]byte{}
+		n, err := c.readAt(b[:], comparatorNameOffset)
+		if err != nil && n != len(b) {
+			return err
+		}
+		name = strings.TrimRight(string(b[:]), "\x00")
+	}
+	if name != c.options.ComparatorName {
+		return ErrComparatorMismatch
+	}
+	return nil
+}
+
+// readFileHeader reads the file header from the data file, along with
+// the offset of the first record.
+func (c *Collection) readFileHeader() error {
+	b := [fileHeaderSize]byte{}
+	n, err := c.readAt(b[:], 0)
+	if err != nil && n < fileHeaderSize1 {
+		return err
+	}
+	c.fileHeader, err = decodeFileHeader(b[:n])
+	if err != nil {
+		return err
+	}
+	c.firstRecord = recordsStart
+	if c.fileHeader.Version == fileVersion {
+		first := [8]byte{}
+		n, err = c.readAt(first[:], firstRecordOffset)
+		if err != nil && n != len(first) {
+			return err
+		}
+		if offset := int64(binary.LittleEndian.Uint64(first[:])); offset != 0 {
+			c.firstRecord = offset
+		}
+	}
+	return nil
+}
+
+// truncateData truncates the data file to LastCommit. If nothing has been
+// committed since Clear, it's truncated to the header first, so that the
+// space of the records from before Clear is released even if a crash
+// interrupted it.
+func (c *Collection) truncateData() error {
+	if c.LastCommit == c.firstRecord && c.firstRecord != recordsStart {
+		if err := c.f.Truncate(recordsStart); err != nil {
+			return err
+		}
+	}
+	return c.f.Truncate(c.LastCommit)
+}
+
 type recordHeader struct {
-	_       uint8 // reserved
+	Flags   uint8
 	_       uint8 // reserved
 	Next    [maxLevels]int64
 	Deleted int64
@@ -97,12 +337,45 @@ type recordHeader struct {
 
 const recordHeaderSize = 2 + (maxLevels * 8) + 8 + 2 + 4
 
+// recordsStart is the offset of the first record in a new data file.
+// The file header is padded to it.
+const recordsStart = 512
+
+const (
+	// MaxKeyLen is the maximum length of a key in bytes.
+	MaxKeyLen = math.MaxUint16
+	// MaxValueLen is the maximum length of a value in bytes.
+	MaxValueLen = math.MaxUint32
+)
+
+const (
+	// recordFlagExpires is set if the record header is followed by an
+	// 8 byte expiration time. Records written before expiration
+	// existed have no flags set, so they're read as they always were.
+	recordFlagExpires = 1 << 0
+	// recordFlagBlob is set if the record's value is a blobRef to the
+	// actual value in the blob file.
+	recordFlagBlob = 1 << 1
+)
+
 func (h recordHeader) bytes() []byte {
 	buf := bytes.NewBuffer(nil)
 	binary.Write(buf, binary.LittleEndian, h)
 	return buf.Bytes()
 }
 
+// decodeRecordHeader decodes a header encoded by recordHeader.bytes.
+func decodeRecordHeader(b []byte) recordHeader {
+	h := recordHeader{Flags: b[0]}
+	for i := range h.Next {
+		h.Next[i] = int64(binary.LittleEndian.Uint64(b[2+8*i:]))
+	}
+	h.Deleted = int64(binary.LittleEndian.Uint64(b[2+8*maxLevels:]))
+	h.KeyLen = binary.LittleEndian.Uint16(b[10+8*maxLevels:])
+	h.ValLen = binary.LittleEndian.Uint32(b[12+8*maxLevels:])
+	return h
+}
+
 type sentinelRecord struct {
 	Magic  uint32 // some fixed pattern
 	Offset int64  // this record's offset
@@ -114,9 +387,44 @@ type record struct {
 	Key    string
 	Value  string
 
+	// ExpiresAt is when the record expires in Unix nanoseconds,
+	// or 0 if it never does.
+	ExpiresAt int64
+	// blob is where the value is if recordFlagBlob is set,
+	// in which case Value is empty.
+	blob blobRef
+
 	lock sync.RWMutex
 }
 
+// dataOffset returns the offset of the record's key, which follows the
+// header and any optional fields.
+func (rec *record) dataOffset() int64 {
+	if rec.Flags&recordFlagExpires != 0 {
+		return rec.Offset + recordHeaderSize + 8
+	}
+	return rec.Offset + recordHeaderSize
+}
+
+// size returns the number of bytes the record takes up in the data file.
+func (rec *record) size() uint64 {
+	return uint64(rec.dataOffset()-rec.Offset) + uint64(rec.KeyLen) + uint64(rec.ValLen)
+}
+
+// expired returns true if rec has an expiration time in the past.
+func (rec *record) expired() bool {
+	return rec.ExpiresAt != 0 && rec.ExpiresAt <= time.Now().UnixNano()
+}
+
+// visible returns true if rec is present at snapshot.
+func (rec *record) visible(snapshot int64) bool {
+	deleted := atomic.LoadInt64(&rec.Deleted)
+	if deleted != 0 && deleted <= snapshot {
+		return false
+	}
+	return rec.Offset < snapshot && !rec.expired()
+}
+
 func generateLevel() int {
 	level := 0
 	for i := 0; i < maxLevels-1; i++ {
@@ -145,8 +453,14 @@ func (c *Collection) setDirty(offset int64, rec *record) {
 }
 
 func (c *Collection) readRecord(offset int64, dirty bool) (*record, error) {
+	return c.readRecordCached(offset, dirty, true)
+}
+
+// readRecordCached is like readRecord, but a record read from disk is
+// only added to the cache if cache is true.
+func (c *Collection) readRecordCached(offset int64, dirty, cache bool) (*record, error) {
 	if offset == 0 {
-		return nil, errors.New("lm2: invalid record offset 0")
+		return nil, Error{Op: "read record", Offset: offset, Err: ErrInvalidOffset}
 	}
 
 	if dirty {
@@ -155,48 +469,101 @@ func (c *Collection) readRecord(offset int64, dirty bool) (*record, error) {
 		}
 	}
 
-	c.cache.lock.RLock()
-	if rec := c.cache.cache[offset]; rec != nil {
-		c.cache.lock.RUnlock()
+	if rec := c.cache.get(offset); rec != nil {
 		c.stats.incRecordsRead(1)
 		c.stats.incCacheHits(1)
 		return rec, nil
 	}
-	c.cache.lock.RUnlock()
 
-	recordHeaderBytes := [recordHeaderSize]byte{}
-	n, err := c.readAt(recordHeaderBytes[:], offset)
-	if err != nil && n != recordHeaderSize {
-		return nil, fmt.Errorf("lm2: partial read (%s)", err)
-	}
-
-	header := recordHeader{}
-	err = binary.Read(bytes.NewReader(recordHeaderBytes[:]), binary.LittleEndian, &header)
+	rec, err := c.readRecordHeader(offset)
 	if err != nil {
 		return nil, err
 	}
 
-	keyValBuf := make([]byte, int(header.KeyLen)+int(header.ValLen))
-	n, err = c.readAt(keyValBuf, offset+recordHeaderSize)
+	keyValBuf := make([]byte, int(rec.KeyLen)+int(rec.ValLen))
+	n, err := c.readAt(keyValBuf, rec.dataOffset())
 	if err != nil && n != len(keyValBuf) {
-		return nil, fmt.Errorf("lm2: partial read (%s)", err)
+		return nil, Error{Op: "read record data", Offset: offset, Err: err}
 	}
 
-	key := string(keyValBuf[:int(header.KeyLen)])
-	value := string(keyValBuf[int(header.KeyLen):])
-
-	rec := &record{
-		recordHeader: header,
-		Offset:       offset,
-		Key:          key,
-		Value:        value,
+	rec.Key = string(keyValBuf[:int(rec.KeyLen)])
+	if rec.Flags&recordFlagBlob != 0 {
+		rec.blob, err = decodeBlobRef(keyValBuf[int(rec.KeyLen):])
+		if err != nil {
+			return nil, Error{Op: "read record data", Offset: offset, Err: err}
+		}
+	} else {
+		rec.Value = string(keyValBuf[int(rec.KeyLen):])
 	}
+
 	c.stats.incRecordsRead(1)
 	c.stats.incCacheMisses(1)
-	c.cache.push(rec)
+	if cache {
+		c.cache.push(rec)
+	}
+	return rec, nil
+}
+
+// readRecordHeader reads the header and optional fields of the record
+// at offset from the data file. The key and value aren't read.
+// Records must end before LastCommit.
+func (c *Collection) readRecordHeader(offset int64) (*record, error) {
+	rec := &record{}
+	buf := [recordHeaderSize + 8]byte{}
+	err := c.readRecordHeaderInto(rec, offset, buf[:])
+	if err != nil {
+		return nil, err
+	}
 	return rec, nil
 }
 
+// readRecordHeaderInto is like readRecordHeader but it reads into rec,
+// using buf, which has room for a header and its optional fields.
+func (c *Collection) readRecordHeaderInto(rec *record, offset int64, buf []byte) error {
+	n, err := c.readAt(buf[:recordHeaderSize], offset)
+	if err != nil && n != recordHeaderSize {
+		return Error{Op: "read record header", Offset: offset, Err: err}
+	}
+
+	rec.recordHeader = decodeRecordHeader(buf)
+	rec.Offset = offset
+	rec.ExpiresAt = 0
+	if rec.Flags&recordFlagExpires != 0 {
+		expiresBytes := buf[recordHeaderSize : recordHeaderSize+8]
+		n, err = c.readAt(expiresBytes, offset+recordHeaderSize)
+		if err != nil && n != len(expiresBytes) {
+			return Error{Op: "read record header", Offset: offset, Err: err}
+		}
+		rec.ExpiresAt = int64(binary.LittleEndian.Uint64(expiresBytes))
+	}
+	// Check the lengths before the caller allocates for them.
+	if end := uint64(offset) + rec.size(); end > uint64(c.readLimit(int64(end))) {
+		return Error{Op: "read record header", Offset: offset, Err: ErrCorruptRecord}
+	}
+	return nil
+}
+
+// readLimit returns the offset that a record ending at end has to end
+// before. For a writable collection that's LastCommit. A read-only one
+// can follow links to records committed by a writer after it was opened,
+// which are completely written before they're linked, so the limit is
+// the data file size.
+func (c *Collection) readLimit(end int64) int64 {
+	if !c.readOnly || end <= c.LastCommit {
+		return c.LastCommit
+	}
+	size := atomic.LoadInt64(&c.readOnlySize)
+	if end > size {
+		fi, err := c.f.Stat()
+		if err != nil {
+			return c.LastCommit
+		}
+		size = fi.Size()
+		atomic.StoreInt64(&c.readOnlySize, size)
+	}
+	return size
+}
+
 func (c *Collection) nextRecord(rec *record, level int, dirty bool) (*record, error) {
 	if rec == nil {
 		return nil, errors.New("lm2: invalid record")
@@ -215,40 +582,110 @@ func (c *Collection) nextRecord(rec *record, level int, dirty bool) (*record, er
 // NewCollection creates a new collection with a data file at file.
 // cacheSize represents the size of the collection cache.
 func NewCollection(file string, cacheSize int) (*Collection, error) {
-	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0666)
+	return NewCollectionWithOptions(file, Options{CacheSize: cacheSize})
+}
+
+// NewCollectionWithOptions creates a new collection with a data file at file
+// using the provided options.
+// ErrAlreadyOpen is returned if file is already open in this process,
+// and ErrLocked if another process has it open.
+func NewCollectionWithOptions(file string, opts Options) (*Collection, error) {
+	lock, err := acquireFile(file, false, os.O_CREATE, opts.fileMode())
+	if err != nil {
+		return nil, err
+	}
+	c, err := newCollection(file, opts)
+	if err != nil {
+		lock.release()
+		return nil, err
+	}
+	c.lock = lock
+	return c, nil
+}
+
+func newCollection(file string, opts Options) (*Collection, error) {
+	compare, err := opts.comparator()
+	if err != nil {
+		return nil, err
+	}
+	f, err := openDataFile(file, os.O_CREATE|os.O_RDWR, opts.fileMode(), opts.OpTimeout)
 	if err != nil {
 		return nil, err
 	}
-	err = f.Truncate(0)
+	if opts.FileMode != 0 {
+		// The umask applied when the file was created.
+		err = os.Chmod(file, opts.FileMode.Perm())
+	}
+	if err == nil {
+		err = f.Truncate(0)
+	}
+	for _, stale := range []string{file + ".blob", indexFile(file), txnFile(file)} {
+		if err == nil {
+			// Left by a collection the new one replaces.
+			err = os.Remove(stale)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		}
+	}
 	if err != nil {
 		f.Close()
 		return nil, err
 	}
 
-	wal, err := newWAL(file + ".wal")
+	wal, err := newWAL(opts.walFile(file), opts.FileMode)
 	if err != nil {
 		f.Close()
 		return nil, err
 	}
+	wal.noSync = opts.Sync != SyncAlways
+	wal.timeout = opts.OpTimeout
 	c := &Collection{
+		file:    file,
 		f:       f,
 		wal:     wal,
-		cache:   newCache(cacheSize),
+		blobs:   newBlobFile(file+".blob", opts, false),
+		cache:   opts.newCache(),
+		options: opts,
+		compare: compare,
+		closed:  make(chan struct{}),
 		readAt:  f.ReadAt,
 		writeAt: f.WriteAt,
 	}
+	c.cache.compare = compare
 
 	// write file header
 	c.fileHeader.Version = fileVersion
 	c.fileHeader.Next[0] = 0
-	c.fileHeader.LastCommit = int64(512)
+	c.fileHeader.LastCommit = recordsStart
+	c.firstRecord = recordsStart
 	c.f.Seek(0, 0)
 	err = binary.Write(c.f, binary.LittleEndian, c.fileHeader)
 	if err != nil {
 		c.f.Close()
 		c.wal.Close()
+		c.cache.release()
 		return nil, err
 	}
+	comparatorName := [maxComparatorNameLen]byte{}
+	copy(comparatorName[:], opts.ComparatorName)
+	_, err = c.writeAt(comparatorName[:], comparatorNameOffset)
+	if err != nil {
+		c.f.Close()
+		c.wal.Close()
+		c.cache.release()
+		return nil, err
+	}
+	// Records start after the header region so that versions
+	// only increase.
+	err = c.f.Truncate(c.LastCommit)
+	if err != nil {
+		c.f.Close()
+		c.wal.Close()
+		c.cache.release()
+		return nil, err
+	}
+	c.startBackground()
 	return c, nil
 }
 
@@ -256,105 +693,614 @@ func NewCollection(file string, cacheSize int) (*Collection, error) {
 // cacheSize represents the size of the collection cache.
 // ErrDoesNotExist is returned if file does not exist.
 func OpenCollection(file string, cacheSize int) (*Collection, error) {
-	f, err := os.OpenFile(file, os.O_RDWR, 0666)
+	return OpenCollectionWithOptions(file, Options{CacheSize: cacheSize})
+}
+
+// OpenCollectionWithOptions opens a collection with a data file at file
+// using the provided options.
+// ErrDoesNotExist is returned if file does not exist, ErrAlreadyOpen
+// if it's already open in this process and ErrLocked if another process
+// has it open.
+func OpenCollectionWithOptions(file string, opts Options) (*Collection, error) {
+	err := recoverUpdateAll(file)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := acquireFile(file, false, 0, 0)
+	if os.IsNotExist(err) {
+		// Check if there's a compacted version.
+		if _, err = os.Stat(file + ".compact"); err != nil {
+			return nil, ErrDoesNotExist
+		}
+		// There is.
+		err = renameCompacted(file+".compact", file)
+		if err != nil {
+			return nil, fmt.Errorf("lm2: error recovering compacted data file: %v", err)
+		}
+		lock, err = acquireFile(file, false, 0, 0)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrDoesNotExist
+		}
+		return nil, err
+	}
+	c, err := openCollection(file, opts)
+	if err == ErrEmptyFile && opts.ReinitializeEmpty {
+		c, err = newCollection(file, opts)
+	}
+	if err != nil {
+		lock.release()
+		return nil, err
+	}
+	c.lock = lock
+	return c, nil
+}
+
+func openCollection(file string, opts Options) (*Collection, error) {
+	compare, err := opts.comparator()
+	if err != nil {
+		return nil, err
+	}
+	f, err := openDataFile(file, os.O_RDWR, 0666, opts.OpTimeout)
 	if err != nil {
 		if os.IsNotExist(err) {
-			// Check if there's a compacted version.
-			if _, err = os.Stat(file + ".compact"); err == nil {
-				// There is.
-				err = os.Rename(file+".compact", file)
-				if err != nil {
-					return nil, fmt.Errorf("lm2: error recovering compacted data file: %v", err)
-				}
-				return OpenCollection(file, cacheSize)
-			}
 			return nil, ErrDoesNotExist
 		}
 		return nil, fmt.Errorf("lm2: error opening data file: %v", err)
 	}
+	err = checkDataFileSize(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
 	// Check if there's a compacted version.
 	if _, err = os.Stat(file + ".compact"); err == nil {
-		// There is. Remove it and its wal.
+		// There is. Remove it, its wal, its blobs and its index.
 		os.Remove(file + ".compact")
 		os.Remove(file + ".compact.wal")
+		os.Remove(file + ".compact.blob")
+		os.Remove(indexFile(file + ".compact"))
 	}
 
-	wal, err := openWAL(file + ".wal")
+	wal, err := openWAL(opts.walFile(file))
 	if os.IsNotExist(err) {
-		wal, err = newWAL(file + ".wal")
+		wal, err = newWAL(opts.walFile(file), opts.FileMode)
 	}
 	if err != nil {
 		f.Close()
 		return nil, fmt.Errorf("lm2: error WAL: %v", err)
 	}
 
+	wal.noSync = opts.Sync != SyncAlways
+	wal.timeout = opts.OpTimeout
 	c := &Collection{
+		file:    file,
 		f:       f,
 		wal:     wal,
-		cache:   newCache(cacheSize),
+		blobs:   newBlobFile(file+".blob", opts, false),
+		cache:   opts.newCache(),
+		options: opts,
+		compare: compare,
+		closed:  make(chan struct{}),
 		readAt:  f.ReadAt,
 		writeAt: f.WriteAt,
 	}
+	c.cache.compare = compare
 
 	// Read file header.
-	c.f.Seek(0, 0)
-	err = binary.Read(c.f, binary.LittleEndian, &c.fileHeader)
+	err = c.readFileHeader()
 	if err != nil {
 		c.Close()
 		return nil, fmt.Errorf("lm2: error reading file header: %v", err)
 	}
+	err = c.checkComparator()
+	if err != nil {
+		c.f.Close()
+		c.wal.Close()
+		c.cache.release()
+		return nil, err
+	}
+
+	err = c.replayWAL()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.loadIndex()
+	if opts.VerifyOnOpen {
+		err = c.Verify()
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	c.startBackground()
+	return c, nil
+}
 
-	// Read last WAL entry.
-	lastEntry, err := c.wal.ReadLastEntry()
+// replayWAL applies the WAL entries that weren't applied again, or
+// without one makes sure the header ends at a commit, then truncates
+// the data file to the last commit and syncs. Entries that commit at or
+// after the data file's last commit are applied again, in order. The file
+// header must have been read.
+func (c *Collection) replayWAL() error {
+	entries, err := c.wal.ReadEntries()
 	if err != nil {
 		// Maybe latest WAL write didn't succeed.
 		// Truncate.
+		c.logf("discarding unreadable WAL entry: %v", err)
 		c.wal.Truncate()
+
+		// Without a WAL entry, the header is all there is to go on.
+		// If it doesn't end at a commit, fall back to the last one.
+		err = c.recoverLastCommit()
+		if err != nil {
+			return err
+		}
 	} else {
-		// Apply last WAL entry again.
-		for _, walRec := range lastEntry.records {
-			_, err := c.writeAt(walRec.Data, walRec.Offset)
-			if err != nil {
-				c.Close()
-				return nil, fmt.Errorf("lm2: partial write (%s)", err)
+		// Versions only increase, so entries that commit before the
+		// last commit are left over from older commits and were applied
+		// already. The entry of the last commit is applied again: its
+		// header may have reached the disk before the records it links.
+		lastCommit := c.LastCommit
+		var last *walEntry
+		replayed := 0
+		for _, entry := range entries {
+			version := entry.version()
+			if version < lastCommit {
+				continue
+			}
+			for _, walRec := range entry.records {
+				_, err := c.writeAt(walRec.Data, walRec.Offset)
+				if err != nil {
+					return Error{Op: "replay WAL", Offset: walRec.Offset, Err: err}
+				}
 			}
+			lastCommit = version
+			last = entry
+			replayed++
+		}
+		if replayed > 1 {
+			c.logf("replayed %d WAL entries", replayed)
 		}
 
 		// Reread file header because it could have been updated
-		c.f.Seek(0, 0)
-		err = binary.Read(c.f, binary.LittleEndian, &c.fileHeader)
+		err = c.readFileHeader()
 		if err != nil {
-			c.Close()
-			return nil, fmt.Errorf("lm2: error reading file header: %v", err)
+			return fmt.Errorf("lm2: error reading file header: %v", err)
+		}
+		if last != nil {
+			c.lastCommitInfo = last.commitInfo(c.LastCommit)
 		}
 	}
 
-	c.f.Truncate(c.LastCommit)
+	c.truncateData()
+	return c.sync()
+}
 
-	err = c.sync()
+// Reload recovers a collection that an error has left inconsistent, so
+// that OK returns false and operations return ErrInternal, without closing
+// it: the data file and WAL are reopened and recovered as OpenCollection
+// would, and the cache is emptied. Cursors and snapshots created before
+// return ErrStale. Reload does nothing if the collection is OK, and it
+// returns ErrInternal if it has been closed. If recovery fails, its error
+// is returned and the collection stays inconsistent.
+func (c *Collection) Reload() error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	select {
+	case <-c.closed:
+		return ErrInternal
+	default:
+	}
+	if atomic.LoadUint32(&c.internalState) == 0 {
+		return nil
+	}
+
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+	f, err := openDataFile(c.file, os.O_RDWR, 0, c.options.OpTimeout)
 	if err != nil {
-		c.Close()
+		return fmt.Errorf("lm2: error opening data file: %v", err)
+	}
+	wal, err := openWAL(c.options.walFile(c.file))
+	if os.IsNotExist(err) {
+		wal, err = newWAL(c.options.walFile(c.file), c.options.FileMode)
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("lm2: error WAL: %v", err)
+	}
+	wal.noSync = c.wal.noSync
+	wal.timeout = c.wal.timeout
+	c.f.Close()
+	c.wal.Close()
+	c.f = f
+	c.readAt = f.ReadAt
+	c.writeAt = f.WriteAt
+	c.wal = wal
+
+	err = c.readFileHeader()
+	if err != nil {
+		return fmt.Errorf("lm2: error reading file header: %v", err)
+	}
+	err = c.replayWAL()
+	if err != nil {
+		return err
+	}
+	c.cache.reset()
+	c.shipper.reset()
+	c.generation++
+	atomic.StoreUint32(&c.internalState, 0)
+	c.logf("reloaded at version %d", c.LastCommit)
+	return nil
+}
+
+// OpenCollectionReadOnly opens the collection with a data file at file
+// for reading only. The WAL isn't opened or replayed, so the collection
+// is read as of its last complete commit, and nothing is written to disk.
+// Any number of read-only collections can open the same file, including
+// while another process updates it; they see the state at open time.
+// They hold a shared lock on it if they can, so that no other process can
+// open it for writing until they're closed. Updates return ErrReadOnly.
+// ErrDoesNotExist is returned if file does not exist.
+func OpenCollectionReadOnly(file string, cacheSize int) (*Collection, error) {
+	return openReadOnly(file, Options{CacheSize: cacheSize})
+}
+
+// openReadOnly is like OpenCollectionReadOnly but uses the cache size
+// and comparator from opts.
+func openReadOnly(file string, opts Options) (*Collection, error) {
+	lock, err := acquireFile(file, true, 0, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrDoesNotExist
+		}
+		return nil, err
+	}
+	c, err := newReadOnly(file, opts)
+	if err != nil {
+		lock.release()
 		return nil, err
 	}
+	c.lock = lock
+	return c, nil
+}
 
+func newReadOnly(file string, opts Options) (*Collection, error) {
+	compare, err := opts.comparator()
+	if err != nil {
+		return nil, err
+	}
+	f, err := openDataFile(file, os.O_RDONLY, 0, opts.OpTimeout)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrDoesNotExist
+		}
+		return nil, fmt.Errorf("lm2: error opening data file: %v", err)
+	}
+	err = checkDataFileSize(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	c := &Collection{
+		file:  file,
+		f:     f,
+		blobs: newBlobFile(file+".blob", opts, true),
+		cache: newCache(opts.CacheSize),
+		options: Options{
+			CacheSize:         opts.CacheSize,
+			Comparator:        opts.Comparator,
+			ComparatorName:    opts.ComparatorName,
+			SeekCachePolicy:   opts.SeekCachePolicy,
+			SeekCacheInterval: opts.SeekCacheInterval,
+			OpTimeout:         opts.OpTimeout,
+		},
+		compare:  compare,
+		readOnly: true,
+		closed:   make(chan struct{}),
+		readAt:   f.ReadAt,
+	}
+	c.cache.compare = compare
+
+	// Read file header.
+	err = c.readFileHeader()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lm2: error reading file header: %v", err)
+	}
+	err = c.checkComparator()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	c.loadIndex()
 	return c, nil
 }
 
+// checkDataFileSize returns ErrEmptyFile if f is too short to hold
+// a file header.
+func checkDataFileSize(f blockFile) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("lm2: error opening data file: %v", err)
+	}
+	if fi.Size() < fileHeaderSize1 {
+		return ErrEmptyFile
+	}
+	return nil
+}
+
+// sentinelAt returns true if there's a commit sentinel at offset.
+func (c *Collection) sentinelAt(offset int64) bool {
+	b := [12]byte{}
+	n, _ := c.readAt(b[:], offset)
+	return n == len(b) &&
+		binary.LittleEndian.Uint32(b[:4]) == sentinelMagic &&
+		int64(binary.LittleEndian.Uint64(b[4:])) == offset
+}
+
+// lastSentinel returns the end of the last commit sentinel that ends at
+// or before end, or 0 if there isn't one.
+func (c *Collection) lastSentinel(end int64) (int64, error) {
+	const chunkSize = 1 << 16
+	magic := [4]byte{}
+	binary.LittleEndian.PutUint32(magic[:], sentinelMagic)
+	for end > 0 {
+		start := end - chunkSize
+		if start < 0 {
+			start = 0
+		}
+		// Chunks overlap by a sentinel so that none is split.
+		b := make([]byte, int(end-start))
+		n, err := c.readAt(b, start)
+		if err != nil && n != len(b) {
+			return 0, err
+		}
+		for i := len(b) - 12; i >= 0; i-- {
+			if bytes.Equal(b[i:i+4], magic[:]) && c.sentinelAt(start+int64(i)) {
+				return start + int64(i) + 12, nil
+			}
+		}
+		if start == 0 {
+			break
+		}
+		end = start + 11
+	}
+	return 0, nil
+}
+
+// recoverLastCommit checks that the header's last commit ends with a
+// sentinel, which it doesn't if the header or the end of the data file
+// was damaged while the WAL was unavailable. If it doesn't, the
+// collection is rolled back to the last commit with a sentinel. Links
+// in the header may still point past it, which Verify reports and
+// RepairCollection fixes.
+func (c *Collection) recoverLastCommit() error {
+	if c.LastCommit <= c.firstRecord || c.sentinelAt(c.LastCommit-12) {
+		return nil
+	}
+	fi, err := c.f.Stat()
+	if err != nil {
+		return err
+	}
+	end := c.LastCommit
+	if fi.Size() < end {
+		end = fi.Size()
+	}
+	lastCommit, err := c.lastSentinel(end)
+	if err != nil {
+		return err
+	}
+	if lastCommit < c.firstRecord && c.firstRecord > recordsStart {
+		// Nothing was committed since Clear, and anything before
+		// its first record is left over from before.
+		lastCommit = c.firstRecord
+	}
+	if lastCommit == 0 {
+		return errors.New("lm2: no complete commit found in data file")
+	}
+	c.logf("last commit at %d is incomplete, rolling back to %d", c.LastCommit, lastCommit)
+	c.LastCommit = lastCommit
+	_, err = c.writeAt(c.fileHeader.bytes(), 0)
+	return err
+}
+
 func (c *Collection) sync() error {
-	if err := c.wal.f.Sync(); err != nil {
-		return errors.New("lm2: error syncing WAL")
+	if c.readOnly {
+		return nil
+	}
+	if err := c.wal.sync(); err != nil {
+		return fmt.Errorf("lm2: error syncing WAL: %w", err)
+	}
+	if err := c.blobs.sync(); err != nil {
+		return fmt.Errorf("lm2: error syncing blob file: %w", err)
+	}
+	if err := c.f.Sync(); err != nil {
+		return fmt.Errorf("lm2: error syncing data file: %w", err)
+	}
+	return nil
+}
+
+// syncData syncs the data file during an Update if
+// the durability mode requires it.
+func (c *Collection) syncData() error {
+	if c.options.Sync != SyncAlways {
+		return nil
+	}
+	return c.f.Sync()
+}
+
+// startBackground starts the collection's background goroutines.
+func (c *Collection) startBackground() {
+	if c.options.Sync == SyncInterval {
+		c.background.Add(1)
+		go c.runSyncer()
+	}
+}
+
+// Flush syncs the WAL and the data file, so everything committed so far
+// is durable even with SyncInterval or SyncNever. It doesn't block reads,
+// and an update only waits for it before applying its commit. It can be
+// called at any time.
+func (c *Collection) Flush() error {
+	if c.readOnly {
+		return nil
+	}
+
+	// Reload and compaction replace the files while holding metaLock.
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return ErrInternal
+	}
+	if err := c.wal.sync(); err != nil {
+		return fmt.Errorf("lm2: error syncing WAL: %w", err)
+	}
+	if err := c.blobs.sync(); err != nil {
+		return fmt.Errorf("lm2: error syncing blob file: %w", err)
+	}
+	if err := c.f.Sync(); err != nil {
+		return fmt.Errorf("lm2: error syncing data file: %w", err)
+	}
+	return nil
+}
+
+// Checkpoint makes sure the last commit is durable in the data file and
+// empties the WAL, so there's nothing to replay after a crash. It also
+// saves the sparse index kept with Options.IndexCheckpointInterval. It waits
+// for any Update in progress. An error is returned, and the WAL is kept,
+// if the WAL's entry doesn't match the last commit.
+func (c *Collection) Checkpoint() error {
+	if c.readOnly {
+		return ErrReadOnly
 	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return ErrInternal
+	}
+
 	if err := c.f.Sync(); err != nil {
-		return errors.New("lm2: error syncing data file")
+		return fmt.Errorf("lm2: error syncing data file: %w", err)
+	}
+	if c.wal.size > 0 {
+		entry, err := c.wal.ReadLastEntry()
+		if err != nil {
+			return fmt.Errorf("lm2: error reading WAL: %v", err)
+		}
+		for _, walRec := range entry.records {
+			if walRec.Offset != 0 {
+				continue
+			}
+			header, err := decodeFileHeader(walRec.Data)
+			if err != nil {
+				return err
+			}
+			if header.LastCommit != c.LastCommit {
+				return fmt.Errorf("lm2: WAL entry is for version %d, not the last commit %d",
+					header.LastCommit, c.LastCommit)
+			}
+		}
 	}
+	if err := c.wal.Truncate(); err != nil {
+		return err
+	}
+	if err := c.wal.sync(); err != nil {
+		return fmt.Errorf("lm2: error syncing WAL: %w", err)
+	}
+	c.saveIndex()
 	return nil
 }
 
-// Close closes a collection and all of its resources.
+// dataFile returns the current data file. Automatic compaction replaces
+// it, so it's only safe to use c.f directly while holding writeLock or
+// metaLock.
+func (c *Collection) dataFile() blockFile {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	return c.f
+}
+
+// walFile returns the current WAL file, or nil if the collection is
+// read-only. Reload replaces the WAL while holding metaLock.
+func (c *Collection) walFile() *os.File {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	if c.wal == nil {
+		return nil
+	}
+	return c.wal.f
+}
+
+func (c *Collection) runSyncer() {
+	defer c.background.Done()
+	period := c.options.SyncPeriod
+	if period <= 0 {
+		period = defaultSyncPeriod
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			if err := c.Flush(); err != nil && c.OK() {
+				c.logf("background sync failed: %v", err)
+			}
+		}
+	}
+}
+
+// Close closes a collection and all of its resources. It waits for any
+// Update in progress.
 func (c *Collection) Close() {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.close()
+}
+
+// close closes the collection. writeLock must be held, so that no
+// Update is between appending to the data file or WAL and applying.
+func (c *Collection) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	c.background.Wait()
+
 	c.metaLock.Lock()
 	defer c.metaLock.Unlock()
+	defer func() {
+		if c.lock != nil {
+			c.lock.release()
+			c.lock = nil
+		}
+	}()
+	c.cache.release()
+	if c.readOnly {
+		c.f.Close()
+		c.blobs.close()
+		atomic.StoreUint32(&c.internalState, 1)
+		return
+	}
+	if c.options.Sync != SyncAlways && atomic.LoadUint32(&c.internalState) == 0 {
+		// Make sure everything is on disk before the WAL is removed.
+		c.sync()
+	}
+	if atomic.LoadUint32(&c.internalState) == 0 {
+		c.saveIndex()
+	}
 	c.f.Close()
+	c.blobs.close()
 	c.wal.Close()
 	if atomic.LoadUint32(&c.internalState) == 0 {
 		// Internal state is OK. Safe to delete WAL.
@@ -370,24 +1316,88 @@ func (c *Collection) Version() int64 {
 	return c.LastCommit
 }
 
+// CommitInfo describes a commit.
+type CommitInfo struct {
+	// Version is the version the commit created.
+	Version int64
+	// Time is when the commit was made on the collection that made it.
+	// It's zero for commits logged before WAL entries had timestamps.
+	Time time.Time
+	// Tag is the tag set with WriteBatch.SetTag, if any.
+	Tag []byte
+}
+
+// LastCommitInfo returns the CommitInfo of the last commit, which comes
+// from its WAL entry. For a follower, that's the last commit applied by
+// ApplyWALStream. It returns false if the last commit isn't known, because
+// the collection was closed cleanly (which removes the WAL) or there has
+// been no commit since it was created, compacted or cleared.
+func (c *Collection) LastCommitInfo() (CommitInfo, bool) {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	info := c.lastCommitInfo
+	if info.Version != c.LastCommit {
+		return CommitInfo{}, false
+	}
+	info.Tag = append([]byte(nil), info.Tag...)
+	return info, true
+}
+
 // Stats returns collection statistics.
+// Gathering sizes doesn't block updates.
 func (c *Collection) Stats() Stats {
-	return c.stats.clone()
+	stats := c.stats.clone()
+	if fi, err := c.dataFile().Stat(); err == nil {
+		stats.DataFileSize = fi.Size()
+	}
+	if f := c.walFile(); f != nil {
+		if fi, err := f.Stat(); err == nil {
+			stats.WALSize = fi.Size()
+		}
+	}
+	c.metaLock.RLock()
+	stats.DeadBytes = uint64(c.DeadBytes)
+	c.metaLock.RUnlock()
+	c.autoCompactor.lock.Lock()
+	stats.LastAutoCompaction = c.autoCompactor.last
+	stats.AutoCompactReclaimed = c.autoCompactor.reclaimed
+	c.autoCompactor.lock.Unlock()
+	c.cache.lock.RLock()
+	stats.CacheRecords = len(c.cache.cache)
+	c.cache.lock.RUnlock()
+	return stats
 }
 
 // Destroy closes the collection and removes its associated data files.
 func (c *Collection) Destroy() error {
-	c.Close()
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.destroy()
+}
+
+// destroy is Destroy with writeLock held.
+func (c *Collection) destroy() error {
+	c.close()
 	var err error
 	err = os.Remove(c.f.Name())
 	if err != nil {
 		return err
 	}
+	for _, file := range []string{c.blobs.name, indexFile(c.file)} {
+		err = os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	return nil
 }
 
-// Compact rewrites a collection to clean up deleted records and optimize
-// data layout on disk.
+// Compact rewrites a collection to clean up deleted and expired records
+// and optimize data layout on disk. Records that haven't expired keep
+// their expiration time.
 // NOTE: The collection is closed after compaction, so you'll have to reopen it.
 func (c *Collection) Compact() error {
 	return c.CompactFunc(func(key, value string) (string, string, bool) {
@@ -401,48 +1411,146 @@ func (c *Collection) Compact() error {
 // Returning false will skip the record.
 // NOTE: The collection is closed after compaction, so you'll have to reopen it.
 func (c *Collection) CompactFunc(f func(key, value string) (string, string, bool)) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
 	c.writeLock.Lock()
 	defer c.writeLock.Unlock()
-	newCollection, err := NewCollection(c.f.Name()+".compact", 10)
+	compacted, _, err := c.writeCompacted(f, false, nil, nil)
 	if err != nil {
 		return err
 	}
-	cur, err := c.NewCursor()
+	err = c.destroy()
 	if err != nil {
 		return err
 	}
-	const batchSize = 1000
-	remaining := batchSize
-	wb := NewWriteBatch()
-	for cur.Next() {
-		key, val, keep := f(cur.Key(), cur.Value())
-		if !keep {
-			continue
-		}
-		wb.Set(key, val)
-		remaining--
+	return renameCompacted(compacted, c.f.Name())
+}
 
-		if remaining == 0 {
-			_, err := newCollection.Update(wb)
-			if err != nil {
-				return err
-			}
-			remaining = batchSize
-			wb = NewWriteBatch()
+// renameCompacted replaces the data file at file with the compacted one
+// at compacted, along with their blob and index files. A compacted data
+// file without a blob file has no blobs, and one without an index file
+// has no index. The data file is renamed last, so if it's interrupted, it
+// can be done again while compacted exists.
+func renameCompacted(compacted, file string) error {
+	err := renameCompanion(compacted+".blob", file+".blob")
+	if err == nil {
+		err = renameCompanion(indexFile(compacted), indexFile(file))
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(compacted, file)
+}
+
+// renameCompanion renames a file that goes with a data file, or
+// removes newName if oldName doesn't exist.
+func renameCompanion(oldName, newName string) error {
+	err := os.Rename(oldName, newName)
+	if os.IsNotExist(err) {
+		err = os.Remove(newName)
+		if os.IsNotExist(err) {
+			err = nil
 		}
 	}
-	if remaining < batchSize {
-		_, err := newCollection.Update(wb)
+	return err
+}
+
+// Clear deletes every key in the collection and truncates its data file
+// back to the header, and its blob file if it has one, keeping the
+// collection open. It returns the new version, which is greater than
+// the versions before it. The new header is written through the WAL
+// first, so after a crash the collection is either unchanged or empty.
+// Snapshots and WAL streams of the collection from before Clear can't
+// be used, and cursors and snapshots created before Clear return
+// ErrStale.
+func (c *Collection) Clear() (int64, error) {
+	if c.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return 0, ErrInternal
+	}
+
+	// The first record comes after the last commit, so that the
+	// version of the empty collection is greater. Data files of older
+	// versions are upgraded, since none of their records are kept.
+	header := fileHeader{
+		Version:    fileVersion,
+		LastCommit: c.LastCommit + 1,
+	}
+	// The comparator name is written again along with the offset of the
+	// first record.
+	trailer := [maxComparatorNameLen + 8]byte{}
+	copy(trailer[:], c.options.ComparatorName)
+	binary.LittleEndian.PutUint64(trailer[maxComparatorNameLen:], uint64(header.LastCommit))
+	walEntry := newWALEntry()
+	walEntry.Push(newWALRecord(0, header.bytes()))
+	walEntry.Push(newWALRecord(comparatorNameOffset, trailer[:]))
+	_, err := c.wal.Append(walEntry)
+	if err != nil {
+		c.wal.Truncate()
+		return 0, err
+	}
+
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+	for _, walRec := range walEntry.records {
+		_, err = c.writeAt(walRec.Data, walRec.Offset)
 		if err != nil {
-			return err
+			return 0, c.markInconsistent(Error{Op: "write header", Offset: walRec.Offset, Err: err})
 		}
 	}
-	err = c.Destroy()
+	err = c.syncData()
+	if err == nil {
+		// Reopening truncates the same way, so a crash from here
+		// on leaves an empty collection.
+		c.LastCommit = header.LastCommit
+		c.firstRecord = header.LastCommit
+		err = c.truncateData()
+	}
 	if err != nil {
-		return err
+		return 0, c.markInconsistent(err)
+	}
+	c.wal.Truncate()
+	if err := c.blobs.truncate(0); err != nil {
+		c.logf("couldn't truncate the blob file: %v", err)
+	}
+
+	if err := os.Remove(indexFile(c.file)); err != nil && !os.IsNotExist(err) {
+		c.logf("couldn't remove the index file: %v", err)
+	}
+
+	c.cache.reset()
+	c.shipper.reset()
+	c.generation++
+	c.index = nil
+	c.indexDirty = false
+	c.fileHeader.Version = fileVersion
+	c.DeadBytes = 0
+	c.lastCommitInfo = CommitInfo{}
+	for i := range c.Next {
+		atomic.StoreInt64(&c.fileHeader.Next[i], 0)
 	}
-	newCollection.Close()
-	return os.Rename(newCollection.f.Name(), c.f.Name())
+	return c.LastCommit, nil
+}
+
+// logf sends a message to the collection's Logger, if it has one.
+func (c *Collection) logf(format string, args ...interface{}) {
+	if c.options.Logger != nil {
+		c.options.Logger.Printf("lm2: %s: "+format, append([]interface{}{c.file}, args...)...)
+	}
+}
+
+// markInconsistent marks the collection inconsistent after err
+// and returns err.
+func (c *Collection) markInconsistent(err error) error {
+	atomic.StoreUint32(&c.internalState, 1)
+	c.logf("collection is inconsistent: %v", err)
+	return err
 }
 
 // OK returns true if the internal state of the collection is valid.
@@ -1,10 +1,18 @@
 package lm2
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"math/rand"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -1234,3 +1242,4735 @@ func TestCursorGet(t *testing.T) {
 		t.Fatalf("expected ErrKeyNotFound but got %v", err)
 	}
 }
+
+func TestPrefixCursor(t *testing.T) {
+	c, err := NewCollection("/tmp/test_prefixcursor.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	wb.Set("user:12", "a")
+	wb.Set("user:123:a", "1")
+	wb.Set("user:123:b", "2")
+	wb.Set("user:123:c", "3")
+	wb.Set("user:124", "b")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wb = NewWriteBatch()
+	wb.Delete("user:123:b")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][2]string{
+		{"user:123:a", "1"},
+		{"user:123:c", "3"},
+	}
+
+	cur, err := c.NewPrefixCursor("user:123:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := 0
+	for cur.Next() {
+		if i == len(expected) {
+			t.Fatal("unexpected key", cur.Key())
+		}
+		if cur.Key() != expected[i][0] || cur.Value() != expected[i][1] {
+			t.Errorf("expected %v => %v, got %v => %v",
+				expected[i][0], expected[i][1], cur.Key(), cur.Value())
+		}
+		i++
+	}
+	if err = cur.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != len(expected) {
+		t.Errorf("expected %d keys, got %d", len(expected), i)
+	}
+
+	cur, err = c.NewPrefixCursor("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for cur.Next() {
+		count++
+	}
+	if err = cur.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("expected 4 keys, got %d", count)
+	}
+
+	cur, err = c.NewPrefixCursor("missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cur.Next() {
+		t.Error("unexpected key", cur.Key())
+	}
+}
+
+func TestRange(t *testing.T) {
+	c, err := NewCollection("/tmp/test_range.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 10; i++ {
+		wb.Set(fmt.Sprintf("key%d", i), fmt.Sprint(i))
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wb = NewWriteBatch()
+	wb.Delete("key4")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kvs, err := c.Range("key2", "key7", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []KV{
+		{"key2", "2"},
+		{"key3", "3"},
+		{"key5", "5"},
+		{"key6", "6"},
+	}
+	if len(kvs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, kvs)
+	}
+	for i := range expected {
+		if kvs[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], kvs[i])
+		}
+	}
+
+	kvs, err = c.Range("key2", "key7", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 2 || kvs[1].Key != "key3" {
+		t.Errorf("expected 2 pairs ending at key3, got %v", kvs)
+	}
+
+	kvs, err = c.Range("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 9 {
+		t.Errorf("expected 9 pairs, got %d", len(kvs))
+	}
+}
+
+func TestSyncModes(t *testing.T) {
+	for _, mode := range []SyncMode{SyncAlways, SyncInterval, SyncNever} {
+		file := fmt.Sprintf("/tmp/test_syncmodes_%d.lm2", mode)
+		opts := Options{
+			CacheSize:  100,
+			Sync:       mode,
+			SyncPeriod: time.Millisecond,
+		}
+		c, err := NewCollectionWithOptions(file, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 20; i++ {
+			wb := NewWriteBatch()
+			wb.Set(fmt.Sprint(i), fmt.Sprint(i))
+			if _, err := c.Update(wb); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		c.Close()
+
+		c, err = OpenCollectionWithOptions(file, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count := verifyOrder(t, c, nil); count != 20 {
+			t.Errorf("mode %d: expected 20 records, got %d", mode, count)
+		}
+		if err = c.Destroy(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConcurrentReadersDuringUpdate(t *testing.T) {
+	c, err := NewCollection("/tmp/test_concurrentreaders.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	const NumBatches = 100
+	const BatchSize = 10
+	const NumReaders = 8
+
+	done := make(chan struct{})
+	errs := make(chan error, NumReaders+1)
+	wg := sync.WaitGroup{}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 0; i < NumBatches; i++ {
+			wb := NewWriteBatch()
+			// Spread each batch over the whole key space.
+			for j := 0; j < BatchSize; j++ {
+				wb.Set(fmt.Sprintf("%02d-%05d", j, i), fmt.Sprint(i))
+			}
+			if _, err := c.Update(wb); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	for r := 0; r < NumReaders; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				cur, err := c.NewCursor()
+				if err != nil {
+					errs <- err
+					return
+				}
+				count := 0
+				prev := ""
+				for cur.Next() {
+					if cur.Key() <= prev {
+						errs <- fmt.Errorf("key %v not greater than previous key %v", cur.Key(), prev)
+						return
+					}
+					prev = cur.Key()
+					count++
+				}
+				if err := cur.Err(); err != nil {
+					errs <- err
+					return
+				}
+				if count%BatchSize != 0 {
+					errs <- fmt.Errorf("observed a partial batch: %d records", count)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if count := verifyOrder(t, c, nil); count != NumBatches*BatchSize {
+		t.Errorf("expected %d records, got %d", NumBatches*BatchSize, count)
+	}
+}
+
+func TestUpdateContextCanceled(t *testing.T) {
+	c, err := NewCollection("/tmp/test_updatecontextcanceled.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	wb.Set("key1", "1")
+	version, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	wb = NewWriteBatch()
+	wb.Set("key2", "2")
+	_, err = c.UpdateContext(ctx, wb)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if !c.OK() {
+		t.Error("expected OK() to return true")
+	}
+	if c.Version() != version {
+		t.Errorf("expected version %d, got %d", version, c.Version())
+	}
+	if count := verifyOrder(t, c, nil); count != 1 {
+		t.Errorf("expected 1 record, got %d", count)
+	}
+
+	_, err = c.UpdateContext(context.Background(), wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := verifyOrder(t, c, nil); count != 2 {
+		t.Errorf("expected 2 records, got %d", count)
+	}
+}
+
+func TestExportImportJSONL(t *testing.T) {
+	c, err := NewCollection("/tmp/test_exportjsonl.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 2500; i++ {
+		wb.Set(fmt.Sprintf("key%05d", i), fmt.Sprintf("value \"%d\"\n", i))
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Delete("key00001")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = c.ExportJSONL(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(buf.Bytes(), []byte("\n")); lines != 2499 {
+		t.Fatalf("expected 2499 lines, got %d", lines)
+	}
+
+	c2, err := ImportJSONL("/tmp/test_importjsonl.lm2", 100, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Destroy()
+
+	kvs1, err := c.Range("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvs2, err := c2.Range("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs1) != len(kvs2) {
+		t.Fatalf("expected %d records, got %d", len(kvs1), len(kvs2))
+	}
+	for i := range kvs1 {
+		if kvs1[i] != kvs2[i] {
+			t.Errorf("expected %v, got %v", kvs1[i], kvs2[i])
+		}
+	}
+}
+
+func TestBulkLoadSorted(t *testing.T) {
+	const N = 50000
+	i := 0
+	c, err := BulkLoadSorted("/tmp/test_bulkloadsorted.lm2", 100, func() (string, string, bool) {
+		if i == N {
+			return "", "", false
+		}
+		i++
+		return fmt.Sprintf("key%06d", i), fmt.Sprint(i), true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	if count := verifyOrder(t, c, nil); count != N {
+		t.Errorf("expected %d records, got %d", N, count)
+	}
+
+	cur, err := c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := cur.Get("key025000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "25000" {
+		t.Errorf("expected %s, got %s", "25000", val)
+	}
+
+	// The loaded collection must accept regular updates.
+	wb := NewWriteBatch()
+	wb.Set("key025000", "updated")
+	wb.Set("key000000", "first")
+	wb.Delete("key000002")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	c, err = OpenCollection("/tmp/test_bulkloadsorted.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := verifyOrder(t, c, nil); count != N {
+		t.Errorf("expected %d records, got %d", N, count)
+	}
+	cur, err = c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err = cur.Get("key025000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "updated" {
+		t.Errorf("expected %s, got %s", "updated", val)
+	}
+}
+
+func TestBulkLoadUnsorted(t *testing.T) {
+	keys := []string{"a", "c", "b"}
+	_, err := BulkLoadSorted("/tmp/test_bulkloadunsorted.lm2", 100, func() (string, string, bool) {
+		if len(keys) == 0 {
+			return "", "", false
+		}
+		key := keys[0]
+		keys = keys[1:]
+		return key, key, true
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err = OpenCollection("/tmp/test_bulkloadunsorted.lm2", 100); err != ErrDoesNotExist {
+		t.Errorf("expected ErrDoesNotExist, got %v", err)
+	}
+}
+
+func BenchmarkBulkLoadSorted(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		i := 0
+		c, err := BulkLoadSorted("/tmp/bench_bulkloadsorted.lm2", 100, func() (string, string, bool) {
+			if i == 10000 {
+				return "", "", false
+			}
+			i++
+			return fmt.Sprintf("key%06d", i), fmt.Sprint(i), true
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		c.Destroy()
+	}
+}
+
+func BenchmarkLoadWithUpdates(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		c, err := NewCollection("/tmp/bench_loadwithupdates.lm2", 100)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for i := 0; i < 10000; i += 100 {
+			wb := NewWriteBatch()
+			for j := i; j < i+100; j++ {
+				wb.Set(fmt.Sprintf("key%06d", j), fmt.Sprint(j))
+			}
+			if _, err = c.Update(wb); err != nil {
+				b.Fatal(err)
+			}
+		}
+		c.Destroy()
+	}
+}
+
+func TestHas(t *testing.T) {
+	c, err := NewCollection("/tmp/test_has.lm2", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 200; i++ {
+		wb.Set(fmt.Sprintf("key%03d", i*2), fmt.Sprint(i))
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wb = NewWriteBatch()
+	wb.Delete("key010")
+	wb.Set("key020", "overwritten")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// Reopen to start with a cold cache.
+	c, err = OpenCollection("/tmp/test_has.lm2", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 400; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		expected := i%2 == 0 && key != "key010"
+		has, err := c.Has(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if has != expected {
+			t.Errorf("expected Has(%s) to be %v", key, expected)
+		}
+	}
+	has, err := c.Has("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has {
+		t.Error("expected Has(\"\") to be false")
+	}
+}
+
+func TestStatsSizes(t *testing.T) {
+	c, err := NewCollection("/tmp/test_statssizes.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	wb.Set("key1", "1234")
+	wb.Set("key2", "1234")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := c.Stats()
+	if stats.DeadBytes != 0 {
+		t.Errorf("expected no dead bytes, got %d", stats.DeadBytes)
+	}
+	if stats.DataFileSize != c.Version() {
+		t.Errorf("expected data file size %d, got %d", c.Version(), stats.DataFileSize)
+	}
+	if stats.WALSize == 0 {
+		t.Error("expected a non-empty WAL")
+	}
+
+	wb = NewWriteBatch()
+	wb.Set("key1", "5")
+	wb.Delete("key2")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting a deleted key doesn't add dead bytes.
+	wb = NewWriteBatch()
+	wb.Delete("key2")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats = c.Stats()
+	if expected := uint64(2 * (recordHeaderSize + 4 + 4)); stats.DeadBytes != expected {
+		t.Errorf("expected %d dead bytes, got %d", expected, stats.DeadBytes)
+	}
+}
+
+func TestSnapshotDeleteDeletedKey(t *testing.T) {
+	c, err := NewCollection("/tmp/test_snapshotdeletedeletedkey.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	wb.Set("key1", "1")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Delete("key1")
+	v2, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Delete("key1")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := c.SnapshotAt(v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = snap.Get("key1"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	c, err := NewCollection("/tmp/test_compareandswap.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	swapped, _, err := c.CompareAndSwap("counter", "", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !swapped {
+		t.Fatal("expected a missing key to match an empty old value")
+	}
+
+	swapped, version, err := c.CompareAndSwap("counter", "1", "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if swapped {
+		t.Error("expected the swap to fail")
+	}
+	if version != c.Version() {
+		t.Errorf("expected version %d, got %d", c.Version(), version)
+	}
+
+	const NumGoroutines = 8
+	const N = 20
+	wg := sync.WaitGroup{}
+	errs := make(chan error, NumGoroutines)
+	for i := 0; i < NumGoroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < N; {
+				cur, err := c.NewCursor()
+				if err != nil {
+					errs <- err
+					return
+				}
+				val, err := cur.Get("counter")
+				if err != nil {
+					errs <- err
+					return
+				}
+				n := 0
+				fmt.Sscan(val, &n)
+				swapped, _, err := c.CompareAndSwap("counter", val, fmt.Sprint(n+1))
+				if err != nil {
+					errs <- err
+					return
+				}
+				if swapped {
+					j++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	cur, err := c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := cur.Get("counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != fmt.Sprint(NumGoroutines*N) {
+		t.Errorf("expected counter to be %d, got %s", NumGoroutines*N, val)
+	}
+}
+
+func TestWriteBatchMerge(t *testing.T) {
+	c, err := NewCollection("/tmp/test_writebatchmerge.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	appendFn := func(suffix string) func(string, bool) string {
+		return func(existing string, existed bool) string {
+			if !existed {
+				return suffix
+			}
+			return existing + suffix
+		}
+	}
+
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wb = NewWriteBatch()
+	wb.Merge("a", appendFn("2"))
+	wb.Merge("a", appendFn("3"))
+	wb.Merge("b", appendFn("x"))
+	wb.Set("c", "set")
+	wb.Merge("c", appendFn("+merged"))
+	wb.Merge("d", appendFn("merged"))
+	wb.Set("d", "replaced")
+	wb.Merge("e", appendFn("deleted"))
+	wb.Delete("e")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kvs, err := c.Range("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []KV{
+		{"a", "123"},
+		{"b", "x"},
+		{"c", "set+merged"},
+		{"d", "replaced"},
+	}
+	if len(kvs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, kvs)
+	}
+	for i := range expected {
+		if kvs[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], kvs[i])
+		}
+	}
+}
+
+func TestSetWithTTL(t *testing.T) {
+	c, err := NewCollection("/tmp/test_setwithttl.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	wb.SetWithTTL("b", "2", -time.Second)
+	wb.SetWithTTL("c", "3", time.Hour)
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(c *Collection) {
+		kvs, err := c.Range("", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []KV{{"a", "1"}, {"c", "3"}}
+		if len(kvs) != len(expected) {
+			t.Fatalf("expected %v, got %v", expected, kvs)
+		}
+		for i := range expected {
+			if kvs[i] != expected[i] {
+				t.Errorf("expected %v, got %v", expected[i], kvs[i])
+			}
+		}
+		if has, err := c.Has("b"); err != nil || has {
+			t.Errorf("expected b to be missing, got %v, %v", has, err)
+		}
+	}
+	check(c)
+
+	// Expired keys don't count as existing.
+	wb = NewWriteBatch()
+	wb.AllowOverwrite(false)
+	wb.Set("b", "new")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Delete("b")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(c)
+
+	c.Close()
+	c, err = OpenCollection("/tmp/test_setwithttl.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(c)
+
+	err = c.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = OpenCollection("/tmp/test_setwithttl.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(c)
+
+	cur, err := c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cur.Next() && cur.Key() != "c" {
+	}
+	if cur.Key() != "c" {
+		t.Fatal("expected to find c")
+	}
+	if cur.current.ExpiresAt == 0 {
+		t.Error("expected c to keep its expiration time after compaction")
+	}
+}
+
+func TestExpirer(t *testing.T) {
+	c, err := NewCollection("/tmp/test_expirer.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	wb.SetWithTTL("b", "2", 10*time.Millisecond)
+	wb.SetWithTTL("c", "3", 10*time.Millisecond)
+	wb.SetWithTTL("d", "4", time.Hour)
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel := c.StartExpirer(5 * time.Millisecond)
+	defer cancel()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Stats().ExpiredRecords < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 expired records, got %d", c.Stats().ExpiredRecords)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+
+	if expired := c.Stats().ExpiredRecords; expired != 2 {
+		t.Errorf("expected 2 expired records, got %d", expired)
+	}
+	kvs, err := c.Range("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 2 || kvs[0].Key != "a" || kvs[1].Key != "d" {
+		t.Errorf("expected a and d, got %v", kvs)
+	}
+
+	// Sweeping doesn't fill the cache.
+	c.cache.reset()
+	err = c.expire(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(c.cache.cache); n != 0 || c.cache.maxKeyOffset() != 0 {
+		t.Errorf("expected the sweep not to cache records, got %d", n)
+	}
+}
+
+func TestFileModeOption(t *testing.T) {
+	const file = "/tmp/test_filemodeoption.lm2"
+	// 0666 checks that the umask doesn't apply.
+	for _, mode := range []os.FileMode{0600, 0666} {
+		c, err := NewCollectionWithOptions(file, Options{
+			CacheSize: 100,
+			FileMode:  mode,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{file, file + ".wal"} {
+			fi, err := os.Stat(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perm := fi.Mode().Perm(); perm != mode {
+				t.Errorf("expected %s to have mode %v, got %v", name, mode, perm)
+			}
+		}
+		c.Destroy()
+		os.Remove(file + ".wal")
+	}
+}
+
+func TestWALFileOption(t *testing.T) {
+	const walDir = "/tmp/test_walfileoption"
+	err := os.MkdirAll(walDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(walDir)
+
+	opts := Options{
+		CacheSize: 100,
+		WALFile:   walDir + "/data.wal",
+	}
+	c, err := NewCollectionWithOptions("/tmp/test_walfileoption.lm2", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	if _, err = os.Stat(opts.WALFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat("/tmp/test_walfileoption.lm2.wal"); !os.IsNotExist(err) {
+		t.Errorf("expected no WAL next to the data file, got %v", err)
+	}
+
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash that loses the header write. Recovery has to
+	// replay the WAL from its own directory.
+	c.f.Close()
+	c.wal.f.Close()
+	c.lock.release()
+	c.lock = nil
+	f, err := os.OpenFile("/tmp/test_walfileoption.lm2", os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt(fileHeader{Version: fileVersion, LastCommit: 512}.bytes(), 0)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = OpenCollectionWithOptions("/tmp/test_walfileoption.lm2", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur, err := c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := cur.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "1" {
+		t.Errorf("expected a to be 1, got %s", val)
+	}
+
+	c.Close()
+	if _, err = os.Stat(opts.WALFile); !os.IsNotExist(err) {
+		t.Errorf("expected WAL to be removed on close, got %v", err)
+	}
+	c, err = OpenCollectionWithOptions("/tmp/test_walfileoption.lm2", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenCollectionReadOnly(t *testing.T) {
+	c, err := NewCollection("/tmp/test_openreadonly.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	wb.Set("b", "2")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readers := []*Collection{}
+	for i := 0; i < 2; i++ {
+		r, err := OpenCollectionReadOnly("/tmp/test_openreadonly.lm2", 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		readers = append(readers, r)
+	}
+
+	for _, r := range readers {
+		kvs, err := r.Range("", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(kvs) != 2 || kvs[0] != (KV{"a", "1"}) || kvs[1] != (KV{"b", "2"}) {
+			t.Errorf("unexpected contents %v", kvs)
+		}
+
+		wb = NewWriteBatch()
+		wb.Set("c", "3")
+		if _, err = r.Update(wb); err != ErrReadOnly {
+			t.Errorf("expected ErrReadOnly from Update, got %v", err)
+		}
+		if _, _, err = r.CompareAndSwap("a", "1", "2"); err != ErrReadOnly {
+			t.Errorf("expected ErrReadOnly from CompareAndSwap, got %v", err)
+		}
+	}
+
+	// The writer is unaffected.
+	wb = NewWriteBatch()
+	wb.Set("c", "3")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFirstKeyLastKey(t *testing.T) {
+	c, err := NewCollection("/tmp/test_firstkeylastkey.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	check := func(first, last string, ok bool) {
+		key, found, err := c.FirstKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != ok || key != first {
+			t.Errorf("expected first key %q (%v), got %q (%v)", first, ok, key, found)
+		}
+		key, found, err = c.LastKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != ok || key != last {
+			t.Errorf("expected last key %q (%v), got %q (%v)", last, ok, key, found)
+		}
+	}
+	check("", "", false)
+
+	wb := NewWriteBatch()
+	for i := 0; i < 100; i++ {
+		wb.Set(fmt.Sprintf("key%03d", i), "1")
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("key000", "key099", true)
+
+	wb = NewWriteBatch()
+	wb.Delete("key000")
+	wb.Delete("key099")
+	wb.Delete("key098")
+	wb.Set("key097", "2")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("key001", "key097", true)
+
+	c.Close()
+	c, err = OpenCollection("/tmp/test_firstkeylastkey.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("key001", "key097", true)
+
+	wb = NewWriteBatch()
+	for i := 0; i < 100; i++ {
+		wb.Delete(fmt.Sprintf("key%03d", i))
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("", "", false)
+}
+
+func TestSeekAfter(t *testing.T) {
+	c, err := NewCollection("/tmp/test_seekafter.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		wb.Set(key, key)
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Set("b", "b2")
+	wb.Delete("d")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		key      string
+		expected string
+	}{
+		{"", "abce"},
+		{"a", "bce"},
+		{"aa", "bce"},
+		{"b", "ce"},
+		{"c", "e"},
+		{"d", "e"},
+		{"e", ""},
+		{"z", ""},
+	}
+	for _, tc := range cases {
+		cur, err := c.NewCursor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cur.SeekAfter(tc.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := ""
+		for cur.Next() {
+			keys += cur.Key()
+		}
+		if err = cur.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if keys != tc.expected {
+			t.Errorf("SeekAfter(%q): expected %q, got %q", tc.key, tc.expected, keys)
+		}
+	}
+}
+
+func TestWALStream(t *testing.T) {
+	primary, err := NewCollection("/tmp/test_walstream.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 50; i++ {
+		wb.Set(fmt.Sprintf("key%02d", i), "1")
+	}
+	_, err = primary.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Seed the follower with a copy of the data file.
+	from := primary.Version()
+	data, err := os.ReadFile("/tmp/test_walstream.lm2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile("/tmp/test_walstream_follower.lm2", data[:from], 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower, err := OpenCollection("/tmp/test_walstream_follower.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Destroy()
+
+	r, w := io.Pipe()
+	streamErr := make(chan error, 1)
+	go func() {
+		err := primary.StreamWAL(from, w)
+		w.Close()
+		streamErr <- err
+	}()
+	applyErr := make(chan error, 1)
+	go func() {
+		applyErr <- follower.ApplyWALStream(r)
+	}()
+	for !primary.shipper.active() {
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 20; i++ {
+		wb = NewWriteBatch()
+		wb.Set(fmt.Sprintf("key%02d", i*3), fmt.Sprint(i))
+		wb.Delete(fmt.Sprintf("key%02d", i*2+1))
+		wb.Set(fmt.Sprintf("new%02d", i), "new")
+		wb.SetTag([]byte(fmt.Sprint("primary/", i)))
+		_, err = primary.Update(wb)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := primary.Range("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := primary.Version()
+
+	primary.Close()
+	if err = <-streamErr; err != nil {
+		t.Fatal(err)
+	}
+	if err = <-applyErr; err != nil {
+		t.Fatal(err)
+	}
+
+	if follower.Version() != version {
+		t.Errorf("expected follower at version %d, got %d", version, follower.Version())
+	}
+	if info, ok := follower.LastCommitInfo(); !ok || info.Version != version || string(info.Tag) != "primary/19" {
+		t.Errorf("expected the last commit's tag to be shipped, got %+v, %v", info, ok)
+	}
+	kvs, err := follower.Range("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != len(expected) {
+		t.Fatalf("expected %d pairs, got %d", len(expected), len(kvs))
+	}
+	for i := range expected {
+		if kvs[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], kvs[i])
+		}
+	}
+	verifyOrder(t, follower, &sync.Mutex{})
+
+	// The follower survives a reopen.
+	follower.Close()
+	follower, err = OpenCollection("/tmp/test_walstream_follower.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if follower.Version() != version {
+		t.Errorf("expected follower at version %d after reopen, got %d", version, follower.Version())
+	}
+}
+
+func TestWALStreamGap(t *testing.T) {
+	c, err := NewCollection("/tmp/test_walstreamgap.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	from := c.Version()
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The commit after from happened before the stream started.
+	err = c.StreamWAL(from, io.Discard)
+	if err != ErrWALGap {
+		t.Errorf("expected ErrWALGap, got %v", err)
+	}
+}
+
+type slowWriter struct {
+	w io.Writer
+}
+
+func (w slowWriter) Write(b []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return w.w.Write(b)
+}
+
+func TestBackupRestore(t *testing.T) {
+	c, err := NewCollection("/tmp/test_backup.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 5000; i++ {
+		wb.Set(fmt.Sprintf("key%04d", i), fmt.Sprint(i))
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep updating existing records while the backup runs.
+	stop := make(chan struct{})
+	writerErr := make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				writerErr <- nil
+				return
+			default:
+			}
+			wb := NewWriteBatch()
+			wb.Set(fmt.Sprintf("key%04d", rand.Intn(5000)), "updated")
+			wb.Delete(fmt.Sprintf("key%04d", rand.Intn(5000)))
+			if _, err := c.Update(wb); err != nil {
+				writerErr <- err
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	buf := bytes.NewBuffer(nil)
+	err = c.Backup(slowWriter{buf})
+	close(stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-writerErr; err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := RestoreBackup("/tmp/test_backup_restored.lm2", 100, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Destroy()
+
+	snap, err := c.SnapshotAt(restored.Version())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := snap.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur, err := restored.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for expected.Next() {
+		if !cur.Next() {
+			t.Fatalf("restored collection ended after %d keys", count)
+		}
+		if cur.Key() != expected.Key() || cur.Value() != expected.Value() {
+			t.Fatalf("expected %s => %s, got %s => %s",
+				expected.Key(), expected.Value(), cur.Key(), cur.Value())
+		}
+		count++
+	}
+	if cur.Next() {
+		t.Errorf("restored collection has extra key %s", cur.Key())
+	}
+	if err = cur.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err = expected.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordSizeLimits(t *testing.T) {
+	c, err := NewCollection("/tmp/test_recordsizelimits.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	longest := strings.Repeat("k", MaxKeyLen)
+	wb := NewWriteBatch()
+	wb.Set(longest, "1")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version := c.Version()
+	wb = NewWriteBatch()
+	wb.Set("a", "1")
+	wb.Set(longest+"k", "1")
+	_, err = c.Update(wb)
+	if err != ErrKeyTooLong {
+		t.Fatalf("expected ErrKeyTooLong, got %v", err)
+	}
+	if c.Version() != version {
+		t.Error("expected the collection to be unchanged")
+	}
+
+	wb = NewWriteBatch()
+	wb.Merge("b", func(string, bool) string {
+		return strings.Repeat("v", MaxKeyLen+1)
+	})
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kvs, err := c.Range("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 2 || kvs[0].Key != "b" || len(kvs[0].Value) != MaxKeyLen+1 || kvs[1].Key != longest {
+		t.Errorf("unexpected contents after size limit checks")
+	}
+
+	_, err = BulkLoadSorted("/tmp/test_recordsizelimits_bulk.lm2", 100, func() (string, string, bool) {
+		return longest + "k", "", true
+	})
+	if err != ErrKeyTooLong {
+		t.Errorf("expected ErrKeyTooLong from BulkLoadSorted, got %v", err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	c, err := NewCollection("/tmp/test_scan.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 10; i++ {
+		wb.Set(fmt.Sprint(i), fmt.Sprint(i*i))
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Delete("4")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := ""
+	err = c.Scan("3", func(key, value string) bool {
+		if key == "3" && value != "9" {
+			t.Errorf("expected 3 => 9, got %s", value)
+		}
+		keys += key
+		return key < "6"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys != "356" {
+		t.Errorf("expected to scan 356, got %s", keys)
+	}
+
+	// Read errors are returned.
+	c.readAt = func(b []byte, off int64) (int, error) {
+		return 0, errors.New("read failed")
+	}
+	c.cache.reset()
+	err = c.Scan("", func(key, value string) bool {
+		return true
+	})
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestWriteBatchLen(t *testing.T) {
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	wb.Set("b", "22")
+	wb.Merge("b", func(string, bool) string { return "" })
+	wb.Merge("c", func(string, bool) string { return "" })
+	wb.Set("d", "4")
+	wb.Delete("d")
+	wb.Delete("e")
+
+	for i := 0; i < 2; i++ {
+		if n := wb.Len(); n != 5 {
+			t.Errorf("expected length 5, got %d", n)
+		}
+		expected := 3*recordHeaderSize + len("a1") + len("b22") + len("c")
+		if n := wb.EstimatedBytes(); n != expected {
+			t.Errorf("expected %d bytes, got %d", expected, n)
+		}
+	}
+}
+
+func TestClear(t *testing.T) {
+	c, err := NewCollection("/tmp/test_clear.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 100; i++ {
+		wb.Set(fmt.Sprint(i), fmt.Sprint(i))
+	}
+	before, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fill the cache.
+	if _, err = c.Range("", "", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := c.Clear()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != c.Version() {
+		t.Errorf("expected version %d, got %d", c.Version(), version)
+	}
+	if version <= before {
+		t.Errorf("expected a version after %d, got %d", before, version)
+	}
+	if size := c.Stats().DataFileSize; size != version {
+		t.Errorf("expected the data file to be truncated to %d bytes, got %d", version, size)
+	}
+	kvs, err := c.Range("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 0 {
+		t.Errorf("expected no keys, got %v", kvs)
+	}
+	if _, found, err := c.LastKey(); err != nil || found {
+		t.Errorf("expected no last key, got %v, %v", found, err)
+	}
+
+	wb = NewWriteBatch()
+	wb.Set("a", "1")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Close()
+	c, err = OpenCollection("/tmp/test_clear.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvs, err = c.Range("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 1 || kvs[0] != (KV{"a", "1"}) {
+		t.Errorf("expected only a => 1, got %v", kvs)
+	}
+	if err = c.Verify(); err != nil {
+		t.Error(err)
+	}
+	changes := []Change{}
+	err = c.ChangesSince(before, func(change Change) bool {
+		changes = append(changes, change)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Key != "a" || changes[0].Version <= version {
+		t.Errorf("expected a change to a after %d, got %v", version, changes)
+	}
+
+	// Versions keep increasing through another Clear.
+	before = c.Version()
+	cleared, err := c.Clear()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cleared <= before {
+		t.Errorf("expected a version after %d, got %d", before, cleared)
+	}
+}
+
+func TestClearCrash(t *testing.T) {
+	const file = "/tmp/test_clearcrash.lm2"
+	c, err := NewCollection(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		c.Destroy()
+	}()
+
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	before, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash after Clear's WAL append and before its header is
+	// written leaves the WAL to replay.
+	c.writeAt = func(b []byte, off int64) (int, error) {
+		return 0, errors.New("simulated write failure")
+	}
+	if _, err = c.Clear(); err == nil {
+		t.Fatal("expected Clear to fail")
+	}
+	c.Close()
+
+	c, err = OpenCollection(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := c.Version(); version <= before {
+		t.Errorf("expected a version after %d, got %d", before, version)
+	}
+	if size := c.Stats().DataFileSize; size != c.Version() {
+		t.Errorf("expected the data file to be truncated to %d bytes, got %d", c.Version(), size)
+	}
+	if kvs, err := c.Range("", "", 0); err != nil || len(kvs) != 0 {
+		t.Errorf("expected no keys, got %v (%v)", kvs, err)
+	}
+	wb = NewWriteBatch()
+	wb.Set("b", "2")
+	if _, err = c.Update(wb); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeadBytesPersisted(t *testing.T) {
+	c, err := NewCollection("/tmp/test_deadbytespersisted.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	wb.Set("key1", "1234")
+	wb.Set("key2", "1234")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Delete("key1")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := uint64(recordHeaderSize + 4 + 4)
+	if dead := c.Stats().DeadBytes; dead != expected {
+		t.Errorf("expected %d dead bytes, got %d", expected, dead)
+	}
+
+	c.Close()
+	c, err = OpenCollection("/tmp/test_deadbytespersisted.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dead := c.Stats().DeadBytes; dead != expected {
+		t.Errorf("expected %d dead bytes after reopening, got %d", expected, dead)
+	}
+
+	err = c.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = OpenCollection("/tmp/test_deadbytespersisted.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dead := c.Stats().DeadBytes; dead != 0 {
+		t.Errorf("expected no dead bytes after compaction, got %d", dead)
+	}
+}
+
+func TestOpenFileVersion1(t *testing.T) {
+	c, err := NewCollection("/tmp/test_openfileversion1.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	wb.Set("key1", "1")
+	wb.Set("key2", "2")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Delete("key1")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// Older data files have a shorter header, so whatever follows it
+	// must not be read as DeadBytes.
+	f, err := os.OpenFile("/tmp/test_openfileversion1.lm2", os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt(fileVersion1[:], 0)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = OpenCollection("/tmp/test_openfileversion1.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dead := c.Stats().DeadBytes; dead != 0 {
+		t.Errorf("expected no dead bytes, got %d", dead)
+	}
+	wb = NewWriteBatch()
+	wb.Delete("key2")
+	wb.Set("key3", "3")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dead := c.Stats().DeadBytes; dead != uint64(recordHeaderSize+4+1) {
+		t.Errorf("expected %d dead bytes, got %d", recordHeaderSize+4+1, dead)
+	}
+
+	c.Close()
+	c, err = OpenCollection("/tmp/test_openfileversion1.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.fileHeader.Version != fileVersion1 {
+		t.Errorf("expected the file version to be unchanged")
+	}
+	kvs, err := c.Range("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 1 || kvs[0] != (KV{"key3", "3"}) {
+		t.Errorf("expected only key3 => 3, got %v", kvs)
+	}
+}
+
+func TestAutoCompact(t *testing.T) {
+	c, err := NewCollectionWithOptions("/tmp/test_autocompact.lm2", Options{
+		CacheSize:        100,
+		AutoCompact:      true,
+		AutoCompactRatio: 0.3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 100; i++ {
+		wb.Set(fmt.Sprintf("key%03d", i), fmt.Sprint(i))
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := c.SnapshotAt(c.Version())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizeBefore := c.Stats().DataFileSize
+
+	wb = NewWriteBatch()
+	for i := 10; i < 100; i++ {
+		wb.Delete(fmt.Sprintf("key%03d", i))
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Stats().LastAutoCompaction.IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("automatic compaction didn't run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := c.Stats()
+	if stats.AutoCompactReclaimed <= 0 {
+		t.Errorf("expected reclaimed bytes, got %d", stats.AutoCompactReclaimed)
+	}
+	if stats.DataFileSize >= sizeBefore {
+		t.Errorf("expected file size below %d, got %d", sizeBefore, stats.DataFileSize)
+	}
+	if stats.DeadBytes != 0 {
+		t.Errorf("expected no dead bytes, got %d", stats.DeadBytes)
+	}
+	if _, err = snap.NewCursor(); err != ErrStale {
+		t.Errorf("expected ErrStale, got %v", err)
+	}
+
+	cur, err := c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for cur.Next() {
+		if expected := fmt.Sprintf("key%03d", count); cur.Key() != expected {
+			t.Errorf("expected key %s, got %s", expected, cur.Key())
+		}
+		count++
+	}
+	if count != 10 {
+		t.Errorf("expected 10 keys, got %d", count)
+	}
+
+	wb = NewWriteBatch()
+	wb.Set("key100", "100")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	c, err = OpenCollection("/tmp/test_autocompact.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err = c.SnapshotAt(c.Version())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := snap.Get("key100"); err != nil || v != "100" {
+		t.Errorf("expected 100, got %q (%v)", v, err)
+	}
+	if v, err := snap.Get("key005"); err != nil || v != "5" {
+		t.Errorf("expected 5, got %q (%v)", v, err)
+	}
+}
+
+func TestScanKeys(t *testing.T) {
+	c, err := NewCollection("/tmp/test_scankeys.lm2", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 20; i++ {
+		wb.Set(fmt.Sprintf("key%02d", i), strings.Repeat("v", 1000))
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Delete("key05")
+	wb.Delete("key06")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{}
+	err = c.ScanKeys("key03", func(key string) bool {
+		keys = append(keys, key)
+		return len(keys) < 5
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"key03", "key04", "key07", "key08", "key09"}
+	if fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, keys)
+	}
+
+	count := 0
+	err = c.ScanKeys("", func(key string) bool {
+		count++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 18 {
+		t.Errorf("expected 18 keys, got %d", count)
+	}
+}
+
+func TestWriteBatchForEach(t *testing.T) {
+	wb := NewWriteBatch()
+	wb.Set("b", "2")
+	wb.Set("a", "1")
+	wb.Set("c", "3")
+	wb.Delete("c")
+	wb.Delete("d")
+	wb.Merge("e", func(string, bool) string { return "" })
+
+	ops := []string{}
+	wb.ForEach(func(key, value string) {
+		ops = append(ops, "set "+key+"="+value)
+	}, func(key string) {
+		ops = append(ops, "delete "+key)
+	})
+	expected := []string{"set a=1", "set b=2", "delete c", "delete d"}
+	if fmt.Sprint(ops) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, ops)
+	}
+
+	wb.ForEach(nil, nil)
+}
+
+func TestReadRecordBogusOffset(t *testing.T) {
+	c, err := NewCollection("/tmp/test_readrecordbogusoffset.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	wb.Set("key", strings.Repeat("\xff", 100))
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.cache.reset()
+
+	// The value is all 0xff bytes, so a header read from inside it
+	// has huge key and value lengths.
+	c.metaLock.RLock()
+	_, err = c.readRecord(c.Next[0]+recordHeaderSize+10, false)
+	c.metaLock.RUnlock()
+	if !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("expected ErrCorruptRecord, got %v", err)
+	}
+	lm2Err := Error{}
+	if !errors.As(err, &lm2Err) || lm2Err.Offset != c.Next[0]+recordHeaderSize+10 {
+		t.Errorf("expected an Error with the bad offset, got %v", err)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	c, err := NewCollectionWithOptions("/tmp/test_flush.lm2", Options{
+		CacheSize: 100,
+		Sync:      SyncNever,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	wb.Set("key", "value")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Close()
+	if err = c.Flush(); err == nil {
+		t.Error("expected an error flushing a closed collection")
+	}
+}
+
+func TestRepairCollection(t *testing.T) {
+	c, err := NewCollection("/tmp/test_repaircollection.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	for i := 0; i < 3; i++ {
+		wb := NewWriteBatch()
+		for j := 0; j < 10; j++ {
+			wb.Set(fmt.Sprintf("key%02d", i*10+j), fmt.Sprint(i))
+		}
+		wb.Delete("key05")
+		_, err = c.Update(wb)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wb := NewWriteBatch()
+	wb.Set("key01", "updated")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := c.Next[0]
+	c.Close()
+
+	c, report, err := RepairCollection("/tmp/test_repaircollection.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rebuilt || report.BadLinks != 0 || report.UnlinkedRecords != 0 {
+		t.Errorf("expected a consistent collection, got %+v", report)
+	}
+	if report.Records != 30 {
+		t.Errorf("expected 30 records, got %d", report.Records)
+	}
+	c.Close()
+
+	// Point the head's level 0 link into the middle of a record.
+	f, err := os.OpenFile("/tmp/test_repaircollection.lm2", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bogus := [8]byte{}
+	binary.LittleEndian.PutUint64(bogus[:], uint64(head+5))
+	_, err = f.WriteAt(bogus[:], head+2)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, report, err = RepairCollection("/tmp/test_repaircollection.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Rebuilt || report.BadLinks == 0 || report.UnlinkedRecords != 29 {
+		t.Errorf("expected a rebuild of a broken link, got %+v", report)
+	}
+	if report.LiveRecords != 29 {
+		t.Errorf("expected 29 live records, got %d", report.LiveRecords)
+	}
+
+	cur, err := c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for cur.Next() {
+		count++
+		if cur.Key() == "key05" {
+			t.Error("found deleted key key05")
+		}
+		if cur.Key() == "key01" && cur.Value() != "updated" {
+			t.Errorf("expected updated value of key01, got %q", cur.Value())
+		}
+	}
+	if err = cur.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != 29 {
+		t.Errorf("expected 29 keys, got %d", count)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	c, err := NewCollection("/tmp/test_verify.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	if err = c.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		wb := NewWriteBatch()
+		for j := 0; j < 100; j++ {
+			wb.Set(fmt.Sprint(j*7%100), fmt.Sprint(i))
+		}
+		wb.Delete(fmt.Sprint(i))
+		_, err = c.Update(wb)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = c.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Point the head's level 0 link past the last commit.
+	head := c.Next[0]
+	c.Close()
+	f, err := os.OpenFile("/tmp/test_verify.lm2", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bogus := [8]byte{}
+	binary.LittleEndian.PutUint64(bogus[:], 1<<40)
+	_, err = f.WriteAt(bogus[:], head+2)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenCollectionWithOptions("/tmp/test_verify.lm2", Options{CacheSize: 100, VerifyOnOpen: true})
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprint(1<<40)) {
+		t.Errorf("expected opening with VerifyOnOpen to fail, got %v", err)
+	}
+	c, err = OpenCollection("/tmp/test_verify.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Verify()
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprint(1<<40)) {
+		t.Errorf("expected an error naming the bad offset, got %v", err)
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	c, err := NewCollection("/tmp/test_deleterange.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 20; i++ {
+		wb.Set(fmt.Sprintf("key%02d", i), fmt.Sprint(i))
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := c.DeleteRange("key05", "key10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 5 {
+		t.Errorf("expected 5 deleted keys, got %d", deleted)
+	}
+	deleted, err = c.DeleteRange("key05", "key10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 0 {
+		t.Errorf("expected no deleted keys, got %d", deleted)
+	}
+
+	// Include the head.
+	deleted, err = c.DeleteRange("", "key02")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Errorf("expected 2 deleted keys, got %d", deleted)
+	}
+	deleted, err = c.DeleteRange("key15", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 5 {
+		t.Errorf("expected 5 deleted keys, got %d", deleted)
+	}
+
+	keys := []string{}
+	err = c.ScanKeys("", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"key02", "key03", "key04", "key10", "key11", "key12", "key13", "key14"}
+	if fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, keys)
+	}
+	if err = c.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestComparator(t *testing.T) {
+	reverse := func(a, b string) int {
+		return strings.Compare(b, a)
+	}
+	opts := Options{
+		CacheSize:      100,
+		Comparator:     reverse,
+		ComparatorName: "reverse",
+	}
+	c, err := NewCollectionWithOptions("/tmp/test_comparator.lm2", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	for i := 0; i < 3; i++ {
+		wb := NewWriteBatch()
+		for j := i; j < 20; j += 3 {
+			wb.Set(fmt.Sprintf("key%02d", j), fmt.Sprint(j))
+		}
+		_, err = c.Update(wb)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wb := NewWriteBatch()
+	wb.Set("key07", "updated")
+	wb.Delete("key03")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkOrder := func() {
+		kvs, err := c.Range("key10", "key04", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "[{key10 10} {key09 9} {key08 8} {key07 updated} {key06 6} {key05 5}]"
+		if fmt.Sprint(kvs) != expected {
+			t.Errorf("expected %s, got %v", expected, kvs)
+		}
+		first, _, err := c.FirstKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first != "key19" {
+			t.Errorf("expected first key key19, got %s", first)
+		}
+		if err = c.Verify(); err != nil {
+			t.Error(err)
+		}
+	}
+	checkOrder()
+
+	c.Close()
+	_, err = OpenCollection("/tmp/test_comparator.lm2", 100)
+	if err != ErrComparatorMismatch {
+		t.Errorf("expected ErrComparatorMismatch, got %v", err)
+	}
+	_, err = OpenCollectionWithOptions("/tmp/test_comparator.lm2", Options{
+		Comparator:     reverse,
+		ComparatorName: "other",
+	})
+	if err != ErrComparatorMismatch {
+		t.Errorf("expected ErrComparatorMismatch, got %v", err)
+	}
+	c, err = OpenCollectionWithOptions("/tmp/test_comparator.lm2", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkOrder()
+
+	err = c.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = OpenCollectionWithOptions("/tmp/test_comparator.lm2", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkOrder()
+
+	_, err = NewCollectionWithOptions("/tmp/test_comparator2.lm2", Options{Comparator: reverse})
+	if err == nil {
+		t.Error("expected an error for a comparator without a name")
+	}
+}
+
+func TestBinaryKeysAndValues(t *testing.T) {
+	c, err := NewCollection("/tmp/test_binarykeysandvalues.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	// In byte order.
+	keys := []string{"\x00", "\x00\x00", "\x00\xff", "a", "a\x00b", "\xfe\xff", "\xff"}
+	values := map[string]string{}
+	wb := NewWriteBatch()
+	for i, key := range keys {
+		values[key] = fmt.Sprintf("\x00%d\xff\x00", i)
+		wb.Set(key, values[key])
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(c *Collection) {
+		kvs, err := c.Range("", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(kvs) != len(keys) {
+			t.Fatalf("expected %d pairs, got %d", len(keys), len(kvs))
+		}
+		for i, kv := range kvs {
+			if kv.Key != keys[i] || kv.Value != values[keys[i]] {
+				t.Errorf("expected %q => %q, got %q => %q", keys[i], values[keys[i]], kv.Key, kv.Value)
+			}
+		}
+
+		snap, err := c.SnapshotAt(c.Version())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			v, err := snap.Get(key)
+			if err != nil || v != values[key] {
+				t.Errorf("expected %q for %q, got %q (%v)", values[key], key, v, err)
+			}
+		}
+		if _, err = snap.Get("\x00\x00\x00"); err != ErrKeyNotFound {
+			t.Errorf("expected ErrKeyNotFound, got %v", err)
+		}
+
+		cur, err := c.NewPrefixCursor("\x00")
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for cur.Next() {
+			count++
+		}
+		if count != 3 {
+			t.Errorf("expected 3 keys with a zero byte prefix, got %d", count)
+		}
+	}
+	check(c)
+
+	c.Close()
+	c, err = OpenCollection("/tmp/test_binarykeysandvalues.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(c)
+
+	buf := bytes.NewBuffer(nil)
+	if err = c.ExportJSONL(buf); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportJSONL("/tmp/test_binarykeysandvalues_import.lm2", 100, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer imported.Destroy()
+	check(imported)
+}
+
+func TestGetWithVersion(t *testing.T) {
+	c, err := NewCollection("/tmp/test_getwithversion.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 50; i++ {
+		wb.Set(fmt.Sprintf("key%02d", i), "1")
+	}
+	v1, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Set("key10", "2")
+	v2, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"key00", "key25", "key49"} {
+		_, version, found, err := c.GetWithVersion(key)
+		if err != nil || !found || version != v1 {
+			t.Errorf("expected %s at version %d, got %d (%v, %v)", key, v1, version, found, err)
+		}
+	}
+	value, version, found, err := c.GetWithVersion("key10")
+	if err != nil || !found || value != "2" || version != v2 {
+		t.Errorf("expected 2 at version %d, got %q at %d (%v, %v)", v2, value, version, found, err)
+	}
+	_, _, found, err = c.GetWithVersion("missing")
+	if err != nil || found {
+		t.Errorf("expected a missing key, got %v (%v)", found, err)
+	}
+}
+
+func TestScanPhysical(t *testing.T) {
+	c, err := NewCollection("/tmp/test_scanphysical.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 10; i++ {
+		wb.Set(fmt.Sprint(i), "value")
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Set("3", "updated")
+	wb.Delete("5")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := int64(0)
+	lastOffset := int64(0)
+	deleted := map[string]bool{}
+	keys := map[string]bool{}
+	err = c.ScanPhysical(func(offset int64, rec RecordInfo) bool {
+		if offset <= lastOffset {
+			t.Errorf("offset %d after %d", offset, lastOffset)
+		}
+		lastOffset = offset
+		size += rec.Size
+		keys[rec.Key] = true
+		if rec.Deleted != 0 {
+			deleted[rec.Key] = true
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 10 {
+		t.Errorf("expected 10 keys, got %d", len(keys))
+	}
+	if len(deleted) != 2 || !deleted["3"] || !deleted["5"] {
+		t.Errorf("expected 3 and 5 to be deleted, got %v", deleted)
+	}
+	// Two commits, each ending with a sentinel.
+	if expected := c.Version() - recordsStart - 2*12; size != expected {
+		t.Errorf("expected %d bytes of records, got %d", expected, size)
+	}
+
+	count := 0
+	err = c.ScanPhysical(func(offset int64, rec RecordInfo) bool {
+		count++
+		return false
+	})
+	if err != nil || count != 1 {
+		t.Errorf("expected the scan to stop after 1 record, got %d (%v)", count, err)
+	}
+}
+
+func TestRecoverLastCommitFromSentinel(t *testing.T) {
+	c, err := NewCollection("/tmp/test_recoverlastcommit.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	for i := 0; i < 3; i++ {
+		wb := NewWriteBatch()
+		wb.Set(fmt.Sprint(i), fmt.Sprint(i))
+		_, err = c.Update(wb)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	version := c.Version()
+	c.Close()
+
+	// Damage the last commit in the header and leave junk after the
+	// data, as if the header was torn without a WAL to recover from.
+	f, err := os.OpenFile("/tmp/test_recoverlastcommit.lm2", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	junk := bytes.Repeat([]byte{0xCC}, 100)
+	_, err = f.WriteAt(junk, version)
+	if err == nil {
+		bogus := [8]byte{}
+		binary.LittleEndian.PutUint64(bogus[:], uint64(version+50))
+		_, err = f.WriteAt(bogus[:], 8+maxLevels*8)
+	}
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = OpenCollection("/tmp/test_recoverlastcommit.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Version() != version {
+		t.Errorf("expected version %d, got %d", version, c.Version())
+	}
+	if err = c.Verify(); err != nil {
+		t.Error(err)
+	}
+	for i := 0; i < 3; i++ {
+		if ok, err := c.Has(fmt.Sprint(i)); err != nil || !ok {
+			t.Errorf("expected key %d (%v)", i, err)
+		}
+	}
+	if size := c.Stats().DataFileSize; size != version {
+		t.Errorf("expected file size %d, got %d", version, size)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	c, err := NewCollectionWithOptions("/tmp/test_checkpoint.lm2", Options{
+		CacheSize: 100,
+		Sync:      SyncNever,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	if err = c.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	wb := NewWriteBatch()
+	wb.Set("key", "value")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Stats().WALSize == 0 {
+		t.Fatal("expected a WAL entry")
+	}
+	if err = c.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if size := c.Stats().WALSize; size != 0 {
+		t.Errorf("expected an empty WAL, got %d bytes", size)
+	}
+
+	// A WAL entry for another version is kept.
+	wb = NewWriteBatch()
+	wb.Set("key2", "value")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := newWALEntry()
+	header := c.fileHeader
+	header.LastCommit++
+	entry.Push(newWALRecord(0, header.bytes()))
+	if _, err = c.wal.Append(entry); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Checkpoint(); err == nil {
+		t.Error("expected an error for a mismatched WAL entry")
+	}
+	if c.Stats().WALSize == 0 {
+		t.Error("expected the WAL to be kept")
+	}
+}
+
+func TestSharedCacheCollections(t *testing.T) {
+	sc := NewSharedCache(50)
+	collections := []*Collection{}
+	for i := 0; i < 3; i++ {
+		c, err := NewCollectionWithOptions(fmt.Sprintf("/tmp/test_sharedcache%d.lm2", i), Options{
+			SharedCache: sc,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Destroy()
+		collections = append(collections, c)
+
+		wb := NewWriteBatch()
+		for j := 0; j < 200; j++ {
+			wb.Set(fmt.Sprint(j), fmt.Sprint(j))
+		}
+		_, err = c.Update(wb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = c.Range("", "", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	total := 0
+	for _, c := range collections {
+		total += c.Stats().CacheRecords
+	}
+	if total > 50 {
+		t.Errorf("expected at most 50 cached records, got %d", total)
+	}
+
+	collections[0].Close()
+	if n := sc.numMembers; n != 2 {
+		t.Errorf("expected 2 collections in the shared cache, got %d", n)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	c, err := NewCollection("/tmp/test_warmup.lm2", 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 200; i++ {
+		wb.Set(fmt.Sprintf("key%03d", i), fmt.Sprint(i))
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rangeMisses := func(warmup bool) uint64 {
+		c, err = OpenCollection("/tmp/test_warmup.lm2", 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if warmup {
+			if err = c.Warmup("key100", "key120"); err != nil {
+				t.Fatal(err)
+			}
+			if n := c.Stats().CacheRecords; n < 19 {
+				t.Errorf("expected at least 19 cached records, got %d", n)
+			}
+		}
+		misses := c.Stats().CacheMisses
+		if _, err = c.Range("key100", "key120", 0); err != nil {
+			t.Fatal(err)
+		}
+		return c.Stats().CacheMisses - misses
+	}
+	cold := rangeMisses(false)
+	c.Close()
+	warm := rangeMisses(true)
+	if warm+15 > cold {
+		t.Errorf("expected at least 15 fewer cache misses after warming up, got %d instead of %d", warm, cold)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = c.WarmupContext(ctx, "", ""); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestWriteBatchClone(t *testing.T) {
+	c1, err := NewCollection("/tmp/test_writebatchclone1.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Destroy()
+	c2, err := NewCollection("/tmp/test_writebatchclone2.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Destroy()
+
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	wb.Set("b", "2")
+	wb.SetWithTTL("c", "3", time.Hour)
+	wb.Delete("b")
+	wb.Merge("d", func(existing string, existed bool) string {
+		return existing + "4"
+	})
+
+	clone := wb.Clone()
+	clone.Set("e", "5")
+	if wb.Len() != 4 || clone.Len() != 5 {
+		t.Fatalf("expected lengths 4 and 5, got %d and %d", wb.Len(), clone.Len())
+	}
+
+	// Update doesn't modify wb, so the copy is still the same.
+	_, err = c1.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c2.Update(wb.Clone())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := func(c *Collection) string {
+		cur, err := c.NewCursor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := ""
+		for cur.Next() {
+			s += cur.Key() + "=" + cur.Value() + " "
+		}
+		if err := cur.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	expected := "a=1 c=3 d=4 "
+	if got := contents(c1); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	if got := contents(c2); got != contents(c1) {
+		t.Errorf("expected %q, got %q", contents(c1), got)
+	}
+}
+
+func TestEstimateRangeCount(t *testing.T) {
+	c, err := NewCollection("/tmp/test_estimaterangecount.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	const numKeys = 5000
+	wb := NewWriteBatch()
+	for i := 0; i < numKeys; i++ {
+		wb.Set(fmt.Sprintf("key%05d", i), "value")
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Delete("key00010")
+	wb.Set("key00011", "new value")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Small ranges are exact.
+	count, err := c.EstimateRangeCount("key00000", "key00100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 99 {
+		t.Errorf("expected 99, got %d", count)
+	}
+	count, err = c.EstimateRangeCount("z", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("expected 0, got %d", count)
+	}
+
+	count, err = c.EstimateRangeCount("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count < numKeys*7/10 || count > numKeys*13/10 {
+		t.Errorf("expected about %d, got %d", numKeys, count)
+	}
+}
+
+func TestGetTombstone(t *testing.T) {
+	c, err := NewCollection("/tmp/test_gettombstone.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	wb.Set("b", "2")
+	wb.Set("c", "3")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Delete("b")
+	deletedAt, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Delete("c")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Set("c", "4")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, deleted, version, found, err := c.GetTombstone("a")
+	if err != nil || !found || deleted || value != "1" || version != 0 {
+		t.Errorf("expected a live key, got %q, %v, %d, %v (%v)", value, deleted, version, found, err)
+	}
+	value, deleted, version, found, err = c.GetTombstone("b")
+	if err != nil || !found || !deleted || value != "2" || version != deletedAt {
+		t.Errorf("expected b deleted at %d, got %q, %v, %d, %v (%v)", deletedAt, value, deleted, version, found, err)
+	}
+	value, deleted, _, found, err = c.GetTombstone("c")
+	if err != nil || !found || deleted || value != "4" {
+		t.Errorf("expected c to be set again, got %q, %v, %v (%v)", value, deleted, found, err)
+	}
+	_, _, _, found, err = c.GetTombstone("missing")
+	if err != nil || found {
+		t.Errorf("expected a missing key, got %v (%v)", found, err)
+	}
+
+	// Compaction drops deleted records.
+	err = c.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = OpenCollection("/tmp/test_gettombstone.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	_, _, _, found, err = c.GetTombstone("b")
+	if err != nil || found {
+		t.Errorf("expected b to be gone after compaction, got %v (%v)", found, err)
+	}
+}
+
+func TestIntegerKeyEncoding(t *testing.T) {
+	uints := []uint64{0, 1, 255, 256, 1<<32 - 1, 1 << 32, 1<<63 - 1, 1 << 63, math.MaxUint64}
+	for i, v := range uints {
+		encoded := EncodeUint64(v)
+		decoded, err := DecodeUint64(encoded)
+		if err != nil || decoded != v {
+			t.Errorf("expected %d, got %d (%v)", v, decoded, err)
+		}
+		if i > 0 && EncodeUint64(uints[i-1]) >= encoded {
+			t.Errorf("%d doesn't sort before %d", uints[i-1], v)
+		}
+	}
+
+	ints := []int64{math.MinInt64, math.MinInt64 + 1, -1 << 32, -256, -255, -1, 0, 1, 255, 256, 1 << 32, math.MaxInt64 - 1, math.MaxInt64}
+	for i, v := range ints {
+		encoded := EncodeInt64(v)
+		decoded, err := DecodeInt64(encoded)
+		if err != nil || decoded != v {
+			t.Errorf("expected %d, got %d (%v)", v, decoded, err)
+		}
+		if i > 0 && EncodeInt64(ints[i-1]) >= encoded {
+			t.Errorf("%d doesn't sort before %d", ints[i-1], v)
+		}
+	}
+
+	if _, err := DecodeInt64("short"); err != ErrInvalidEncoding {
+		t.Errorf("expected ErrInvalidEncoding, got %v", err)
+	}
+}
+
+func TestChangesSince(t *testing.T) {
+	c, err := NewCollection("/tmp/test_changessince.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	wb.Set("b", "1")
+	wb.Set("c", "1")
+	v1, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Set("b", "2")
+	wb.Delete("c")
+	wb.Set("d", "2")
+	v2, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Delete("a")
+	v3, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := func(version int64) string {
+		s := []string{}
+		err := c.ChangesSince(version, func(change Change) bool {
+			if change.Type == ChangePut {
+				s = append(s, fmt.Sprintf("%d put %s=%s", change.Version, change.Key, change.Value))
+			} else {
+				s = append(s, fmt.Sprintf("%d delete %s", change.Version, change.Key))
+			}
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(s, ", ")
+	}
+
+	expected := fmt.Sprintf("%[1]d put b=2, %[1]d delete c, %[1]d put d=2, %[2]d delete a", v2, v3)
+	if got := changes(v1); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	expected = fmt.Sprintf("%[1]d put a=1, %[1]d put b=1, %[1]d put c=1, ", v1) + expected
+	if got := changes(0); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	if got := changes(v3); got != "" {
+		t.Errorf("expected no changes, got %q", got)
+	}
+
+	if err := c.ChangesSince(v3+1, func(Change) bool { return true }); err != ErrInvalidVersion {
+		t.Errorf("expected ErrInvalidVersion, got %v", err)
+	}
+}
+
+func TestDeleteMaxCachedKey(t *testing.T) {
+	c, err := NewCollection("/tmp/test_deletemaxcachedkey.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 20; i++ {
+		wb.Set(fmt.Sprintf("key%02d", i), fmt.Sprint(i))
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur, err := c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cur.Get("key19"); err != nil {
+		t.Fatal(err)
+	}
+	if c.cache.maxKeyRecord == nil || c.cache.maxKeyRecord.Key != "key19" {
+		t.Fatal("expected key19 to be the largest cached key")
+	}
+
+	wb = NewWriteBatch()
+	wb.Delete("key19")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(key string, exists bool) {
+		t.Helper()
+		has, err := c.Has(key)
+		if err != nil || has != exists {
+			t.Errorf("expected %s to exist: %v, got %v (%v)", key, exists, has, err)
+		}
+	}
+	check("key18", true)
+	check("key19", false)
+
+	// The deleted key is still where a search for a larger key starts.
+	c.metaLock.RLock()
+	rec, err := c.findLastBefore("key18~")
+	c.metaLock.RUnlock()
+	if err != nil || rec == nil || rec.Key != "key18" {
+		t.Errorf("expected key18, got %v (%v)", rec, err)
+	}
+
+	wb = NewWriteBatch()
+	wb.Set("key20", "20")
+	wb.Set("key19", "again")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("key19", true)
+	check("key20", true)
+	kvs, err := c.Range("key18", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(kvs) != "[{key18 18} {key19 again} {key20 20}]" {
+		t.Errorf("unexpected range %v", kvs)
+	}
+}
+
+func TestPutIfAbsent(t *testing.T) {
+	c, err := NewCollection("/tmp/test_putifabsent.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	const NumGoroutines = 8
+	wg := sync.WaitGroup{}
+	inserted := make(chan string, NumGoroutines)
+	errs := make(chan error, NumGoroutines)
+	for i := 0; i < NumGoroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, _, err := c.PutIfAbsent("lock", fmt.Sprint(i))
+			if err != nil {
+				errs <- err
+				return
+			}
+			if ok {
+				inserted <- fmt.Sprint(i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	close(inserted)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	winners := []string{}
+	for i := range inserted {
+		winners = append(winners, i)
+	}
+	if len(winners) != 1 {
+		t.Fatalf("expected one insert, got %v", winners)
+	}
+	cur, err := c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := cur.Get("lock"); err != nil || val != winners[0] {
+		t.Errorf("expected %s, got %s (%v)", winners[0], val, err)
+	}
+
+	ok, version, err := c.PutIfAbsent("lock", "other")
+	if err != nil || ok || version != c.Version() {
+		t.Errorf("expected no insert at version %d, got %v at %d (%v)", c.Version(), ok, version, err)
+	}
+
+	// A deleted key can be inserted again.
+	wb := NewWriteBatch()
+	wb.Delete("lock")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, _, err = c.PutIfAbsent("lock", "again")
+	if err != nil || !ok {
+		t.Errorf("expected an insert, got %v (%v)", ok, err)
+	}
+}
+
+func TestCursorReuse(t *testing.T) {
+	c, err := NewCollection("/tmp/test_cursorreuse.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	wb.Set("b", "2")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cur, err := c.NewPrefixCursor("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cur.Next() {
+	}
+	wb = NewWriteBatch()
+	wb.Set("c", "3")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reset clears the prefix and takes a new snapshot.
+	for i := 0; i < 2; i++ {
+		err = cur.Reset(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := ""
+		for cur.Next() {
+			keys += cur.Key()
+		}
+		if keys != "abc" || cur.Err() != nil {
+			t.Errorf("expected abc, got %s (%v)", keys, cur.Err())
+		}
+		c.PutCursor(cur)
+		cur = c.GetCursor()
+	}
+	if val, err := cur.Get("b"); err != nil || val != "2" {
+		t.Errorf("expected 2, got %s (%v)", val, err)
+	}
+	c.PutCursor(cur)
+}
+
+func benchmarkSmallScans(b *testing.B, reuse bool) {
+	c, err := NewCollection("/tmp/test_benchmarksmallscans.lm2", 1000)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 1000; i++ {
+		wb.Set(fmt.Sprintf("key%04d", i), "value")
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var cur *Cursor
+		if reuse {
+			cur = c.GetCursor()
+		} else {
+			cur, err = c.NewCursor()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		for j := 0; j < 10 && cur.Next(); j++ {
+		}
+		if err := cur.Err(); err != nil {
+			b.Fatal(err)
+		}
+		if reuse {
+			c.PutCursor(cur)
+		}
+	}
+}
+
+func BenchmarkSmallScansNewCursor(b *testing.B) {
+	benchmarkSmallScans(b, false)
+}
+
+func BenchmarkSmallScansGetCursor(b *testing.B) {
+	benchmarkSmallScans(b, true)
+}
+
+func TestMaxFileSize(t *testing.T) {
+	c, err := NewCollectionWithOptions("/tmp/test_maxfilesize.lm2", Options{
+		CacheSize:   100,
+		MaxFileSize: 1 << 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wb = NewWriteBatch()
+	wb.Set("b", strings.Repeat("x", 1<<20))
+	_, err = c.Update(wb)
+	if err != ErrQuotaExceeded {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+
+	// A record without copies for higher levels grows the data file by
+	// its size and the sentinel's. Retry until one gets level 0.
+	wb = NewWriteBatch()
+	wb.Set("b", "2")
+	grow := int64(recordHeaderSize + 2 + 12)
+	for {
+		version := c.Version()
+		c.options.MaxFileSize = version + grow - 1
+		_, err = c.Update(wb)
+		if err != ErrQuotaExceeded {
+			t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+		}
+		if c.Version() != version || c.Stats().DataFileSize != version {
+			t.Fatalf("expected the collection to be untouched at %d, got %d", version, c.Stats().DataFileSize)
+		}
+
+		c.options.MaxFileSize = version + grow
+		_, err = c.Update(wb)
+		if err == ErrQuotaExceeded {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Version() != c.options.MaxFileSize {
+			t.Fatalf("expected the data file to be %d bytes, got %d", c.options.MaxFileSize, c.Version())
+		}
+		break
+	}
+
+	// Deletes are allowed over quota.
+	wb = NewWriteBatch()
+	wb.Delete("a")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := c.Has("a"); has {
+		t.Error("expected a to be deleted")
+	}
+}
+
+func TestListKeys(t *testing.T) {
+	c, err := NewCollection("/tmp/test_listkeys.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 10; i++ {
+		wb.Set(fmt.Sprint(i), "value")
+	}
+	wb.Set("", "empty key")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Delete("3")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages := []string{}
+	token := ""
+	for {
+		keys, next, err := c.ListKeys(token, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, fmt.Sprintf("%q", keys))
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	expected := `["" "0" "1"] ["2" "4" "5"] ["6" "7" "8"] ["9"]`
+	if got := strings.Join(pages, " "); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+
+	keys, next, err := c.ListKeys("", 0)
+	if err != nil || len(keys) != 10 || next != "" {
+		t.Errorf("expected all 10 keys, got %q, %q (%v)", keys, next, err)
+	}
+	if _, _, err = c.ListKeys("not a token!", 3); err != ErrInvalidPageToken {
+		t.Errorf("expected ErrInvalidPageToken, got %v", err)
+	}
+}
+
+func TestCacheConsistentAfterUpdates(t *testing.T) {
+	c, err := NewCollection("/tmp/test_cacheconsistent.lm2", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	for i := 0; i < 20; i++ {
+		wb := NewWriteBatch()
+		for j := 0; j < 50; j++ {
+			wb.Set(fmt.Sprint(rand.Intn(500)), fmt.Sprint(i))
+		}
+		wb.Delete(fmt.Sprint(rand.Intn(500)))
+		_, err = c.Update(wb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifyOrder(t, c, nil)
+	}
+
+	rc := c.cache
+	rc.lock.RLock()
+	defer rc.lock.RUnlock()
+	if rc.index.len != len(rc.cache) || rc.records != int64(len(rc.cache)) {
+		t.Fatalf("expected %d records in the index and count, got %d and %d",
+			len(rc.cache), rc.index.len, rc.records)
+	}
+	var prev *record
+	rc.index.each(func(rec *record) {
+		if rc.cache[rec.Offset] != rec {
+			t.Errorf("index record at offset %d isn't the cached one", rec.Offset)
+		}
+		if prev != nil {
+			cmp := rc.compare(prev.Key, rec.Key)
+			if cmp > 0 || (cmp == 0 && prev.Offset >= rec.Offset) {
+				t.Errorf("index record at offset %d is out of order", rec.Offset)
+			}
+		}
+		prev = rec
+	})
+	for offset, rec := range rc.cache {
+		if rec.Offset != offset {
+			t.Errorf("record at offset %d is cached at %d", rec.Offset, offset)
+		}
+	}
+}
+
+func TestUpdateChunked(t *testing.T) {
+	c, err := NewCollection("/tmp/test_updatechunked.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	wb.Set("a", "old")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wb = NewWriteBatch()
+	for i := 0; i < 100; i++ {
+		wb.Set(fmt.Sprintf("key%02d", i), strings.Repeat("x", 100))
+	}
+	wb.Set("big", strings.Repeat("x", 5000))
+	wb.Delete("a")
+	wb.Merge("m", func(existing string, existed bool) string { return "merged" })
+	versions, err := c.UpdateChunked(wb, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Records of about 150 bytes fit six to a commit, and "big" needs
+	// one of its own.
+	if len(versions) < 15 {
+		t.Errorf("expected at least 15 commits, got %d", len(versions))
+	}
+	for i := 1; i < len(versions); i++ {
+		if versions[i] <= versions[i-1] {
+			t.Errorf("expected increasing versions, got %v", versions)
+		}
+	}
+	if versions[len(versions)-1] != c.Version() {
+		t.Errorf("expected the last version to be %d, got %d", c.Version(), versions[len(versions)-1])
+	}
+
+	count := verifyOrder(t, c, nil)
+	if count != 102 {
+		t.Errorf("expected 102 keys, got %d", count)
+	}
+	if has, _ := c.Has("a"); has {
+		t.Error("expected a to be deleted")
+	}
+	cur, err := c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := cur.Get("m"); err != nil || val != "merged" {
+		t.Errorf("expected merged, got %s (%v)", val, err)
+	}
+}
+
+func TestStatsConcurrent(t *testing.T) {
+	c, err := NewCollection("/tmp/test_statsconcurrent.lm2", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 100; i++ {
+		wb.Set(fmt.Sprint(i), "value")
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if i == 0 {
+					wb := NewWriteBatch()
+					wb.Set(fmt.Sprint(j), "new value")
+					if _, err := c.Update(wb); err != nil {
+						t.Error(err)
+						return
+					}
+					continue
+				}
+				verifyOrder(t, c, nil)
+			}
+		}(i)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	prev := Stats{}
+	for {
+		stats := c.Stats()
+		if stats.RecordsRead < prev.RecordsRead || stats.CacheHits < prev.CacheHits ||
+			stats.CacheMisses < prev.CacheMisses {
+			t.Fatalf("counters went backwards: %+v after %+v", stats, prev)
+		}
+		prev = stats
+		select {
+		case <-done:
+			stats = c.Stats()
+			if stats.RecordsRead != stats.CacheHits+stats.CacheMisses {
+				t.Errorf("expected %d records read, got %d", stats.CacheHits+stats.CacheMisses, stats.RecordsRead)
+			}
+			return
+		default:
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	c1, err := NewCollection("/tmp/test_fingerprint1.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Destroy()
+	c2, err := NewCollection("/tmp/test_fingerprint2.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Destroy()
+
+	empty, err := c1.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// c1 gets the contents in one batch, and c2 with a history of
+	// overwrites and deletes.
+	wb := NewWriteBatch()
+	for i := 0; i < 50; i++ {
+		wb.Set(fmt.Sprint(i), "value")
+	}
+	_, err = c1.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 49; i >= 0; i-- {
+		wb := NewWriteBatch()
+		wb.Set(fmt.Sprint(i), "old")
+		wb.Set("extra"+fmt.Sprint(i), "value")
+		_, err = c2.Update(wb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wb = NewWriteBatch()
+		wb.Set(fmt.Sprint(i), "value")
+		wb.Delete("extra" + fmt.Sprint(i))
+		_, err = c2.Update(wb)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f1, err := c1.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := c2.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f1 != f2 {
+		t.Errorf("expected the same fingerprint, got %x and %x", f1, f2)
+	}
+	if f1 == empty {
+		t.Error("expected a different fingerprint than an empty collection")
+	}
+
+	wb = NewWriteBatch()
+	wb.Set("1", "value ")
+	_, err = c2.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err = c2.Fingerprint()
+	if err != nil || f2 == f1 {
+		t.Errorf("expected a different fingerprint after a change, got %x (%v)", f2, err)
+	}
+}
+
+func TestOpenWithoutWAL(t *testing.T) {
+	c, err := NewCollection("/tmp/test_openwithoutwal.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 10; i++ {
+		wb.Set(fmt.Sprint(i), "value")
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Copy only the data file of the open collection.
+	data, err := os.ReadFile("/tmp/test_openwithoutwal.lm2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("/tmp/test_openwithoutwal_copy.lm2.wal")
+	err = os.WriteFile("/tmp/test_openwithoutwal_copy.lm2", data, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copied, err := OpenCollection("/tmp/test_openwithoutwal_copy.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Destroy()
+	if copied.Version() != c.Version() {
+		t.Errorf("expected version %d, got %d", c.Version(), copied.Version())
+	}
+	if count := verifyOrder(t, copied, nil); count != 10 {
+		t.Errorf("expected 10 keys, got %d", count)
+	}
+}
+
+func TestReader(t *testing.T) {
+	c, err := NewCollection("/tmp/test_reader.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 100; i++ {
+		wb.Set(fmt.Sprintf("%03d", i), "1")
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := c.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	version := r.Version()
+	if version != c.Version() {
+		t.Errorf("expected version %d, got %d", c.Version(), version)
+	}
+
+	// Records added after the Reader was created are linked from
+	// records it sees, but it keeps seeing its own version.
+	for i := 0; i < 10; i++ {
+		wb := NewWriteBatch()
+		wb.Set(fmt.Sprintf("%03d", i*10), "2")
+		wb.Set(fmt.Sprintf("%03d-new", i), "2")
+		wb.Delete(fmt.Sprintf("%03d", i*10+5))
+		_, err = c.Update(wb)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cur, err := r.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for cur.Next() {
+		if cur.Value() != "1" {
+			t.Errorf("expected %s to be 1, got %s", cur.Key(), cur.Value())
+		}
+		count++
+	}
+	if err = cur.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != 100 {
+		t.Errorf("expected 100 keys, got %d", count)
+	}
+	if val, err := r.Get("010"); err != nil || val != "1" {
+		t.Errorf("expected 1, got %s (%v)", val, err)
+	}
+
+	err = r.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Version() != c.Version() {
+		t.Errorf("expected version %d, got %d", c.Version(), r.Version())
+	}
+	if val, err := r.Get("010"); err != nil || val != "2" {
+		t.Errorf("expected 2, got %s (%v)", val, err)
+	}
+	if _, err := r.Get("015"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+	cur, err = r.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count = 0
+	for cur.Next() {
+		count++
+	}
+	if count != 100 {
+		t.Errorf("expected 100 keys, got %d", count)
+	}
+
+	// The Reader uses the collection's cache without adding to it.
+	c.cache.reset()
+	if _, err := r.Get("050"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(c.cache.cache); n != 0 || c.cache.maxKeyOffset() != 0 {
+		t.Errorf("expected the Reader not to add to the cache, got %d records", n)
+	}
+	if err = r.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Range("", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	hits := r.c.Stats().CacheHits
+	if val, err := r.Get("051"); err != nil || val != "1" {
+		t.Errorf("expected 1, got %s (%v)", val, err)
+	}
+	if r.c.Stats().CacheHits == hits {
+		t.Error("expected the Reader to hit the collection's cache")
+	}
+}
+
+// recordingLogger records the messages logged to it.
+type recordingLogger struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Printf(format string, args ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) contains(s string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, message := range l.messages {
+		if strings.Contains(message, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogger(t *testing.T) {
+	const file = "/tmp/test_logger.lm2"
+	logger := &recordingLogger{}
+	c, err := NewCollectionWithOptions(file, Options{CacheSize: 100, Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if len(logger.messages) != 0 {
+		t.Errorf("expected no messages, got %q", logger.messages)
+	}
+
+	err = os.WriteFile(file+".wal", []byte("garbage"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = OpenCollectionWithOptions(file, Options{CacheSize: 100, Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !logger.contains(file + ": discarding unreadable WAL entry") {
+		t.Errorf("expected the WAL entry to be logged, got %q", logger.messages)
+	}
+
+	// The data file can't be seeked to append.
+	c.f.Close()
+	wb = NewWriteBatch()
+	wb.Set("b", "2")
+	_, err = c.Update(wb)
+	if err == nil || c.OK() {
+		t.Fatalf("expected the collection to be inconsistent, got %v", err)
+	}
+	if !logger.contains("collection is inconsistent") {
+		t.Errorf("expected the inconsistency to be logged, got %q", logger.messages)
+	}
+}
+
+func TestAlreadyOpen(t *testing.T) {
+	const file = "/tmp/test_alreadyopen.lm2"
+	c, err := NewCollection(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewCollection(file, 100); err != ErrAlreadyOpen {
+		t.Errorf("expected ErrAlreadyOpen, got %v", err)
+	}
+	if _, err = OpenCollection("/tmp/../tmp/test_alreadyopen.lm2", 100); err != ErrAlreadyOpen {
+		t.Errorf("expected ErrAlreadyOpen, got %v", err)
+	}
+	ro, err := OpenCollectionReadOnly(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro.Close()
+	c.Close()
+	c.Close()
+
+	c, err = OpenCollection(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Destroy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = NewCollection(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Destroy()
+}
+
+func TestDiff(t *testing.T) {
+	a, err := NewCollection("/tmp/test_diff_a.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Destroy()
+	b, err := NewCollection("/tmp/test_diff_b.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Destroy()
+
+	wb := NewWriteBatch()
+	for _, key := range []string{"a", "b", "c", "e"} {
+		wb.Set(key, "1")
+	}
+	_, err = a.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	for _, key := range []string{"b", "d", "e", "f"} {
+		wb.Set(key, "1")
+	}
+	wb.Set("c", "2")
+	_, err = b.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := Diff(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for entry := range entries {
+		if entry.Err != nil {
+			t.Fatal(entry.Err)
+		}
+		got = append(got, fmt.Sprintf("%s:%v=%s,%v=%s", entry.Key, entry.InA, entry.A, entry.InB, entry.B))
+	}
+	expected := []string{"a:true=1,false=", "c:true=1,true=2", "d:false=,true=1", "f:false=,true=1"}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	entries, err = DiffContext(ctx, a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-entries
+	cancel()
+	for range entries {
+	}
+}
+
+func TestGetCached(t *testing.T) {
+	c, err := NewCollection("/tmp/test_getcached.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 10; i++ {
+		wb.Set(fmt.Sprintf("%03d", i), "1")
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := c.GetCached("005"); ok || err != nil {
+		t.Errorf("expected a miss, got %v (%v)", ok, err)
+	}
+
+	err = c.Warmup("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reads := c.Stats().RecordsRead
+	if val, ok, err := c.GetCached("005"); !ok || err != nil || val != "1" {
+		t.Errorf("expected 1, got %s, %v (%v)", val, ok, err)
+	}
+	if _, ok, err := c.GetCached("missing"); ok || err != nil {
+		t.Errorf("expected a miss, got %v (%v)", ok, err)
+	}
+	if c.Stats().RecordsRead != reads {
+		t.Error("expected GetCached not to read records")
+	}
+
+	wb = NewWriteBatch()
+	wb.Set("005", "2")
+	wb.Delete("006")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"005", "006"} {
+		if val, ok, err := c.GetCached(key); ok || err != nil {
+			t.Errorf("expected a miss for %s, got %s, %v (%v)", key, val, ok, err)
+		}
+	}
+}
+
+func TestScanBuffer(t *testing.T) {
+	c, err := NewCollection("/tmp/test_scanbuffer.lm2", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 100; i++ {
+		wb.Set(fmt.Sprintf("%03d", i), strings.Repeat("v", i))
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Set("050", "new")
+	wb.Delete("051")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{}
+	err = c.Scan("045", func(key, value string) bool {
+		expected[key] = value
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	prev := ""
+	err = c.ScanBuffer("045", make([]byte, 0, 8), func(key, value []byte) bool {
+		if string(key) <= prev {
+			t.Errorf("%s came after %s", key, prev)
+		}
+		prev = string(key)
+		got[string(key)] = string(value)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	count := 0
+	err = c.ScanBuffer("", nil, func(key, value []byte) bool {
+		count++
+		return count < 10
+	})
+	if err != nil || count != 10 {
+		t.Errorf("expected to stop after 10 keys, got %d (%v)", count, err)
+	}
+}
+
+func benchmarkScan(b *testing.B, buffered bool) {
+	c, err := NewCollection("/tmp/bench_scan.lm2", 100)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Destroy()
+	wb := NewWriteBatch()
+	for i := 0; i < 10000; i++ {
+		wb.Set(fmt.Sprintf("%06d", i), "value")
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if buffered {
+			err = c.ScanBuffer("", buf, func(key, value []byte) bool {
+				return true
+			})
+		} else {
+			err = c.Scan("", func(key, value string) bool {
+				return true
+			})
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkScan(b *testing.B) {
+	benchmarkScan(b, false)
+}
+
+func BenchmarkScanBuffer(b *testing.B) {
+	benchmarkScan(b, true)
+}
+
+func TestLastCommitInfo(t *testing.T) {
+	const file = "/tmp/test_lastcommitinfo.lm2"
+	c, err := NewCollection(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	if _, ok := c.LastCommitInfo(); ok {
+		t.Error("expected no commit info for a new collection")
+	}
+
+	before := time.Now()
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	wb.SetTag([]byte("txn-1"))
+	version, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, ok := c.LastCommitInfo()
+	if !ok || info.Version != version || string(info.Tag) != "txn-1" || info.Time.Before(before) {
+		t.Errorf("unexpected commit info %+v, %v", info, ok)
+	}
+
+	// The WAL entry is kept after a crash and replayed.
+	atomic.StoreUint32(&c.internalState, 1)
+	c.Close()
+	c, err = OpenCollection(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, ok := c.LastCommitInfo(); !ok || string(info.Tag) != "txn-1" {
+		t.Errorf("expected the tag after recovery, got %+v, %v", info, ok)
+	}
+
+	wb = NewWriteBatch()
+	wb.Set("b", "2")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, ok := c.LastCommitInfo(); !ok || info.Tag != nil {
+		t.Errorf("expected no tag, got %+v, %v", info, ok)
+	}
+	_, err = c.Clear()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.LastCommitInfo(); ok {
+		t.Error("expected no commit info after Clear")
+	}
+}
+
+func TestReload(t *testing.T) {
+	c, err := NewCollection("/tmp/test_reload.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	version, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	cur, err := c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The data file can't be seeked to append.
+	c.f.Close()
+	wb = NewWriteBatch()
+	wb.Set("b", "2")
+	if _, err = c.Update(wb); err == nil || c.OK() {
+		t.Fatalf("expected the collection to be inconsistent, got %v", err)
+	}
+	if err = c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.OK() || c.Version() != version {
+		t.Errorf("expected the collection to be OK at version %d, got %v at %d", version, c.OK(), c.Version())
+	}
+	if cur.Next(); cur.Err() != ErrStale {
+		t.Errorf("expected ErrStale, got %v", cur.Err())
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := verifyOrder(t, c, nil); count != 2 {
+		t.Errorf("expected 2 keys, got %d", count)
+	}
+
+	c.Close()
+	if err = c.Reload(); err != ErrInternal {
+		t.Errorf("expected ErrInternal after Close, got %v", err)
+	}
+}
+
+func TestReloadWhileSyncing(t *testing.T) {
+	c, err := NewCollectionWithOptions("/tmp/test_reloadwhilesyncing.lm2", Options{
+		CacheSize:  100,
+		Sync:       SyncInterval,
+		SyncPeriod: time.Microsecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	done := make(chan struct{})
+	flushed := make(chan struct{})
+	go func() {
+		defer close(flushed)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := c.Flush(); err != nil && err != ErrInternal {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		wb := NewWriteBatch()
+		wb.Set(fmt.Sprint(i), "1")
+		if _, err = c.Update(wb); err != nil {
+			t.Fatal(err)
+		}
+		c.markInconsistent(errors.New("test"))
+		if err = c.Reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	<-flushed
+
+	if count := verifyOrder(t, c, nil); count != 100 {
+		t.Errorf("expected 100 keys, got %d", count)
+	}
+}
+
+func TestSeekCachePolicy(t *testing.T) {
+	const file = "/tmp/test_seekcachepolicy.lm2"
+	c, err := NewCollection(file, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb := NewWriteBatch()
+	for i := 0; i < 2000; i++ {
+		wb.Set(fmt.Sprintf("%04d", i), "1")
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	cached := map[SeekCachePolicy]int{}
+	for _, policy := range []SeekCachePolicy{SeekCacheAll, SeekCacheNone, SeekCacheSampled} {
+		c, err = OpenCollectionWithOptions(file, Options{
+			CacheSize:         1000,
+			SeekCachePolicy:   policy,
+			SeekCacheInterval: 2,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur, err := c.NewCursor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.cache.reset()
+		cur.Seek("1999")
+		if !cur.Valid() || cur.Key() != "1998" {
+			t.Fatalf("policy %d: expected to seek to 1998, got %s (%v)", policy, cur.Key(), cur.Err())
+		}
+		cached[policy] = len(c.cache.cache)
+		c.Close()
+	}
+	if cached[SeekCacheNone] > 1 {
+		t.Errorf("expected only the record the cursor landed on to be cached, got %d records", cached[SeekCacheNone])
+	}
+	if cached[SeekCacheAll] <= cached[SeekCacheNone] || cached[SeekCacheSampled] > cached[SeekCacheAll] {
+		t.Errorf("unexpected cached record counts %v", cached)
+	}
+	os.Remove(file)
+}
+
+func benchmarkSeekToEnd(b *testing.B, policy SeekCachePolicy, cold bool) {
+	const file = "/tmp/bench_seektoend.lm2"
+	c, err := NewCollectionWithOptions(file, Options{CacheSize: 1000, SeekCachePolicy: policy})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Destroy()
+	wb := NewWriteBatch()
+	for i := 0; i < 10000; i++ {
+		wb.Set(fmt.Sprintf("%06d", i), "value")
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if cold {
+			c.cache.reset()
+		}
+		cur, err := c.NewCursor()
+		if err != nil {
+			b.Fatal(err)
+		}
+		cur.Seek("009999")
+		if err = cur.Err(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSeekToEndCold(b *testing.B) {
+	benchmarkSeekToEnd(b, SeekCacheAll, true)
+}
+
+func BenchmarkSeekToEndColdNoCache(b *testing.B) {
+	benchmarkSeekToEnd(b, SeekCacheNone, true)
+}
+
+func BenchmarkSeekToEndWarm(b *testing.B) {
+	benchmarkSeekToEnd(b, SeekCacheAll, false)
+}
+
+func BenchmarkSeekToEndWarmNoCache(b *testing.B) {
+	benchmarkSeekToEnd(b, SeekCacheNone, false)
+}
+
+func TestSetIfChanged(t *testing.T) {
+	c, err := NewCollection("/tmp/test_setifchanged.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	wb.Set("b", "2")
+	v1, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wb = NewWriteBatch()
+	wb.SetIfChanged("a", "1")
+	version, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != v1 {
+		t.Errorf("expected nothing to be committed at version %d, got %d", v1, version)
+	}
+
+	wb = NewWriteBatch()
+	wb.SetIfChanged("a", "1")
+	wb.SetIfChanged("b", "3")
+	wb.SetIfChanged("c", "4")
+	v2, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2 <= v1 {
+		t.Fatalf("expected a new version after %d, got %d", v1, v2)
+	}
+	for key, expected := range map[string]int64{"a": v1, "b": v2, "c": v2} {
+		_, version, found, err := c.GetWithVersion(key)
+		if err != nil || !found || version != expected {
+			t.Errorf("expected %s at version %d, got %d, %v (%v)", key, expected, version, found, err)
+		}
+	}
+	if elided := c.Stats().SetsElided; elided != 2 {
+		t.Errorf("expected 2 elided sets, got %d", elided)
+	}
+
+	keys := []string{}
+	err = c.ChangesSince(v1, func(change Change) bool {
+		keys = append(keys, change.Key)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(keys) != "[b c]" {
+		t.Errorf("expected changes to b and c, got %v", keys)
+	}
+
+	// A Set of the same key isn't elided.
+	wb.Set("a", "1")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, version, _, _ := c.GetWithVersion("a"); version == v1 {
+		t.Errorf("expected a to be rewritten")
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	const file = "/tmp/test_tombstones.lm2"
+	c, err := NewCollection(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 10; i++ {
+		wb.Set(fmt.Sprint(i), "value")
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, bytes, err := c.Tombstones()
+	if err != nil || count != 0 || bytes != 0 {
+		t.Errorf("expected no tombstones, got %d, %d (%v)", count, bytes, err)
+	}
+
+	wb = NewWriteBatch()
+	wb.Set("3", "updated")
+	wb.Delete("5")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, bytes, err = c.Tombstones()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 tombstones, got %d", count)
+	}
+	if dead := c.Stats().DeadBytes; uint64(bytes) != dead {
+		t.Errorf("expected %d bytes, got %d", dead, bytes)
+	}
+
+	err = c.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = OpenCollection(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	count, bytes, err = c.Tombstones()
+	if err != nil || count != 0 || bytes != 0 {
+		t.Errorf("expected no tombstones after compaction, got %d, %d (%v)", count, bytes, err)
+	}
+}
+
+func TestReadRecordAt(t *testing.T) {
+	c, err := NewCollection("/tmp/test_readrecordat.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 10; i++ {
+		wb.Set(fmt.Sprint(i), fmt.Sprint("value", i))
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Delete("5")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.cache.reset()
+	scanned := []RecordInfo{}
+	err = c.ScanPhysical(func(offset int64, rec RecordInfo) bool {
+		scanned = append(scanned, rec)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range scanned {
+		rec, err := c.ReadRecordAt(expected.Offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Value != "value"+rec.Key {
+			t.Errorf("expected value%s, got %s", rec.Key, rec.Value)
+		}
+		rec.Value = ""
+		if rec != expected {
+			t.Errorf("expected %+v, got %+v", expected, rec)
+		}
+	}
+	if n := len(c.cache.cache); n != 0 {
+		t.Errorf("expected the cache to stay empty, got %d records", n)
+	}
+
+	for _, offset := range []int64{0, recordsStart - 1, c.Version() - 12, c.Version()} {
+		_, err = c.ReadRecordAt(offset)
+		if err != ErrInvalidOffset {
+			t.Errorf("offset %d: expected ErrInvalidOffset, got %v", offset, err)
+		}
+	}
+}
+
+func TestCursorNextN(t *testing.T) {
+	c, err := NewCollection("/tmp/test_cursornextn.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 10; i++ {
+		wb.Set(fmt.Sprintf("key%d", i), fmt.Sprint(i))
+	}
+	wb.Set("other", "value")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Delete("key4")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cur, err := c.NewPrefixCursor("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := []string{}
+	for {
+		kvs, err := cur.NextN(4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(kvs) == 0 {
+			break
+		}
+		pages = append(pages, fmt.Sprint(kvs))
+	}
+	expected := []string{
+		"[{key0 0} {key1 1} {key2 2} {key3 3}]",
+		"[{key5 5} {key6 6} {key7 7} {key8 8}]",
+		"[{key9 9}]",
+	}
+	if fmt.Sprint(pages) != fmt.Sprint(expected) {
+		t.Errorf("expected pages %v, got %v", expected, pages)
+	}
+	if cur.Valid() {
+		t.Error("expected the cursor to be at the end")
+	}
+
+	// An error stops NextN with what was read before it.
+	cur, err = c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cur.Next() {
+		t.Fatal("expected a record")
+	}
+	c.cache.reset()
+	c.readAt = func(b []byte, off int64) (int, error) {
+		return 0, errInjected
+	}
+	kvs, err := cur.NextN(4)
+	if !errors.Is(err, errInjected) || len(kvs) != 0 || cur.Err() != err {
+		t.Errorf("expected the injected error, got %v, %v (%v)", kvs, err, cur.Err())
+	}
+}
+
+func TestReverseRange(t *testing.T) {
+	c, err := NewCollection("/tmp/test_reverserange.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	for i := 0; i < 10; i++ {
+		wb.Set(fmt.Sprintf("key%d", i), fmt.Sprint(i))
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Delete("key4")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		start, end string
+		limit      int
+		expected   string
+	}{
+		{"key7", "key2", 0, "[{key6 6} {key5 5} {key3 3} {key2 2}]"},
+		{"key7", "key2", 3, "[{key6 6} {key5 5} {key3 3}]"},
+		{"key7", "key2", 10, "[{key6 6} {key5 5} {key3 3} {key2 2}]"},
+		{"", "key7", 2, "[{key9 9} {key8 8}]"},
+		{"key2", "key2", 0, "[]"},
+		{"key0", "", 0, "[]"},
+	} {
+		kvs, err := c.ReverseRange(test.start, test.end, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(kvs) != test.expected {
+			t.Errorf("ReverseRange(%q, %q, %d): expected %s, got %v",
+				test.start, test.end, test.limit, test.expected, kvs)
+		}
+	}
+}
+
+func TestCursorWithDeleted(t *testing.T) {
+	c, err := NewCollection("/tmp/test_cursorwithdeleted.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	wb.Set("b", "1")
+	wb.Set("c", "1")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Set("b", "2")
+	v2, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur, err := c.NewCursorWithDeleted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Delete("c")
+	v3, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cursor's snapshot is from before c was deleted.
+	records := []string{}
+	for cur.Next() {
+		records = append(records, fmt.Sprintf("%s=%s@%d", cur.Key(), cur.Value(), cur.DeletedVersion()))
+	}
+	if err = cur.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"a=1@0", fmt.Sprintf("b=1@%d", v2), "b=2@0", "c=1@0"}
+	if fmt.Sprint(records) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, records)
+	}
+
+	cur, err = c.NewCursorWithDeleted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cur.Get("c"); err != nil {
+		t.Fatal(err)
+	}
+	if !cur.Deleted() || cur.DeletedVersion() != v3 {
+		t.Errorf("expected c to be deleted at %d, got %d", v3, cur.DeletedVersion())
+	}
+
+	// Other cursors still skip deleted records.
+	cur, err = c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for cur.Next() {
+		if cur.Deleted() {
+			t.Errorf("unexpected deleted record %s", cur.Key())
+		}
+		keys = append(keys, cur.Key()+"="+cur.Value())
+	}
+	if fmt.Sprint(keys) != "[a=1 b=2]" {
+		t.Errorf("expected [a=1 b=2], got %v", keys)
+	}
+}
+
+func TestGetInto(t *testing.T) {
+	c, err := NewCollectionWithOptions("/tmp/test_getinto.lm2", Options{CacheSize: 100, BlobThreshold: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	wb.Set("b", "22")
+	wb.Set("c", strings.Repeat("3", 20))
+	wb.Set("d", "4")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Delete("d")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cold := range []bool{false, true} {
+		if cold {
+			c.cache.reset()
+		}
+		buf := []byte("x")
+		for _, key := range []string{"a", "b", "c", "d", "e"} {
+			found, err := c.GetInto(key, &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != (key < "d") {
+				t.Errorf("unexpected found %v for %s", found, key)
+			}
+		}
+		if expected := "x122" + strings.Repeat("3", 20); string(buf) != expected {
+			t.Errorf("expected %q, got %q", expected, buf)
+		}
+	}
+}
+
+func benchmarkGet(b *testing.B, into, cold bool) {
+	const file = "/tmp/bench_get.lm2"
+	c, err := NewCollection(file, 1000)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Destroy()
+	wb := NewWriteBatch()
+	for i := 0; i < 1000; i++ {
+		wb.Set(fmt.Sprintf("%06d", i), strings.Repeat("v", 100))
+	}
+	_, err = c.Update(wb)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// Cache the records a Get of key reads.
+	const key = "000500"
+	cur := c.GetCursor()
+	_, err = cur.Get(key)
+	c.PutCursor(cur)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	buf := make([]byte, 0, 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if cold {
+			c.cache.reset()
+		}
+		if into {
+			buf = buf[:0]
+			_, err = c.GetInto(key, &buf)
+		} else {
+			cur := c.GetCursor()
+			_, err = cur.Get(key)
+			c.PutCursor(cur)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	benchmarkGet(b, false, false)
+}
+
+func BenchmarkGetInto(b *testing.B) {
+	benchmarkGet(b, true, false)
+}
+
+func BenchmarkGetCold(b *testing.B) {
+	benchmarkGet(b, false, true)
+}
+
+func BenchmarkGetIntoCold(b *testing.B) {
+	benchmarkGet(b, true, true)
+}
+
+func TestOpenEmptyDataFile(t *testing.T) {
+	const file = "/tmp/test_openemptydatafile.lm2"
+	os.Remove(file)
+	err := os.WriteFile(file, nil, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file)
+
+	if _, err = OpenCollection(file, 100); err != ErrEmptyFile {
+		t.Fatalf("expected ErrEmptyFile, got %v", err)
+	}
+	if _, err = OpenCollectionReadOnly(file, 100); err != ErrEmptyFile {
+		t.Fatalf("expected ErrEmptyFile for a read-only collection, got %v", err)
+	}
+	if fi, err := os.Stat(file); err != nil || fi.Size() != 0 {
+		t.Fatalf("expected the data file to be left alone, got %v (%v)", fi, err)
+	}
+
+	c, err := OpenCollectionWithOptions(file, Options{CacheSize: 100, ReinitializeEmpty: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	if _, err = c.Update(wb); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	c, err = OpenCollection(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	cur, err := c.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := cur.Get("a"); err != nil || value != "1" {
+		t.Errorf("expected a=1, got %q (%v)", value, err)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	const file = "/tmp/test_files.lm2"
+	c, err := NewCollectionWithOptions(file, Options{
+		CacheSize:     100,
+		WALFile:       "/tmp/test_files.log",
+		BlobThreshold: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	info := c.Files()
+	if info.DataFile != file || info.DataSize != recordsStart {
+		t.Errorf("expected data file %s of %d bytes, got %s of %d", file, recordsStart, info.DataFile, info.DataSize)
+	}
+	if info.WALFile != "/tmp/test_files.log" || info.WALSize != 0 {
+		t.Errorf("expected an empty WAL at /tmp/test_files.log, got %s of %d bytes", info.WALFile, info.WALSize)
+	}
+	if info.BlobFile != "" || info.IndexFile != "" {
+		t.Errorf("expected no blob or index file, got %q and %q", info.BlobFile, info.IndexFile)
+	}
+
+	wb := NewWriteBatch()
+	wb.Set("a", strings.Repeat("x", 100))
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info = c.Files()
+	if info.DataSize <= recordsStart || info.WALSize == 0 {
+		t.Errorf("expected the data file and WAL to grow, got %d and %d bytes", info.DataSize, info.WALSize)
+	}
+	if info.BlobFile != file+".blob" || info.BlobSize != 100 {
+		t.Errorf("expected a blob file of 100 bytes, got %s of %d", info.BlobFile, info.BlobSize)
+	}
+}
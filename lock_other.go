@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package lm2
+
+import "os"
+
+// tryLock does nothing on platforms without advisory locks, so only
+// collections in the same process are kept from writing the same file.
+func tryLock(f *os.File, exclusive bool) error {
+	return nil
+}
+
+func unlock(f *os.File) error {
+	return nil
+}
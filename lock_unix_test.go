@@ -0,0 +1,96 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package lm2
+
+import (
+	"os"
+	"testing"
+)
+
+// Locks taken through another file descriptor conflict like locks taken
+// by another process.
+func lockFromOutside(t *testing.T, file string, exclusive bool) (*os.File, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tryLock(f, exclusive)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func TestFileLock(t *testing.T) {
+	const file = "/tmp/test_filelock.lm2"
+	c, err := NewCollection(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	if _, err = lockFromOutside(t, file, false); err != ErrLocked {
+		t.Errorf("expected ErrLocked, got %v", err)
+	}
+
+	// Another process writing doesn't keep read-only collections out.
+	ro, err := OpenCollectionReadOnly(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if _, err = lockFromOutside(t, file, true); err != ErrLocked {
+		t.Errorf("expected the read-only collection to keep a shared lock, got %v", err)
+	}
+	ro.Close()
+
+	outside, err := lockFromOutside(t, file, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenCollection(file, 100); err != ErrLocked {
+		t.Errorf("expected ErrLocked, got %v", err)
+	}
+	outside.Close()
+
+	outside, err = lockFromOutside(t, file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro, err = OpenCollectionReadOnly(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro.Close()
+	outside.Close()
+
+	// Read-only collections in this process don't keep a writer out.
+	ro, err = OpenCollectionReadOnly(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	c, err = OpenCollection(file, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb := NewWriteBatch()
+	wb.Set("a", "1")
+	wb.Delete("a")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock moves to the data file written by compaction.
+	c.writeLock.Lock()
+	_, err = c.compactOnline(nil)
+	c.writeLock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = lockFromOutside(t, file, false); err != ErrLocked {
+		t.Errorf("expected ErrLocked after compaction, got %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+//go:build prometheus
+// +build prometheus
+
+package lm2
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RegisterMetrics registers Prometheus collectors for the collection's
+// statistics with reg. Each metric is labeled with the data file path.
+// RegisterMetrics is only available when building with the prometheus
+// build tag.
+func (c *Collection) RegisterMetrics(reg prometheus.Registerer) error {
+	labels := prometheus.Labels{"file": c.f.Name()}
+	counter := func(name, help string, v *uint64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "lm2",
+			Name:        name,
+			Help:        help,
+			ConstLabels: labels,
+		}, func() float64 {
+			return float64(atomic.LoadUint64(v))
+		})
+	}
+	gauge := func(name, help string, f func() float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   "lm2",
+			Name:        name,
+			Help:        help,
+			ConstLabels: labels,
+		}, f)
+	}
+
+	collectors := []prometheus.Collector{
+		counter("cache_hits_total", "Number of record reads served from the cache.",
+			&c.stats.CacheHits),
+		counter("cache_misses_total", "Number of record reads that went to disk.",
+			&c.stats.CacheMisses),
+		counter("records_read_total", "Number of records read.",
+			&c.stats.RecordsRead),
+		counter("records_written_total", "Number of records written.",
+			&c.stats.RecordsWritten),
+		gauge("cache_records", "Number of records in the cache.", func() float64 {
+			c.cache.lock.RLock()
+			defer c.cache.lock.RUnlock()
+			return float64(len(c.cache.cache))
+		}),
+		gauge("data_file_bytes", "Size of the data file in bytes.", func() float64 {
+			fi, err := c.dataFile().Stat()
+			if err != nil {
+				return 0
+			}
+			return float64(fi.Size())
+		}),
+	}
+	for _, collector := range collectors {
+		if err := reg.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
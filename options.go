@@ -0,0 +1,248 @@
+package lm2
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// SyncMode determines when a collection's files are synced to stable storage.
+type SyncMode int
+
+const (
+	// SyncAlways syncs the data file and WAL during every Update.
+	// A successful Update survives an operating system crash or power loss.
+	SyncAlways SyncMode = iota
+	// SyncInterval syncs the data file and WAL in the background every
+	// Options.SyncPeriod. Updates survive a process crash, but an operating
+	// system crash or power loss may lose the updates made since the last
+	// sync and may leave the collection inconsistent.
+	SyncInterval
+	// SyncNever leaves syncing to the operating system. Updates survive a
+	// process crash, but an operating system crash or power loss may lose
+	// any number of updates and may leave the collection inconsistent.
+	// Collection.Flush syncs explicitly.
+	SyncNever
+)
+
+// Logger receives messages about internal events, such as recovery,
+// repair, compaction and errors that leave a collection inconsistent.
+// *log.Logger implements it.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// SeekCachePolicy determines which of the records read while seeking to
+// a key are added to the cache.
+type SeekCachePolicy int
+
+const (
+	// SeekCacheAll adds every record read while seeking to the cache.
+	SeekCacheAll SeekCachePolicy = iota
+	// SeekCacheNone adds none of them. A cursor still caches the record
+	// it lands on. Seeks far from the cached records read the path there
+	// from disk every time, but they don't evict the cache.
+	SeekCacheNone
+	// SeekCacheSampled adds every Options.SeekCacheInterval-th record,
+	// so repeated seeks to a region speed up without a single seek
+	// filling the cache.
+	SeekCacheSampled
+)
+
+// defaultSeekCacheInterval is used by SeekCacheSampled if
+// Options.SeekCacheInterval isn't set.
+const defaultSeekCacheInterval = 16
+
+// defaultSyncPeriod is used by SyncInterval if Options.SyncPeriod isn't set.
+const defaultSyncPeriod = time.Second
+
+// Options holds collection options.
+type Options struct {
+	// CacheSize is the size of the collection cache.
+	CacheSize int
+	// SharedCache, if set, is used instead of a cache of CacheSize
+	// records. The collection leaves it when it's closed.
+	SharedCache *SharedCache
+
+	// FileMode is the permission bits used when a data file or WAL is
+	// created. If it's set, new files get exactly these bits, whatever
+	// the umask. By default data files are created with 0666 and WALs
+	// with 0600, both less the umask.
+	FileMode os.FileMode
+	// WALFile is the path of the write-ahead log. It defaults to the
+	// data file path with a ".wal" suffix. It can be on a different device
+	// than the data file. The same WALFile has to be used when reopening
+	// a collection, or an interrupted update can't be recovered.
+	WALFile string
+
+	// Comparator orders keys. It returns a negative number if a sorts
+	// before b, zero if a == b and a positive number otherwise, and it
+	// must only return zero for identical keys. It defaults to byte order.
+	// Ordering is fixed when a data file is created, so ComparatorName,
+	// which identifies the comparator, is stored in the data file. Opening
+	// it with a different ComparatorName fails with ErrComparatorMismatch.
+	// The two must be set together. Functions without Options, like
+	// OpenCollection, use byte order.
+	Comparator     func(a, b string) int
+	ComparatorName string
+
+	// Sync is the durability mode. The default is SyncAlways.
+	Sync SyncMode
+	// SyncPeriod is how often files are synced with SyncInterval.
+	// It defaults to one second.
+	SyncPeriod time.Duration
+
+	// AutoCompact enables compaction in the background once more than
+	// AutoCompactRatio of the data file is taken up by deleted records,
+	// as reported by Stats.DeadBytes. The collection stays open, but
+	// cursors and snapshots created before a compaction return ErrStale.
+	AutoCompact bool
+	// AutoCompactRatio is the fraction of dead bytes that triggers
+	// automatic compaction. It defaults to 0.5.
+	AutoCompactRatio float64
+	// RetainSnapshots makes automatic compaction keep the records that
+	// snapshots from SnapshotAt still see, until Snapshot.Release is
+	// called, so that they stay usable instead of returning ErrStale.
+	// Versions are offsets in the data file, so a retained snapshot gets
+	// a new version in the compacted data file with the same view. The
+	// compacted data file holds the state at the oldest retained version
+	// and a commit with the changes up to each newer one, so each
+	// snapshot costs about the space of the keys changed since the
+	// previous one, and a snapshot that's never released keeps that
+	// space forever. Dead bytes kept this way don't count towards
+	// AutoCompactRatio until the next compaction. Compact, CompactFunc
+	// and Clear still make every snapshot stale.
+	RetainSnapshots bool
+
+	// GroupCommit enables batching of concurrent Update calls so they
+	// share the cost of syncing files. Each batch is still a commit of
+	// its own with a version of its own.
+	GroupCommit bool
+	// GroupCommitWindow is how long the first writer of a group waits
+	// for other writers to join before committing. A zero window only
+	// groups writers that are already waiting.
+	GroupCommitWindow time.Duration
+
+	// MaxFileSize, if set, is the size in bytes the data file isn't
+	// allowed to grow past. An Update that sets keys and would grow it
+	// past MaxFileSize fails with ErrQuotaExceeded and changes nothing.
+	// Updates that only delete keys are always allowed, as is Compact,
+	// so space can be recovered.
+	MaxFileSize int64
+
+	// BlobThreshold, if set, makes Update store values longer than
+	// BlobThreshold bytes out of line, in a blob file named after the
+	// data file with a ".blob" suffix, so that large values don't bloat
+	// the data file and the cache. Records refer to their value by its
+	// offset and length in the blob file, and it's only read when the
+	// value is. Stored values stay readable whatever BlobThreshold is
+	// later opened with. Compact and CompactFunc rewrite the blob file
+	// with the live values, out of line or not by the current
+	// BlobThreshold. Automatic compaction only rewrites the data file and
+	// keeps the blob file as it is, so space taken by deleted values in
+	// it is only reclaimed by Compact. Backup and StreamWAL return
+	// ErrBlobsUnsupported for collections with a blob file.
+	// MaxFileSize doesn't include the blob file.
+	BlobThreshold int
+
+	// IndexCheckpointInterval, if set, keeps a sparse index of the
+	// collection, with a checkpoint for every IndexCheckpointInterval-th
+	// record inserted by Update and every IndexCheckpointInterval-th
+	// record of a data file written by compaction. A checkpoint holds a
+	// record's key and offset, and seeks start from the last checkpoint
+	// before their key when it's further along than the skip list gets
+	// them, which bounds a seek on a cold cache to about
+	// IndexCheckpointInterval reads at level 0. The index is saved by
+	// Close and Checkpoint in a file named after the data file with a
+	// ".index" suffix, and loaded by OpenCollection whatever
+	// IndexCheckpointInterval is. After a crash it may be out of date,
+	// which only makes seeks slower: a checkpoint is only used if the
+	// record at its offset has its key.
+	IndexCheckpointInterval int
+
+	// SeekCachePolicy determines which records read while seeking are
+	// cached. The default, SeekCacheAll, caches all of them, so a seek
+	// into a cold part of a large collection can evict a warm cache.
+	SeekCachePolicy SeekCachePolicy
+	// SeekCacheInterval is how often SeekCacheSampled caches a record.
+	// It defaults to 16.
+	SeekCacheInterval int
+
+	// OpTimeout, if set, is how long reading, writing or syncing the
+	// data file or the WAL may take before the operation fails with
+	// ErrTimeout, so a failing disk doesn't hang Update or Get forever.
+	// Files can't be interrupted, so the operation keeps running in
+	// the background, and a write that timed out may still land; an
+	// Update fails, and is rolled back or leaves the collection
+	// inconsistent like after any other write error.
+	OpTimeout time.Duration
+
+	// ReinitializeEmpty makes OpenCollectionWithOptions create an empty
+	// collection, as NewCollectionWithOptions would, in place of a data
+	// file that's empty or too short to hold a file header, instead of
+	// returning ErrEmptyFile. Such a file has no records to lose, but
+	// it's off by default so that a truncated data file isn't silently
+	// taken for an empty collection.
+	ReinitializeEmpty bool
+
+	// VerifyOnOpen makes OpenCollection run Verify once the collection
+	// is recovered, and fail with its error, so corruption is found at
+	// startup instead of by a later read. Verify reads every linked
+	// record, so it's off by default.
+	VerifyOnOpen bool
+
+	// Logger, if set, is sent messages about internal events.
+	// Nothing is logged by default.
+	Logger Logger
+}
+
+func (o Options) fileMode() os.FileMode {
+	if o.FileMode == 0 {
+		return 0666
+	}
+	return o.FileMode
+}
+
+// seekCaches returns true if the nth record read by a seek, counting
+// from 0, should be cached.
+func (o Options) seekCaches(n int) bool {
+	switch o.SeekCachePolicy {
+	case SeekCacheNone:
+		return false
+	case SeekCacheSampled:
+		interval := o.SeekCacheInterval
+		if interval <= 0 {
+			interval = defaultSeekCacheInterval
+		}
+		return n%interval == 0
+	}
+	return true
+}
+
+func (o Options) comparator() (func(a, b string) int, error) {
+	if (o.Comparator == nil) != (o.ComparatorName == "") {
+		return nil, errors.New("lm2: Comparator and ComparatorName must be set together")
+	}
+	if len(o.ComparatorName) > maxComparatorNameLen {
+		return nil, errors.New("lm2: comparator name too long")
+	}
+	if o.Comparator == nil {
+		return strings.Compare, nil
+	}
+	return o.Comparator, nil
+}
+
+func (o Options) newCache() *recordCache {
+	if o.SharedCache != nil {
+		return o.SharedCache.newCache()
+	}
+	return newCache(o.CacheSize)
+}
+
+func (o Options) walFile(file string) string {
+	if o.WALFile == "" {
+		return file + ".wal"
+	}
+	return o.WALFile
+}
@@ -0,0 +1,99 @@
+package lm2
+
+import "sync/atomic"
+
+// Reader reads a collection through a file handle and locks of its own,
+// so that reads don't contend with the collection's updates or with reads
+// through other Readers. It shares the collection's cache read-only:
+// records cached by the collection are used, but records the Reader reads
+// aren't added. A Reader sees the collection as of the last commit when
+// it was created or last refreshed; Refresh moves it to the latest commit.
+// Cursors keep the view they were created with.
+type Reader struct {
+	source *Collection
+	c      *Collection
+	// generation is the generation of source when the Reader was created.
+	generation uint64
+}
+
+// Reader returns a new Reader for c. It has to be closed when it's no
+// longer needed.
+func (c *Collection) Reader() (*Reader, error) {
+	if c.readOnly {
+		return nil, ErrReadOnly
+	}
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return nil, ErrInternal
+	}
+
+	// The header is only written while metaLock is held.
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	rc, err := openReadOnly(c.f.Name(), Options{
+		Comparator:        c.options.Comparator,
+		ComparatorName:    c.options.ComparatorName,
+		SeekCachePolicy:   c.options.SeekCachePolicy,
+		SeekCacheInterval: c.options.SeekCacheInterval,
+		OpTimeout:         c.options.OpTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	rc.cache.follow(c.cache)
+	return &Reader{
+		source:     c,
+		c:          rc,
+		generation: c.generation,
+	}, nil
+}
+
+// Version returns the version the Reader sees.
+func (r *Reader) Version() int64 {
+	return r.c.Version()
+}
+
+// NewCursor returns a new cursor over the Reader's view of the collection.
+func (r *Reader) NewCursor() (*Cursor, error) {
+	return r.c.NewCursor()
+}
+
+// Get returns the value of key. ErrKeyNotFound is returned if key
+// doesn't exist.
+func (r *Reader) Get(key string) (string, error) {
+	cur, err := r.c.NewCursor()
+	if err != nil {
+		return "", err
+	}
+	return cur.Get(key)
+}
+
+// Refresh moves the Reader to the collection's latest commit.
+// ErrStale is returned if the collection's data file has been
+// rewritten, by compaction or Clear, since the Reader was created; a new
+// Reader has to be created. A compacted data file replaces the old one,
+// which the Reader keeps reading until then, but Clear truncates it,
+// so Readers shouldn't be used across a Clear.
+func (r *Reader) Refresh() error {
+	r.source.metaLock.RLock()
+	defer r.source.metaLock.RUnlock()
+	if r.source.generation != r.generation {
+		return ErrStale
+	}
+
+	r.c.metaLock.Lock()
+	defer r.c.metaLock.Unlock()
+	err := r.c.readFileHeader()
+	if err != nil {
+		atomic.StoreUint32(&r.c.internalState, 1)
+		return err
+	}
+	// The collection's cache may have been reset without rewriting
+	// the data file, which the generation shows it hasn't been.
+	r.c.cache.follow(r.source.cache)
+	return nil
+}
+
+// Close closes the Reader. Cursors created from it can't be used afterwards.
+func (r *Reader) Close() {
+	r.c.Close()
+}
@@ -0,0 +1,132 @@
+package lm2
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// openFiles holds the data files open in this process by absolute path.
+// Two collections writing the same file would each have their own cache
+// and WAL and corrupt it, so only one writable collection can have a file
+// open at a time, in this process and, with an advisory lock, in others.
+// Paths are compared as they are, so a file reached through a symlink
+// or a hard link isn't detected in-process.
+var openFiles = struct {
+	sync.Mutex
+	files map[string]*openFile
+}{files: map[string]*openFile{}}
+
+// openFile is an entry in openFiles.
+type openFile struct {
+	// f holds the advisory lock: exclusive if writer is set, shared
+	// otherwise. It's nil if read-only collections opened the file
+	// while another process held the exclusive lock.
+	f       *os.File
+	writer  bool
+	readers int
+}
+
+// fileLock is a collection's hold on its data file's openFiles entry.
+type fileLock struct {
+	path     string
+	readOnly bool
+}
+
+// acquireFile adds a hold on file to openFiles and takes the advisory
+// lock if this process doesn't hold it yet. flag and perm are used to
+// open the file for locking. A writer gets ErrAlreadyOpen if there's
+// already a writer in this process, and ErrLocked if another process
+// has the file open. Read-only collections share the lock, but they
+// still open the file without it if another process is writing it.
+func acquireFile(file string, readOnly bool, flag int, perm os.FileMode) (*fileLock, error) {
+	path, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+	openFiles.Lock()
+	defer openFiles.Unlock()
+	of := openFiles.files[path]
+	if of == nil {
+		of = &openFile{}
+	}
+	if of.writer && !readOnly {
+		return nil, ErrAlreadyOpen
+	}
+
+	if of.f == nil {
+		f, err := os.OpenFile(path, os.O_RDONLY|flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		err = tryLock(f, !readOnly)
+		if err != nil {
+			f.Close()
+			f = nil
+			if err != ErrLocked || !readOnly {
+				return nil, err
+			}
+		}
+		of.f = f
+	} else if !readOnly {
+		// Only read-only collections have the file open, so the shared
+		// lock is held. Converting it may let another process take it.
+		unlock(of.f)
+		err = tryLock(of.f, true)
+		if err != nil {
+			if tryLock(of.f, false) != nil {
+				of.f.Close()
+				of.f = nil
+			}
+			return nil, err
+		}
+	}
+
+	if readOnly {
+		of.readers++
+	} else {
+		of.writer = true
+	}
+	openFiles.files[path] = of
+	return &fileLock{path: path, readOnly: readOnly}, nil
+}
+
+// release drops the hold, and the advisory lock with the last one.
+func (l *fileLock) release() {
+	openFiles.Lock()
+	defer openFiles.Unlock()
+	of := openFiles.files[l.path]
+	if l.readOnly {
+		of.readers--
+	} else {
+		of.writer = false
+	}
+	if of.writer {
+		return
+	}
+	if of.readers == 0 {
+		if of.f != nil {
+			of.f.Close()
+		}
+		delete(openFiles.files, l.path)
+		return
+	}
+	if !l.readOnly {
+		// Read-only collections are left; keep a shared lock for them.
+		unlock(of.f)
+		if tryLock(of.f, false) != nil {
+			of.f.Close()
+			of.f = nil
+		}
+	}
+}
+
+// replace moves a writer's lock to f, which has to hold the exclusive
+// lock already. It's used when a new data file is renamed over the old one.
+func (l *fileLock) replace(f *os.File) {
+	openFiles.Lock()
+	defer openFiles.Unlock()
+	of := openFiles.files[l.path]
+	of.f.Close()
+	of.f = f
+}
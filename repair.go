@@ -0,0 +1,404 @@
+package lm2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// RepairReport describes what RepairCollection found and fixed.
+type RepairReport struct {
+	// Records is the number of records found in the data file.
+	Records int
+	// BadLinks is the number of Next pointers that were dangling,
+	// out of key order or part of a cycle.
+	BadLinks int
+	// UnlinkedRecords is the number of records that weren't
+	// reachable from the head of the collection.
+	UnlinkedRecords int
+	// DroppedBytes is the number of bytes before the last commit
+	// that couldn't be read as records. They're dropped by a rebuild.
+	DroppedBytes int64
+	// Rebuilt is true if the data file was rebuilt.
+	Rebuilt bool
+	// LiveRecords is the number of records kept by the rebuild.
+	LiveRecords int
+}
+
+// RepairCollection opens the collection at file, recovering from its WAL
+// like OpenCollection, and checks it for inconsistencies. The data file is
+// read record by record, and the Next pointers of every level are checked
+// to link records in key order. If a problem is found, the data file is
+// rebuilt from the most recent record of each key, like Compact, and the
+// rebuilt collection is returned. The report says what was found.
+// cacheSize represents the size of the collection cache.
+func RepairCollection(file string, cacheSize int) (*Collection, *RepairReport, error) {
+	c, err := OpenCollection(file, cacheSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	report := &RepairReport{}
+	latest, err := c.checkRecords(report)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	if report.BadLinks == 0 && report.UnlinkedRecords == 0 && report.DroppedBytes == 0 {
+		return c, report, nil
+	}
+
+	repaired, err := c.writeRepaired(latest, report)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	c.Close()
+	err = os.Rename(repaired, file)
+	if err != nil {
+		os.Remove(repaired)
+		return nil, nil, err
+	}
+	// The rebuilt data file has its values inline and no index.
+	os.Remove(file + ".blob")
+	os.Remove(indexFile(file))
+	report.Rebuilt = true
+	c, err = OpenCollection(file, cacheSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, report, nil
+}
+
+// RecordInfo describes a record in the data file for ScanPhysical
+// and ReadRecordAt.
+type RecordInfo struct {
+	Offset int64
+	// Next holds the offsets of the next record at each level.
+	Next [maxLevels]int64
+	// Deleted is the version at which the record was deleted or
+	// overwritten, or 0.
+	Deleted int64
+	// ExpiresAt is when the record expires in Unix nanoseconds, or 0.
+	ExpiresAt int64
+	Key       string
+	// ValueLen is the length of the value in the data file, which for
+	// a value stored in the blob file is the length of its reference.
+	ValueLen int
+	// Value is only read by ReadRecordAt.
+	Value string
+	// Size is the number of bytes the record takes up in the data file.
+	Size int64
+}
+
+// recordInfo returns the RecordInfo of rec without its value.
+func recordInfo(rec *record) RecordInfo {
+	info := RecordInfo{
+		Offset:    rec.Offset,
+		Deleted:   atomic.LoadInt64(&rec.Deleted),
+		ExpiresAt: rec.ExpiresAt,
+		Key:       rec.Key,
+		ValueLen:  int(rec.ValLen),
+		Size:      int64(rec.size()),
+	}
+	for i := range info.Next {
+		info.Next[i] = atomic.LoadInt64(&rec.Next[i])
+	}
+	return info
+}
+
+// ScanPhysical calls fn with each record in the data file in offset order,
+// up to the version the collection had when ScanPhysical was called, until
+// fn returns false. Deleted and overwritten records are included; commit
+// sentinels are skipped. Update writes a copy of a record for each of its
+// levels above 0, and only the first copy is linked. It's meant for
+// inspecting the data file, so values aren't read. ErrStale is returned
+// if the data file is rewritten during the scan.
+func (c *Collection) ScanPhysical(fn func(offset int64, rec RecordInfo) bool) error {
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return ErrInternal
+	}
+
+	c.metaLock.RLock()
+	end := c.LastCommit
+	generation := c.generation
+	offset := c.firstRecord
+	c.metaLock.RUnlock()
+
+	for offset < end {
+		c.metaLock.RLock()
+		if c.generation != generation {
+			c.metaLock.RUnlock()
+			return ErrStale
+		}
+		rec, next, err := c.readPhysical(offset)
+		info := RecordInfo{}
+		if rec != nil {
+			info = recordInfo(rec)
+		}
+		c.metaLock.RUnlock()
+		if err != nil {
+			return fmt.Errorf("lm2: record at offset %d: %v", offset, err)
+		}
+
+		if rec != nil && !fn(offset, info) {
+			return nil
+		}
+		offset = next
+	}
+	return nil
+}
+
+// Tombstones returns the number of deleted and overwritten records still
+// in the data file and the bytes they take up, by scanning it with
+// ScanPhysical. Unlike Stats.DeadBytes, it's exact for any data file,
+// but it reads the whole file. Updates can continue during the scan.
+func (c *Collection) Tombstones() (count int64, bytes int64, err error) {
+	err = c.ScanPhysical(func(offset int64, rec RecordInfo) bool {
+		if rec.Deleted != 0 {
+			count++
+			bytes += rec.Size
+		}
+		return true
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return count, bytes, nil
+}
+
+// ReadRecordAt reads the record that starts at offset in the data file,
+// such as an offset passed to ScanPhysical or a link in RecordInfo.Next,
+// with its value. It's meant for inspection tools, so the cache is
+// neither used nor changed. ErrInvalidOffset is returned if offset is
+// outside the committed records or is a commit sentinel. An offset
+// inside a record usually fails with ErrCorruptRecord, but it isn't
+// guaranteed to be detected.
+func (c *Collection) ReadRecordAt(offset int64) (RecordInfo, error) {
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return RecordInfo{}, ErrInternal
+	}
+
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	if offset < c.firstRecord || offset >= c.LastCommit {
+		return RecordInfo{}, ErrInvalidOffset
+	}
+	rec, _, err := c.readPhysical(offset)
+	if err != nil {
+		return RecordInfo{}, err
+	}
+	if rec == nil {
+		return RecordInfo{}, ErrInvalidOffset
+	}
+	value := make([]byte, int(rec.ValLen))
+	n, err := c.readAt(value, rec.dataOffset()+int64(rec.KeyLen))
+	if err != nil && n != len(value) {
+		return RecordInfo{}, Error{Op: "read record value", Offset: offset, Err: err}
+	}
+	if rec.Flags&recordFlagBlob != 0 {
+		value, err = c.readBlobInto(value, 0)
+		if err != nil {
+			return RecordInfo{}, err
+		}
+	}
+	info := recordInfo(rec)
+	info.Value = string(value)
+	return info, nil
+}
+
+// readPhysical reads the record or sentinel at offset, which has to be
+// the start of one, and returns the offset after it. The record is nil
+// for a sentinel. Values aren't read. metaLock must be held.
+func (c *Collection) readPhysical(offset int64) (*record, int64, error) {
+	sentinelBytes := [12]byte{}
+	n, _ := c.readAt(sentinelBytes[:], offset)
+	if n == len(sentinelBytes) &&
+		binary.LittleEndian.Uint32(sentinelBytes[:4]) == sentinelMagic &&
+		int64(binary.LittleEndian.Uint64(sentinelBytes[4:])) == offset {
+		return nil, offset + int64(len(sentinelBytes)), nil
+	}
+
+	rec, err := c.readRecordHeader(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	keyBuf := make([]byte, int(rec.KeyLen))
+	n, err = c.readAt(keyBuf, rec.dataOffset())
+	if err != nil && n != len(keyBuf) {
+		return nil, 0, Error{Op: "read record key", Offset: offset, Err: err}
+	}
+	rec.Key = string(keyBuf)
+	return rec, offset + int64(rec.size()), nil
+}
+
+// checkRecords reads every record in the data file and checks the
+// links between them, filling in report. It returns the offset of the
+// most recent record of each key.
+func (c *Collection) checkRecords(report *RepairReport) (map[string]int64, error) {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+
+	// Commits end with a sentinel, so the data between
+	// firstRecord and LastCommit is records and sentinels.
+	records := map[int64]*record{}
+	latest := map[string]int64{}
+	offset := c.firstRecord
+	var prev *record
+	for offset < c.LastCommit {
+		rec, next, err := c.readPhysical(offset)
+		if err != nil {
+			// Nothing after this can be trusted to be a record.
+			report.DroppedBytes = c.LastCommit - offset
+			break
+		}
+		offset = next
+		if rec == nil {
+			// A sentinel ends each commit.
+			prev = nil
+			continue
+		}
+		if prev != nil && prev.Key == rec.Key {
+			// Update writes a copy of a record for each of its levels
+			// above 0. Only the first copy is linked. Keys are unique
+			// within a commit, so this isn't a newer record.
+			continue
+		}
+		records[rec.Offset] = rec
+		latest[rec.Key] = rec.Offset
+		prev = rec
+	}
+	report.Records = len(records)
+
+	linked := map[int64]bool{}
+	for level := 0; level < maxLevels; level++ {
+		visited := map[int64]bool{}
+		var prev *record
+		next := c.Next[level]
+		for next != 0 {
+			rec := records[next]
+			if rec == nil || visited[next] || (prev != nil && c.compare(rec.Key, prev.Key) < 0) {
+				report.BadLinks++
+				break
+			}
+			visited[next] = true
+			if level == 0 {
+				linked[next] = true
+			}
+			prev = rec
+			next = atomic.LoadInt64(&rec.Next[level])
+		}
+	}
+	report.UnlinkedRecords = len(records) - len(linked)
+	return latest, nil
+}
+
+// writeRepaired writes the live records among latest to a new data file
+// next to the current one and returns its name.
+func (c *Collection) writeRepaired(latest map[string]int64, report *RepairReport) (string, error) {
+	newCollection, err := NewCollectionWithOptions(c.f.Name()+".repair", Options{
+		CacheSize:      10,
+		FileMode:       c.options.FileMode,
+		Comparator:     c.options.Comparator,
+		ComparatorName: c.options.ComparatorName,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	keys := make([]string, 0, len(latest))
+	for key := range latest {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return c.compare(keys[i], keys[j]) < 0
+	})
+
+	const batchSize = 1000
+	wb := NewWriteBatch()
+	for i, key := range keys {
+		c.metaLock.RLock()
+		rec, err := c.readRecord(latest[key], false)
+		c.metaLock.RUnlock()
+		value := ""
+		if err == nil {
+			value, err = c.recordValue(rec)
+		}
+		if err != nil {
+			newCollection.Destroy()
+			return "", err
+		}
+		deleted := atomic.LoadInt64(&rec.Deleted)
+		if (deleted == 0 || deleted > c.LastCommit) && !rec.expired() {
+			if rec.ExpiresAt != 0 {
+				wb.setExpiresAt(rec.Key, value, rec.ExpiresAt)
+			} else {
+				wb.Set(rec.Key, value)
+			}
+			report.LiveRecords++
+		}
+
+		if wb.Len() == batchSize || i == len(keys)-1 {
+			if wb.Len() > 0 {
+				_, err = newCollection.Update(wb)
+				if err != nil {
+					newCollection.Destroy()
+					return "", err
+				}
+			}
+			wb = NewWriteBatch()
+		}
+	}
+	newCollection.Close()
+	return newCollection.f.Name(), nil
+}
+
+// Verify checks that every level of the collection links records in key
+// order, that live keys are unique, and that every linked record lies
+// within the committed part of the data file and can be read. The first
+// problem found is returned, naming the offset of the bad record.
+// Updates wait for Verify to finish.
+func (c *Collection) Verify() error {
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return ErrInternal
+	}
+
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	// Every record is at least a header long, so a longer chain has a cycle.
+	maxRecords := (c.LastCommit - c.firstRecord) / recordHeaderSize
+	for level := 0; level < maxLevels; level++ {
+		var prev, prevLive *record
+		next := atomic.LoadInt64(&c.Next[level])
+		for count := int64(0); next != 0; count++ {
+			if count > maxRecords {
+				return fmt.Errorf("lm2: verify: level %d has a cycle", level)
+			}
+			if next < c.firstRecord || next >= c.LastCommit {
+				return fmt.Errorf("lm2: verify: level %d links to offset %d outside the committed region",
+					level, next)
+			}
+			rec, err := c.readRecordKey(next)
+			if err != nil {
+				return fmt.Errorf("lm2: verify: record at offset %d: %v", next, err)
+			}
+			if prev != nil && c.compare(rec.Key, prev.Key) < 0 {
+				return fmt.Errorf("lm2: verify: record at offset %d with key %q follows %q at level %d",
+					next, rec.Key, prev.Key, level)
+			}
+			deleted := atomic.LoadInt64(&rec.Deleted)
+			if deleted == 0 || deleted > c.LastCommit {
+				if prevLive != nil && rec.Key == prevLive.Key {
+					return fmt.Errorf("lm2: verify: record at offset %d has the same key %q as live record at offset %d",
+						next, rec.Key, prevLive.Offset)
+				}
+				prevLive = rec
+			}
+			prev = rec
+			next = atomic.LoadInt64(&rec.Next[level])
+		}
+	}
+	return nil
+}
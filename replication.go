@@ -0,0 +1,285 @@
+package lm2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const shipmentMagic = 0x4C4D3253 // "LM2S"
+
+// maxShipments is the number of recent commits kept for WAL streams
+// that have fallen behind.
+const maxShipments = 64
+
+// ErrWALGap is returned when a WAL stream can't continue from the
+// requested version, either because the commits after it are no longer
+// available or because a follower received a commit that doesn't
+// follow its last commit.
+var ErrWALGap = errors.New("lm2: gap in WAL stream")
+
+// shipmentHeader precedes each commit in a WAL stream. From is the
+// version the commit applies to and To is the version it creates.
+// DataLen bytes of data follow the header, to be written at From,
+// followed by the commit's WAL entry.
+type shipmentHeader struct {
+	Magic   uint32
+	From    int64
+	To      int64
+	DataLen int64
+}
+
+type shipment struct {
+	from  int64
+	to    int64
+	bytes []byte
+}
+
+// walShipper keeps recent commits for StreamWAL.
+type walShipper struct {
+	lock      sync.Mutex
+	streams   int32
+	shipments []shipment
+	// notify is closed when a commit is published.
+	notify chan struct{}
+}
+
+// active returns true if a WAL stream is running.
+func (s *walShipper) active() bool {
+	return atomic.LoadInt32(&s.streams) > 0
+}
+
+func (s *walShipper) publish(sh shipment) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.shipments = append(s.shipments, sh)
+	if len(s.shipments) > maxShipments {
+		s.shipments = s.shipments[len(s.shipments)-maxShipments:]
+	}
+	if s.notify != nil {
+		close(s.notify)
+		s.notify = nil
+	}
+}
+
+// reset drops the kept commits.
+func (s *walShipper) reset() {
+	s.lock.Lock()
+	s.shipments = nil
+	s.lock.Unlock()
+}
+
+// next returns the shipment that applies to version from, if there is one,
+// and a channel that's closed when the next commit is published.
+func (s *walShipper) next(from int64) (*shipment, chan struct{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := range s.shipments {
+		if s.shipments[i].from == from {
+			sh := s.shipments[i]
+			return &sh, nil
+		}
+	}
+	if s.notify == nil {
+		s.notify = make(chan struct{})
+	}
+	return nil, s.notify
+}
+
+// shipCommit publishes a commit that appended data to the data file
+// between from and to and rewrote the headers in entry. It's called
+// while applying the commit, after the WAL entry has been written to
+// the data file, with metaLock held. If the appended data can't be read
+// the commit isn't published, and streams waiting for it get ErrWALGap.
+func (c *Collection) shipCommit(from, to int64, entry *walEntry) {
+	data := make([]byte, int(to-from))
+	n, err := c.readAt(data, from)
+	if err != nil && n != len(data) {
+		return
+	}
+
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.LittleEndian, shipmentHeader{
+		Magic:   shipmentMagic,
+		From:    from,
+		To:      to,
+		DataLen: int64(len(data)),
+	})
+	buf.Write(data)
+	buf.Write(entry.Bytes())
+	c.shipper.publish(shipment{
+		from:  from,
+		to:    to,
+		bytes: buf.Bytes(),
+	})
+}
+
+// StreamWAL writes the commits made after version from to w, in order,
+// until the collection is closed or writing to w fails. Commits made
+// before the collection is closed are written before it returns. Commits that
+// haven't happened yet are written as they're made.
+//
+// Only the most recent commits are kept for streams. Commits are only kept
+// while a stream is running, so from must be at least the version the
+// collection had when the first stream started. ErrWALGap is returned if
+// the commit after from isn't available; the follower has to be reseeded
+// with a copy of the data file. Compaction rewrites the data file, so it
+// always breaks the stream. Commits don't carry values stored in the blob
+// file, so ErrBlobsUnsupported is returned if the collection has one.
+func (c *Collection) StreamWAL(from int64, w io.Writer) error {
+	if c.hasBlobs() {
+		return ErrBlobsUnsupported
+	}
+	// Commits are published while metaLock is held, so every commit
+	// after this one is kept.
+	c.metaLock.RLock()
+	atomic.AddInt32(&c.shipper.streams, 1)
+	c.metaLock.RUnlock()
+	defer atomic.AddInt32(&c.shipper.streams, -1)
+
+	for {
+		sh, notify := c.shipper.next(from)
+		if sh != nil {
+			_, err := w.Write(sh.bytes)
+			if err != nil {
+				return err
+			}
+			from = sh.to
+			continue
+		}
+
+		select {
+		case <-c.closed:
+			// Everything committed before closing has been written.
+			return nil
+		default:
+		}
+		if atomic.LoadUint32(&c.internalState) != 0 {
+			return ErrInternal
+		}
+
+		if from != c.Version() {
+			// The commit may have been published while
+			// checking the version.
+			if sh, _ = c.shipper.next(from); sh == nil {
+				return ErrWALGap
+			}
+			continue
+		}
+
+		select {
+		case <-notify:
+		case <-c.closed:
+			return nil
+		}
+	}
+}
+
+// ApplyWALStream applies commits read from r, as written by StreamWAL on
+// another collection, until r returns io.EOF. The collection has to start
+// out as a copy of the streaming collection's data file at the version
+// passed to StreamWAL, and it shouldn't be updated in any other way.
+// Each commit is checked to apply to the collection's current version;
+// ErrWALGap is returned if it doesn't. Commits are applied with the same
+// WAL protocol as Update, so a follower is recoverable after a crash.
+func (c *Collection) ApplyWALStream(r io.Reader) error {
+	for {
+		header := shipmentHeader{}
+		err := binary.Read(r, binary.LittleEndian, &header)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Magic != shipmentMagic {
+			return errors.New("lm2: invalid WAL stream magic")
+		}
+		data := make([]byte, int(header.DataLen))
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return err
+		}
+		entry, err := readWALEntry(r)
+		if err != nil {
+			return err
+		}
+
+		err = c.applyShipment(header, data, entry)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Collection) applyShipment(header shipmentHeader, data []byte, entry *walEntry) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return ErrInternal
+	}
+	if header.From != c.LastCommit || header.To != header.From+int64(len(data)) {
+		return ErrWALGap
+	}
+
+	newHeader := fileHeader{}
+	offsets := []int64{}
+	for _, walRec := range entry.records {
+		if walRec.Offset == 0 {
+			var err error
+			newHeader, err = decodeFileHeader(walRec.Data)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		offsets = append(offsets, walRec.Offset)
+	}
+	if newHeader.LastCommit != header.To {
+		return errors.New("lm2: WAL stream entry doesn't match its commit")
+	}
+
+	// Like Update, append the data and log the header changes
+	// before touching anything readers can see.
+	_, err := c.f.WriteAt(data, header.From)
+	if err == nil {
+		err = c.syncData()
+	}
+	if err == nil {
+		_, err = c.wal.Append(entry)
+	}
+	if err != nil {
+		c.wal.Truncate()
+		c.f.Truncate(c.LastCommit)
+		return err
+	}
+
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+	for _, walRec := range entry.records {
+		_, err := c.writeAt(walRec.Data, walRec.Offset)
+		if err != nil {
+			return c.markInconsistent(Error{Op: "write", Offset: walRec.Offset, Err: err})
+		}
+	}
+	err = c.syncData()
+	if err != nil {
+		return c.markInconsistent(err)
+	}
+
+	c.cache.flushOffsets(offsets)
+	c.LastCommit = newHeader.LastCommit
+	c.DeadBytes = newHeader.DeadBytes
+	for i, v := range newHeader.Next {
+		atomic.StoreInt64(&c.fileHeader.Next[i], v)
+	}
+	c.lastCommitInfo = entry.commitInfo(c.LastCommit)
+	return nil
+}
@@ -0,0 +1,141 @@
+package lm2
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// Snapshot is a read-only view of a collection as of a
+// committed version.
+type Snapshot struct {
+	collection *Collection
+	// version and generation are changed by compaction if the snapshot
+	// is retained. They're protected by the collection's metaLock.
+	version    int64
+	generation uint64
+}
+
+// SnapshotAt returns a read-only view of the collection at version.
+// A record is visible in the snapshot if it was created at or before
+// version and was not deleted at or before version. version is usually
+// a value returned by Update or Version. ErrInvalidVersion is returned
+// if version is newer than the last committed version.
+//
+// Snapshots rely on deleted records still being present in the data
+// file. Compaction rewrites the collection without deleted records,
+// so it must not run while a snapshot that can still see them is in use,
+// or the snapshot returns ErrStale. With Options.RetainSnapshots,
+// automatic compaction keeps what the collection's snapshots see until
+// they're released.
+func (c *Collection) SnapshotAt(version int64) (*Snapshot, error) {
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return nil, ErrInternal
+	}
+
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	if version > c.LastCommit || version < 0 {
+		return nil, ErrInvalidVersion
+	}
+	s := &Snapshot{
+		collection: c,
+		version:    version,
+		generation: c.generation,
+	}
+	if c.options.RetainSnapshots {
+		c.snapshotLock.Lock()
+		if c.snapshots == nil {
+			c.snapshots = map[*Snapshot]struct{}{}
+		}
+		c.snapshots[s] = struct{}{}
+		c.snapshotLock.Unlock()
+	}
+	return s, nil
+}
+
+// Version returns the version the snapshot was taken at. Versions are
+// offsets in the data file, so if compaction retains the snapshot, it
+// gets the version in the compacted data file that has the same view.
+func (s *Snapshot) Version() int64 {
+	s.collection.metaLock.RLock()
+	defer s.collection.metaLock.RUnlock()
+	return s.version
+}
+
+// Release lets compaction drop the records that only the snapshot sees.
+// It only matters with Options.RetainSnapshots. The snapshot can still be
+// used until the next compaction, which makes it return ErrStale.
+func (s *Snapshot) Release() {
+	c := s.collection
+	c.snapshotLock.Lock()
+	delete(c.snapshots, s)
+	c.snapshotLock.Unlock()
+}
+
+// retainedSnapshots returns the snapshots that compaction has to keep,
+// which are those that haven't been released or made stale, and their
+// distinct versions before the last commit in ascending order.
+// writeLock must be held.
+func (c *Collection) retainedSnapshots() ([]*Snapshot, []int64) {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	c.snapshotLock.Lock()
+	defer c.snapshotLock.Unlock()
+	snapshots := []*Snapshot{}
+	seen := map[int64]bool{}
+	versions := []int64{}
+	for s := range c.snapshots {
+		if s.generation != c.generation {
+			delete(c.snapshots, s)
+			continue
+		}
+		snapshots = append(snapshots, s)
+		if s.version < c.LastCommit && !seen[s.version] {
+			seen[s.version] = true
+			versions = append(versions, s.version)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return snapshots, versions
+}
+
+// remapSnapshots moves snapshots to the compacted data file, which has
+// the new versions of retain in versions and its last commit in place of
+// lastCommit. metaLock must be held.
+func (c *Collection) remapSnapshots(snapshots []*Snapshot, lastCommit int64, retain, versions []int64) {
+	for _, s := range snapshots {
+		if s.version == lastCommit {
+			s.version = c.LastCommit
+		} else {
+			s.version = versions[sort.Search(len(retain), func(i int) bool {
+				return retain[i] >= s.version
+			})]
+		}
+		s.generation = c.generation
+	}
+}
+
+// NewCursor returns a new cursor over the snapshot.
+func (s *Snapshot) NewCursor() (*Cursor, error) {
+	c := s.collection
+	if atomic.LoadUint32(&c.internalState) != 0 {
+		return nil, ErrInternal
+	}
+
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	if s.generation != c.generation {
+		return nil, ErrStale
+	}
+	return c.newCursor(s.version)
+}
+
+// Get returns the value of key as of the snapshot version.
+// ErrKeyNotFound is returned if the key is not visible in the snapshot.
+func (s *Snapshot) Get(key string) (string, error) {
+	cur, err := s.NewCursor()
+	if err != nil {
+		return "", err
+	}
+	return cur.Get(key)
+}
@@ -0,0 +1,207 @@
+package lm2
+
+import "testing"
+
+func TestSnapshotAt(t *testing.T) {
+	c, err := NewCollection("/tmp/test_snapshotat.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	initial := c.Version()
+
+	wb := NewWriteBatch()
+	wb.Set("key1", "1")
+	wb.Set("key2", "1")
+	v1, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wb = NewWriteBatch()
+	wb.Set("key1", "2")
+	wb.Delete("key2")
+	wb.Set("key3", "2")
+	v2, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := c.SnapshotAt(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := snap.Get("key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "1" {
+		t.Errorf("expected key1 to be %s at v1, got %s", "1", val)
+	}
+	val, err = snap.Get("key2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "1" {
+		t.Errorf("expected key2 to be %s at v1, got %s", "1", val)
+	}
+	if _, err = snap.Get("key3"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound for key3 at v1, got %v", err)
+	}
+
+	expected := [][2]string{
+		{"key1", "2"},
+		{"key3", "2"},
+	}
+	snap, err = c.SnapshotAt(v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur, err := snap.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := 0
+	for cur.Next() {
+		if i == len(expected) {
+			t.Fatal("unexpected key", cur.Key())
+		}
+		if cur.Key() != expected[i][0] || cur.Value() != expected[i][1] {
+			t.Errorf("expected %v => %v, got %v => %v",
+				expected[i][0], expected[i][1], cur.Key(), cur.Value())
+		}
+		i++
+	}
+	if err = cur.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != len(expected) {
+		t.Errorf("expected %d records, got %d", len(expected), i)
+	}
+
+	snap, err = c.SnapshotAt(initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur, err = snap.NewCursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cur.Next() {
+		t.Error("unexpected key", cur.Key())
+	}
+	if err = cur.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = c.SnapshotAt(v2 + 1); err != ErrInvalidVersion {
+		t.Errorf("expected ErrInvalidVersion, got %v", err)
+	}
+}
+
+func TestSnapshotRetainedByCompaction(t *testing.T) {
+	c, err := NewCollectionWithOptions("/tmp/test_snapshotretained.lm2", Options{
+		CacheSize:       100,
+		RetainSnapshots: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	compact := func() {
+		t.Helper()
+		c.writeLock.Lock()
+		_, err := c.compactOnline(nil)
+		c.writeLock.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(get func(string) (string, error), expected map[string]string) {
+		t.Helper()
+		for _, key := range []string{"key1", "key2", "key3"} {
+			val, err := get(key)
+			if want, ok := expected[key]; !ok {
+				if err != ErrKeyNotFound {
+					t.Errorf("expected %s to be missing, got %q (%v)", key, val, err)
+				}
+			} else if err != nil || val != want {
+				t.Errorf("expected %s to be %s, got %q (%v)", key, want, val, err)
+			}
+		}
+	}
+	current := func(key string) (string, error) {
+		cur, err := c.NewCursor()
+		if err != nil {
+			return "", err
+		}
+		return cur.Get(key)
+	}
+
+	wb := NewWriteBatch()
+	wb.Set("key1", "1")
+	wb.Set("key2", "1")
+	v1, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Set("key1", "2")
+	wb.Delete("key2")
+	wb.Set("key3", "2")
+	v2, err := c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap1, err := c.SnapshotAt(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap2, err := c.SnapshotAt(v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb = NewWriteBatch()
+	wb.Set("key1", "3")
+	wb.Delete("key3")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unretained, err := c.SnapshotAt(v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unretained.Release()
+
+	compact()
+	check(snap1.Get, map[string]string{"key1": "1", "key2": "1"})
+	check(snap2.Get, map[string]string{"key1": "2", "key3": "2"})
+	check(current, map[string]string{"key1": "3"})
+	if _, err = unretained.Get("key1"); err != ErrStale {
+		t.Errorf("expected ErrStale for a released snapshot, got %v", err)
+	}
+	if snap1.Version() >= snap2.Version() || snap2.Version() >= c.Version() {
+		t.Errorf("expected versions %d < %d < %d", snap1.Version(), snap2.Version(), c.Version())
+	}
+	if c.DeadBytes == 0 {
+		t.Error("expected the retained records to be dead bytes")
+	}
+
+	// Retained snapshots survive another compaction, and once they're
+	// released the space is reclaimed.
+	compact()
+	check(snap1.Get, map[string]string{"key1": "1", "key2": "1"})
+	snap1.Release()
+	snap2.Release()
+	compact()
+	if _, err = snap1.Get("key1"); err != ErrStale {
+		t.Errorf("expected ErrStale after release, got %v", err)
+	}
+	if c.DeadBytes != 0 {
+		t.Errorf("expected no dead bytes, got %d", c.DeadBytes)
+	}
+	check(current, map[string]string{"key1": "3"})
+}
@@ -1,13 +1,48 @@
 package lm2
 
-import "sync/atomic"
+import (
+	"os"
+	"sync/atomic"
+	"time"
+)
 
 // Stats holds collection statistics.
+// Counters are updated atomically, so Collection.Stats can be called
+// while the collection is in use. Each counter is read on its own, so a
+// record read that's in progress may be counted in RecordsRead but not
+// yet in CacheHits or CacheMisses.
 type Stats struct {
 	RecordsWritten uint64
 	RecordsRead    uint64
 	CacheHits      uint64
 	CacheMisses    uint64
+
+	// DeadBytes is the space taken up by deleted and overwritten records,
+	// which compaction would reclaim. It's stored in the data file header
+	// and reset by compaction. Data files created before it was stored
+	// only count records deleted since the collection was opened.
+	DeadBytes uint64
+	// ExpiredRecords is the number of expired records deleted by
+	// the expirer since the collection was opened.
+	ExpiredRecords uint64
+	// SetsElided is the number of SetIfChanged keys that Updates
+	// skipped because their value was unchanged.
+	SetsElided uint64
+
+	// DataFileSize is the size of the data file in bytes.
+	DataFileSize int64
+	// WALSize is the size of the WAL in bytes. The WAL only holds the
+	// most recent commit's header changes, so it stays small.
+	WALSize int64
+	// CacheRecords is the number of records in the cache.
+	CacheRecords int
+
+	// LastAutoCompaction is when the last automatic compaction
+	// finished, or the zero time if there hasn't been one.
+	LastAutoCompaction time.Time
+	// AutoCompactReclaimed is the number of bytes the last automatic
+	// compaction reclaimed.
+	AutoCompactReclaimed int64
 }
 
 func (s *Stats) incRecordsWritten(count uint64) {
@@ -26,11 +61,64 @@ func (s *Stats) incCacheMisses(count uint64) {
 	atomic.AddUint64(&s.CacheMisses, count)
 }
 
+func (s *Stats) incExpiredRecords(count uint64) {
+	atomic.AddUint64(&s.ExpiredRecords, count)
+}
+
+func (s *Stats) incSetsElided(count uint64) {
+	atomic.AddUint64(&s.SetsElided, count)
+}
+
 func (s *Stats) clone() Stats {
 	return Stats{
 		RecordsWritten: atomic.LoadUint64(&s.RecordsWritten),
 		RecordsRead:    atomic.LoadUint64(&s.RecordsRead),
 		CacheHits:      atomic.LoadUint64(&s.CacheHits),
 		CacheMisses:    atomic.LoadUint64(&s.CacheMisses),
+		ExpiredRecords: atomic.LoadUint64(&s.ExpiredRecords),
+		SetsElided:     atomic.LoadUint64(&s.SetsElided),
+	}
+}
+
+// FileInfo holds the paths and sizes in bytes of a collection's files.
+// The path of a file the collection doesn't have is empty, and its
+// size is 0. There's no cache file; the cache is only kept in memory.
+type FileInfo struct {
+	// DataFile is the path the collection was opened with.
+	DataFile string
+	DataSize int64
+	// WALFile is set by Options.WALFile. Read-only collections
+	// don't have a WAL.
+	WALFile string
+	WALSize int64
+	// BlobFile holds values stored out of line by Options.BlobThreshold.
+	BlobFile string
+	BlobSize int64
+	// IndexFile holds the sparse index kept with
+	// Options.IndexCheckpointInterval, as it was last saved.
+	IndexFile string
+	IndexSize int64
+}
+
+// Files returns the paths and current sizes of the collection's files.
+// Like Stats, it doesn't block updates, and a size that can't be read
+// is left at 0.
+func (c *Collection) Files() FileInfo {
+	info := FileInfo{DataFile: c.file}
+	if fi, err := c.dataFile().Stat(); err == nil {
+		info.DataSize = fi.Size()
+	}
+	if f := c.walFile(); f != nil {
+		info.WALFile = f.Name()
+		if fi, err := f.Stat(); err == nil {
+			info.WALSize = fi.Size()
+		}
+	}
+	if fi, err := os.Stat(c.blobs.name); err == nil {
+		info.BlobFile, info.BlobSize = c.blobs.name, fi.Size()
+	}
+	if fi, err := os.Stat(indexFile(c.file)); err == nil {
+		info.IndexFile, info.IndexSize = indexFile(c.file), fi.Size()
 	}
+	return info
 }
@@ -148,7 +148,7 @@ func TestTransactionalSquares(t *testing.T) {
 			for j := 0; j < count; j++ {
 				err := txCol.View(verifySquares)
 				if err != nil {
-					if err.Error() == "lm2: partial read (random failure)" {
+					if errors.Is(err, errRandomFailure) {
 						atomic.AddUint32(&expectedReadFailures, 1)
 					} else {
 						t.Fatal(err)
@@ -169,7 +169,7 @@ func TestTransactionalSquares(t *testing.T) {
 					return nil
 				})
 				if err != nil {
-					if !IsRollbackError(err) && err.Error() != "lm2: partial read (random failure)" {
+					if !IsRollbackError(err) && !errors.Is(err, errRandomFailure) {
 						t.Fatal(err)
 					} else {
 						atomic.AddUint32(&expectedWriteFailures, 1)
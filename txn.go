@@ -0,0 +1,481 @@
+package lm2
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// txnLogMagic starts the transaction log of an UpdateAll, which is
+	// written next to the data file of its first collection.
+	txnLogMagic = sentinelMagic + 2
+	// txnMarkerMagic starts the files that point the other collections
+	// of an UpdateAll to its transaction log.
+	txnMarkerMagic = sentinelMagic + 3
+)
+
+var (
+	errUpdateAllAborted = errors.New("lm2: UpdateAll aborted")
+	errCorruptTxnFile   = errors.New("lm2: corrupt transaction file")
+	errBadChecksum      = errors.New("lm2: bad checksum")
+)
+
+// CollectionUpdate is a WriteBatch to apply to a collection with UpdateAll.
+type CollectionUpdate struct {
+	Collection *Collection
+	Batch      *WriteBatch
+}
+
+// UpdateAll applies each batch to its collection, so that after a crash
+// either every update has been applied or none has. It returns the new
+// versions of the collections, in the order of updates.
+//
+// The batches are first written to the data files, and every collection
+// waits while the others are. Then a transaction log with the WAL entries
+// of all of them is written and synced next to the data file of the first
+// collection by file name, and each collection gets a ".txn" file pointing
+// to it. The transaction log is the commit point: once it's written, each
+// collection writes its WAL entry and applies it as Update does, and the
+// ".txn" files are removed at the end. If there's a crash, opening any of
+// the collections with OpenCollection completes the transaction, by
+// writing the missing WAL entries from the transaction log, or discards it
+// if the log wasn't written, before the collection is opened.
+//
+// Collections are updated in file name order to avoid deadlocks between
+// concurrent calls. With SyncNever or SyncInterval the batches may be
+// lost after an operating system crash, but they're still lost together.
+// Readers see each collection's update as soon as it's applied, so they
+// can see one collection updated before the other. In the same way,
+// OpenCollectionReadOnly doesn't complete an interrupted transaction.
+//
+// If a batch can't be written, the others are rolled back and the error
+// is returned. If an error happens after the commit point, the collection
+// that failed is left inconsistent and has to be reopened, which
+// completes its update.
+func UpdateAll(updates []CollectionUpdate) ([]int64, error) {
+	order := make([]int, len(updates))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return updates[order[i]].Collection.file < updates[order[j]].Collection.file
+	})
+	for i := range order {
+		c := updates[order[i]].Collection
+		if c.readOnly {
+			return nil, ErrReadOnly
+		}
+		if i > 0 && c.file == updates[order[i-1]].Collection.file {
+			return nil, errors.New("lm2: UpdateAll got the same collection twice")
+		}
+	}
+
+	type participant struct {
+		c *Collection
+		// ready is closed once the update is written, and decision
+		// then tells it to commit or roll back.
+		ready    chan struct{}
+		decision chan error
+		done     chan struct{}
+		prepared bool
+		entry    []byte
+		base     int64
+		end      int64
+		version  int64
+		err      error
+	}
+	participants := []*participant{}
+	finish := func(err error) []int64 {
+		for _, p := range participants {
+			if p.prepared {
+				p.decision <- err
+			}
+		}
+		versions := make([]int64, len(updates))
+		for i, p := range participants {
+			<-p.done
+			versions[order[i]] = p.version
+		}
+		return versions
+	}
+
+	for _, i := range order {
+		p := &participant{
+			c:        updates[i].Collection,
+			ready:    make(chan struct{}),
+			decision: make(chan error),
+			done:     make(chan struct{}),
+		}
+		wb := updates[i].Batch.Clone()
+		wb.prepared = func(entry *walEntry, base, end int64) error {
+			p.entry = entry.Bytes()
+			p.base, p.end = base, end
+			close(p.ready)
+			return <-p.decision
+		}
+		participants = append(participants, p)
+		go func() {
+			p.version, p.err = p.c.update(context.Background(), wb)
+			close(p.done)
+		}()
+
+		select {
+		case <-p.ready:
+			p.prepared = true
+		case <-p.done:
+			if p.err != nil {
+				finish(errUpdateAllAborted)
+				return nil, p.err
+			}
+		}
+	}
+
+	prepared := []*participant{}
+	for _, p := range participants {
+		if p.prepared {
+			prepared = append(prepared, p)
+		}
+	}
+	// A single update is atomic without a transaction log.
+	var files []string
+	if len(prepared) > 1 {
+		log := &txnLog{id: rand.Uint64()}
+		for _, p := range prepared {
+			log.participants = append(log.participants, txnParticipant{
+				file:  absPath(p.c.file),
+				wal:   absPath(p.c.wal.f.Name()),
+				base:  p.base,
+				end:   p.end,
+				entry: p.entry,
+			})
+		}
+		var err error
+		files, err = log.write()
+		if err != nil {
+			finish(errUpdateAllAborted)
+			return nil, err
+		}
+	}
+
+	versions := finish(nil)
+	for _, p := range participants {
+		if p.err != nil {
+			// The transaction log is kept to complete the update.
+			return versions, fmt.Errorf("lm2: UpdateAll couldn't apply its update to %s: %w", p.c.file, p.err)
+		}
+	}
+	removeAll(files)
+	return versions, nil
+}
+
+// txnLog is the transaction log of an UpdateAll.
+type txnLog struct {
+	id           uint64
+	participants []txnParticipant
+}
+
+// txnParticipant is a collection updated by an UpdateAll.
+type txnParticipant struct {
+	// file and wal are the paths of the data file and the WAL.
+	file string
+	wal  string
+	// base and end are the last commit before and after the update.
+	base  int64
+	end   int64
+	entry []byte
+}
+
+// txnFile returns the path of the ".txn" file of the data file at file.
+func txnFile(file string) string {
+	return absPath(file) + ".txn"
+}
+
+// absPath returns the absolute path of file, so that it can be found
+// from another working directory.
+func absPath(file string) string {
+	path, err := filepath.Abs(file)
+	if err != nil {
+		return file
+	}
+	return path
+}
+
+// write writes and syncs the markers of every participant but the
+// first and then the log itself, next to the first participant. It
+// returns the files in the order they should be removed, the log first.
+func (log *txnLog) write() ([]string, error) {
+	logFile := txnFile(log.participants[0].file)
+	files := []string{}
+	for _, p := range log.participants[1:] {
+		buf := bytes.NewBuffer(nil)
+		binary.Write(buf, binary.LittleEndian, uint32(txnMarkerMagic))
+		binary.Write(buf, binary.LittleEndian, log.id)
+		writeTxnString(buf, logFile)
+		file := txnFile(p.file)
+		files = append(files, file)
+		err := writeChecksummed(file, buf.Bytes())
+		if err != nil {
+			removeAll(files)
+			return nil, err
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.LittleEndian, uint32(txnLogMagic))
+	binary.Write(buf, binary.LittleEndian, log.id)
+	binary.Write(buf, binary.LittleEndian, uint32(len(log.participants)))
+	for _, p := range log.participants {
+		writeTxnString(buf, p.file)
+		writeTxnString(buf, p.wal)
+		binary.Write(buf, binary.LittleEndian, p.base)
+		binary.Write(buf, binary.LittleEndian, p.end)
+		binary.Write(buf, binary.LittleEndian, uint32(len(p.entry)))
+		buf.Write(p.entry)
+	}
+	files = append([]string{logFile}, files...)
+	err := writeChecksummed(logFile, buf.Bytes())
+	if err != nil {
+		removeAll(files)
+		return nil, err
+	}
+	return files, nil
+}
+
+func removeAll(files []string) {
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
+
+func writeTxnString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.LittleEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
+
+// writeChecksummed writes b followed by its checksum to file and syncs it.
+func writeChecksummed(file string, b []byte) error {
+	h := fnv.New64a()
+	h.Write(b)
+	sum := [8]byte{}
+	binary.LittleEndian.PutUint64(sum[:], h.Sum64())
+	b = append(b, sum[:]...)
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readTxnFile reads a ".txn" file. A marker is returned as a log with
+// no participants and the path of the log it points to.
+func readTxnFile(file string) (*txnLog, string, error) {
+	b, err := readChecksummed(file)
+	if err == errBadChecksum {
+		return nil, "", errCorruptTxnFile
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	r := bytes.NewReader(b)
+	var magic uint32
+	log := &txnLog{}
+	binary.Read(r, binary.LittleEndian, &magic)
+	err = binary.Read(r, binary.LittleEndian, &log.id)
+	if err != nil {
+		return nil, "", errCorruptTxnFile
+	}
+	switch magic {
+	case txnMarkerMagic:
+		logFile, err := readTxnString(r)
+		if err != nil {
+			return nil, "", errCorruptTxnFile
+		}
+		return log, logFile, nil
+	case txnLogMagic:
+	default:
+		return nil, "", errCorruptTxnFile
+	}
+
+	var count uint32
+	err = binary.Read(r, binary.LittleEndian, &count)
+	for i := 0; err == nil && i < int(count); i++ {
+		p := txnParticipant{}
+		p.file, err = readTxnString(r)
+		if err == nil {
+			p.wal, err = readTxnString(r)
+		}
+		if err == nil {
+			err = binary.Read(r, binary.LittleEndian, &p.base)
+		}
+		if err == nil {
+			err = binary.Read(r, binary.LittleEndian, &p.end)
+		}
+		var size uint32
+		if err == nil {
+			err = binary.Read(r, binary.LittleEndian, &size)
+		}
+		if err == nil && int64(size) <= int64(r.Len()) {
+			p.entry = make([]byte, size)
+			_, err = io.ReadFull(r, p.entry)
+		} else if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		log.participants = append(log.participants, p)
+	}
+	if err != nil {
+		return nil, "", errCorruptTxnFile
+	}
+	return log, file, nil
+}
+
+// readChecksummed reads a file written by writeChecksummed and returns
+// its contents without the checksum, or errBadChecksum if they don't
+// match it.
+func readChecksummed(file string) ([]byte, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 8 {
+		return nil, errBadChecksum
+	}
+	h := fnv.New64a()
+	h.Write(b[:len(b)-8])
+	if h.Sum64() != binary.LittleEndian.Uint64(b[len(b)-8:]) {
+		return nil, errBadChecksum
+	}
+	return b[:len(b)-8], nil
+}
+
+func readTxnString(r *bytes.Reader) (string, error) {
+	var size uint16
+	err := binary.Read(r, binary.LittleEndian, &size)
+	if err != nil {
+		return "", err
+	}
+	if int(size) > r.Len() {
+		return "", io.ErrUnexpectedEOF
+	}
+	b := make([]byte, size)
+	_, err = io.ReadFull(r, b)
+	return string(b), err
+}
+
+// recoverUpdateAll completes or discards an UpdateAll interrupted by a
+// crash that the collection with a data file at file took part in. The
+// collections it updated must not be open.
+func recoverUpdateAll(file string) error {
+	marker := txnFile(file)
+	log, logFile, err := readTxnFile(marker)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err == errCorruptTxnFile {
+		// The transaction log is synced before anything depends on
+		// it, so it's only corrupt if it wasn't completely written.
+		return os.Remove(marker)
+	}
+	if err != nil {
+		return err
+	}
+	if logFile != marker {
+		id := log.id
+		log, _, err = readTxnFile(logFile)
+		if err != nil && err != errCorruptTxnFile && !os.IsNotExist(err) {
+			return err
+		}
+		if err != nil || log.id != id {
+			// The transaction wasn't committed, or it was completed.
+			return os.Remove(marker)
+		}
+	}
+
+	for _, p := range log.participants {
+		// A collection that's open in this process can only have
+		// committed its update, which recover checks.
+		lock, err := acquireFile(p.file, false, 0, 0)
+		if err == nil {
+			defer lock.release()
+		} else if err != ErrAlreadyOpen {
+			return fmt.Errorf("lm2: error recovering UpdateAll of %s: %w", p.file, err)
+		}
+		err = p.recover(err == ErrAlreadyOpen)
+		if err != nil {
+			return fmt.Errorf("lm2: error recovering UpdateAll of %s: %v", p.file, err)
+		}
+	}
+	os.Remove(logFile)
+	for _, p := range log.participants {
+		os.Remove(txnFile(p.file))
+	}
+	return nil
+}
+
+// recover writes the participant's WAL entry if its update wasn't
+// committed, so that it's applied when the collection is opened. If the
+// collection is open, the update must have been committed.
+func (p txnParticipant) recover(open bool) error {
+	f, err := os.Open(p.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b := [fileHeaderSize]byte{}
+	n, err := f.ReadAt(b[:], 0)
+	if err != nil && n < fileHeaderSize1 {
+		return err
+	}
+	header, err := decodeFileHeader(b[:n])
+	if err != nil {
+		return err
+	}
+	if header.LastCommit >= p.end {
+		// Already committed.
+		return nil
+	}
+	if open {
+		return ErrAlreadyOpen
+	}
+	if header.LastCommit != p.base {
+		return errors.New("lm2: collection was modified after the interrupted UpdateAll")
+	}
+	sentinel := [12]byte{}
+	n, _ = f.ReadAt(sentinel[:], p.end-12)
+	if n != len(sentinel) ||
+		binary.LittleEndian.Uint32(sentinel[:4]) != sentinelMagic ||
+		int64(binary.LittleEndian.Uint64(sentinel[4:])) != p.end-12 {
+		return errors.New("lm2: update of the interrupted UpdateAll is missing from the data file")
+	}
+
+	entry, err := readWALEntry(bytes.NewReader(p.entry))
+	if err != nil {
+		return err
+	}
+	w, err := openWAL(p.wal)
+	if os.IsNotExist(err) {
+		w, err = newWAL(p.wal, 0)
+	}
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	_, err = w.Append(entry)
+	return err
+}
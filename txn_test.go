@@ -0,0 +1,142 @@
+package lm2
+
+import (
+	"os"
+	"testing"
+)
+
+func TestUpdateAll(t *testing.T) {
+	const fileA = "/tmp/test_updateall_a.lm2"
+	const fileB = "/tmp/test_updateall_b.lm2"
+	a, err := NewCollection(fileA, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Destroy()
+	b, err := NewCollection(fileB, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Destroy()
+
+	wbA := NewWriteBatch()
+	wbA.Set("a", "1")
+	wbB := NewWriteBatch()
+	wbB.Set("b", "1")
+	versions, err := UpdateAll([]CollectionUpdate{{b, wbB}, {a, wbA}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if versions[0] != b.Version() || versions[1] != a.Version() {
+		t.Errorf("expected versions %d and %d, got %v", b.Version(), a.Version(), versions)
+	}
+	for _, file := range []string{fileA, fileB} {
+		if _, err := os.Stat(file + ".txn"); !os.IsNotExist(err) {
+			t.Errorf("expected %s.txn to be removed, got %v", file, err)
+		}
+	}
+
+	// If one batch fails, neither is applied.
+	versionA, versionB := a.Version(), b.Version()
+	wbA = NewWriteBatch()
+	wbA.Set("a2", "2")
+	wbB = NewWriteBatch()
+	wbB.Set("b", "2")
+	wbB.AllowOverwrite(false)
+	_, err = UpdateAll([]CollectionUpdate{{a, wbA}, {b, wbB}})
+	if !IsRollbackError(err) {
+		t.Fatalf("expected a rollback, got %v", err)
+	}
+	if a.Version() != versionA || b.Version() != versionB {
+		t.Errorf("expected versions %d and %d, got %d and %d", versionA, versionB, a.Version(), b.Version())
+	}
+
+	// A crash after the commit point is recovered by opening either collection.
+	b.crashHook = func(point crashPoint) bool {
+		return point == crashAfterPrepared
+	}
+	wbA = NewWriteBatch()
+	wbA.Set("a", "3")
+	wbB = NewWriteBatch()
+	wbB.Set("b", "3")
+	_, err = UpdateAll([]CollectionUpdate{{a, wbA}, {b, wbB}})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := os.Stat(fileA + ".txn"); err != nil {
+		t.Errorf("expected the transaction log to be kept, got %v", err)
+	}
+	a.Close()
+	b.Close()
+	b, err = OpenCollection(fileB, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err = OpenCollection(fileA, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*Collection{a, b} {
+		cur, err := c.NewCursor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := "a"
+		if c == b {
+			key = "b"
+		}
+		if value, err := cur.Get(key); err != nil || value != "3" {
+			t.Errorf("expected %s=3, got %q (%v)", key, value, err)
+		}
+		if _, err := os.Stat(c.file + ".txn"); !os.IsNotExist(err) {
+			t.Errorf("expected %s.txn to be removed, got %v", c.file, err)
+		}
+	}
+
+	if _, err := UpdateAll([]CollectionUpdate{{a, wbA}, {a, wbB}}); err == nil {
+		t.Error("expected an error for a repeated collection")
+	}
+}
+
+func TestUpdateAllUncommitted(t *testing.T) {
+	const fileA = "/tmp/test_updateall_uncommitted_a.lm2"
+	const fileB = "/tmp/test_updateall_uncommitted_b.lm2"
+	a, err := NewCollection(fileA, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Destroy()
+	b, err := NewCollection(fileB, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Destroy()
+
+	// A crash before the transaction log is complete leaves a marker,
+	// which is removed without applying anything.
+	log := &txnLog{id: 1, participants: []txnParticipant{{file: fileA}, {file: fileB}}}
+	files, err := log.write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(files[0], 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	b, err = OpenCollection(fileB, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fileB + ".txn"); !os.IsNotExist(err) {
+		t.Errorf("expected the marker to be removed, got %v", err)
+	}
+	a.Close()
+	a, err = OpenCollection(fileA, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fileA + ".txn"); !os.IsNotExist(err) {
+		t.Errorf("expected the partial transaction log to be removed, got %v", err)
+	}
+}
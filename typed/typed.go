@@ -0,0 +1,220 @@
+// Package typed wraps an lm2 collection with typed keys and values.
+//
+// Keys are stored as the strings returned by a KeyCodec, and lm2 orders
+// collections by those strings (byte order unless the collection has a
+// custom comparator). A KeyCodec must therefore preserve order: a < b if
+// and only if Encode(a) sorts before Encode(b). Integers have to be
+// encoded with a fixed width, big-endian, with the sign bit flipped for
+// signed integers so that negative numbers sort first; Uint64Keys and
+// Int64Keys do this. Variable-length encodings such as decimal strings or
+// varints don't preserve order. Encode must also be one-to-one, since
+// equal strings are the same key.
+package typed
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+
+	"github.com/Preetam/lm2"
+)
+
+// KeyCodec encodes keys of type K as order-preserving strings.
+type KeyCodec[K any] interface {
+	Encode(key K) string
+	Decode(s string) (K, error)
+}
+
+// ValueCodec encodes values of type V as strings.
+type ValueCodec[V any] interface {
+	Encode(value V) (string, error)
+	Decode(s string) (V, error)
+}
+
+type stringKeys struct{}
+
+func (stringKeys) Encode(key string) string { return key }
+
+func (stringKeys) Decode(s string) (string, error) { return s, nil }
+
+// StringKeys stores string keys as they are.
+var StringKeys KeyCodec[string] = stringKeys{}
+
+type uint64Keys struct{}
+
+func (uint64Keys) Encode(key uint64) string { return lm2.EncodeUint64(key) }
+
+func (uint64Keys) Decode(s string) (uint64, error) { return lm2.DecodeUint64(s) }
+
+// Uint64Keys stores uint64 keys with lm2.EncodeUint64.
+var Uint64Keys KeyCodec[uint64] = uint64Keys{}
+
+type int64Keys struct{}
+
+func (int64Keys) Encode(key int64) string { return lm2.EncodeInt64(key) }
+
+func (int64Keys) Decode(s string) (int64, error) { return lm2.DecodeInt64(s) }
+
+// Int64Keys stores int64 keys with lm2.EncodeInt64, so negative keys
+// sort before positive ones.
+var Int64Keys KeyCodec[int64] = int64Keys{}
+
+type stringValues struct{}
+
+func (stringValues) Encode(value string) (string, error) { return value, nil }
+
+func (stringValues) Decode(s string) (string, error) { return s, nil }
+
+// StringValues stores string values as they are.
+var StringValues ValueCodec[string] = stringValues{}
+
+type jsonValues[V any] struct{}
+
+func (jsonValues[V]) Encode(value V) (string, error) {
+	b, err := json.Marshal(value)
+	return string(b), err
+}
+
+func (jsonValues[V]) Decode(s string) (V, error) {
+	var value V
+	err := json.Unmarshal([]byte(s), &value)
+	return value, err
+}
+
+// JSON returns a ValueCodec that stores values as JSON.
+func JSON[V any]() ValueCodec[V] {
+	return jsonValues[V]{}
+}
+
+type gobValues[V any] struct{}
+
+func (gobValues[V]) Encode(value V) (string, error) {
+	buf := bytes.NewBuffer(nil)
+	err := gob.NewEncoder(buf).Encode(value)
+	return buf.String(), err
+}
+
+func (gobValues[V]) Decode(s string) (V, error) {
+	var value V
+	err := gob.NewDecoder(bytes.NewBufferString(s)).Decode(&value)
+	return value, err
+}
+
+// Gob returns a ValueCodec that stores values with encoding/gob.
+// Each value is encoded on its own, so type information is repeated
+// in every value.
+func Gob[V any]() ValueCodec[V] {
+	return gobValues[V]{}
+}
+
+// KV is a typed key-value pair.
+type KV[K comparable, V any] struct {
+	Key   K
+	Value V
+}
+
+// TypedCollection is an lm2 collection with keys of type K and values
+// of type V.
+type TypedCollection[K comparable, V any] struct {
+	c      *lm2.Collection
+	keys   KeyCodec[K]
+	values ValueCodec[V]
+}
+
+// New returns a TypedCollection that stores keys and values in c with
+// the given codecs. Every key in c should have been written with keys.
+func New[K comparable, V any](c *lm2.Collection, keys KeyCodec[K], values ValueCodec[V]) *TypedCollection[K, V] {
+	return &TypedCollection[K, V]{
+		c:      c,
+		keys:   keys,
+		values: values,
+	}
+}
+
+// Collection returns the underlying collection.
+func (t *TypedCollection[K, V]) Collection() *lm2.Collection {
+	return t.c
+}
+
+// Get returns the value of key. found is false if key doesn't exist.
+func (t *TypedCollection[K, V]) Get(key K) (value V, found bool, err error) {
+	cur, err := t.c.NewCursor()
+	if err != nil {
+		return value, false, err
+	}
+	s, err := cur.Get(t.keys.Encode(key))
+	if err == lm2.ErrKeyNotFound {
+		return value, false, nil
+	}
+	if err != nil {
+		return value, false, err
+	}
+	value, err = t.values.Decode(s)
+	if err != nil {
+		return value, false, err
+	}
+	return value, true, nil
+}
+
+// Set sets key to value and returns the new version of the collection.
+func (t *TypedCollection[K, V]) Set(key K, value V) (int64, error) {
+	s, err := t.values.Encode(value)
+	if err != nil {
+		return 0, err
+	}
+	wb := lm2.NewWriteBatch()
+	wb.Set(t.keys.Encode(key), s)
+	return t.c.Update(wb)
+}
+
+// Delete deletes key and returns the new version of the collection.
+func (t *TypedCollection[K, V]) Delete(key K) (int64, error) {
+	wb := lm2.NewWriteBatch()
+	wb.Delete(t.keys.Encode(key))
+	return t.c.Update(wb)
+}
+
+// Range returns the key-value pairs with keys in [start, end), in key
+// order. If end is encoded as an empty string there is no upper bound.
+// At most limit pairs are returned; limit <= 0 means no limit.
+func (t *TypedCollection[K, V]) Range(start, end K, limit int) ([]KV[K, V], error) {
+	kvs, err := t.c.Range(t.keys.Encode(start), t.keys.Encode(end), limit)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]KV[K, V], 0, len(kvs))
+	for _, kv := range kvs {
+		typed, err := t.decode(kv.Key, kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, typed)
+	}
+	return result, nil
+}
+
+// Scan calls fn with each key-value pair with a key greater than or equal
+// to start, in key order, until fn returns false.
+func (t *TypedCollection[K, V]) Scan(start K, fn func(key K, value V) bool) error {
+	var decodeErr error
+	err := t.c.Scan(t.keys.Encode(start), func(key, value string) bool {
+		var kv KV[K, V]
+		kv, decodeErr = t.decode(key, value)
+		return decodeErr == nil && fn(kv.Key, kv.Value)
+	})
+	if decodeErr != nil {
+		return decodeErr
+	}
+	return err
+}
+
+func (t *TypedCollection[K, V]) decode(key, value string) (KV[K, V], error) {
+	kv := KV[K, V]{}
+	var err error
+	kv.Key, err = t.keys.Decode(key)
+	if err != nil {
+		return kv, err
+	}
+	kv.Value, err = t.values.Decode(value)
+	return kv, err
+}
@@ -0,0 +1,93 @@
+package typed
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/Preetam/lm2"
+)
+
+type point struct {
+	X, Y int
+}
+
+func TestTypedCollection(t *testing.T) {
+	c, err := lm2.NewCollection("/tmp/test_typedcollection.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	tc := New(c, Int64Keys, JSON[point]())
+	for _, i := range []int64{5, -3, 0, math.MinInt64, math.MaxInt64, -1, 100} {
+		_, err = tc.Set(i, point{X: int(i % 10), Y: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = tc.Delete(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, found, err := tc.Get(-3)
+	if err != nil || !found || p != (point{X: -3, Y: 1}) {
+		t.Errorf("expected {-3 1}, got %v, %v (%v)", p, found, err)
+	}
+	_, found, err = tc.Get(100)
+	if err != nil || found {
+		t.Errorf("expected 100 to be deleted, got %v (%v)", found, err)
+	}
+
+	kvs, err := tc.Range(-3, 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(kvs) != "[{-3 {-3 1}} {-1 {-1 1}} {0 {0 1}}]" {
+		t.Errorf("unexpected range %v", kvs)
+	}
+
+	keys := []int64{}
+	err = tc.Scan(math.MinInt64, func(key int64, value point) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int64{math.MinInt64, -3, -1, 0, 5, math.MaxInt64}
+	if fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("expected keys %v, got %v", expected, keys)
+	}
+}
+
+func TestGobValues(t *testing.T) {
+	c, err := lm2.NewCollection("/tmp/test_typedgob.lm2", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+
+	tc := New(c, Uint64Keys, Gob[[]string]())
+	_, err = tc.Set(1, []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, found, err := tc.Get(1)
+	if err != nil || !found || fmt.Sprint(value) != "[a b]" {
+		t.Errorf("expected [a b], got %v, %v (%v)", value, found, err)
+	}
+
+	// Keys written without the codec can't be decoded.
+	wb := lm2.NewWriteBatch()
+	wb.Set("bad", "value")
+	_, err = c.Update(wb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tc.Scan(0, func(uint64, []string) bool { return true })
+	if err != lm2.ErrInvalidEncoding {
+		t.Errorf("expected ErrInvalidEncoding, got %v", err)
+	}
+}
@@ -2,28 +2,53 @@ package lm2
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
 	"sort"
 	"sync/atomic"
 )
 
+// checkRecordSize returns an error if key or value can't be stored
+// in a record because their lengths don't fit in the record header.
+func checkRecordSize(key, value string) error {
+	if len(key) > MaxKeyLen {
+		return ErrKeyTooLong
+	}
+	if uint64(len(value)) > MaxValueLen {
+		return ErrValueTooLong
+	}
+	return nil
+}
+
 func writeRecord(rec *record, buf *bytes.Buffer) error {
+	value := rec.Value
+	if rec.Flags&recordFlagBlob != 0 {
+		value = string(rec.blob.bytes())
+	}
 	rec.KeyLen = uint16(len(rec.Key))
-	rec.ValLen = uint32(len(rec.Value))
+	rec.ValLen = uint32(len(value))
+	if rec.ExpiresAt != 0 {
+		rec.Flags |= recordFlagExpires
+	}
 
 	err := binary.Write(buf, binary.LittleEndian, rec.recordHeader)
 	if err != nil {
 		return err
 	}
+	if rec.Flags&recordFlagExpires != 0 {
+		err = binary.Write(buf, binary.LittleEndian, rec.ExpiresAt)
+		if err != nil {
+			return err
+		}
+	}
 
 	_, err = buf.WriteString(rec.Key)
 	if err != nil {
 		return err
 	}
-	_, err = buf.WriteString(rec.Value)
+	_, err = buf.WriteString(value)
 	if err != nil {
 		return err
 	}
@@ -51,50 +76,75 @@ func (c *Collection) findLastLessThanOrEqual(key string, startingOffset int64, l
 	offset := startingOffset
 
 	headOffset := atomic.LoadInt64(&c.Next[level])
+	if dirty {
+		headOffset = c.dirtyHeader.Next[level]
+	}
 	if headOffset == 0 {
 		// Empty collection.
 		return 0, nil
 	}
 
+	// Records read by cursors are cached as the policy allows. Updates
+	// always cache them, since the records they link are written back
+	// from the cache.
+	read := 0
+	readRecord := func(offset int64) (*record, error) {
+		read++
+		return c.readRecordCached(offset, dirty, dirty || c.options.seekCaches(read-1))
+	}
+
 	var rec *record
 	var err error
 	if offset == 0 {
 		// read the head
-		rec, err = c.readRecord(headOffset, dirty)
+		rec, err = readRecord(headOffset)
 		if err != nil {
 			return 0, err
 		}
-		if rec.Key > key { // we have a new head
+		if (!equal && rec.Key == key) || c.compare(rec.Key, key) > 0 { // we have a new head
 			return 0, nil
 		}
 
 		if level == maxLevels-1 {
 			cacheResult := c.cache.findLastLessThan(key)
 			if cacheResult != 0 {
-				rec, err = c.readRecord(cacheResult, dirty)
+				cached, err := readRecord(cacheResult)
 				if err != nil {
 					return 0, err
 				}
+				// Only a record linked at this level is a shortcut;
+				// starting from a lower one walks the lower levels
+				// from there.
+				if atomic.LoadInt64(&cached.Next[level]) != 0 {
+					rec = cached
+				}
 			}
 		}
 
 		offset = rec.Offset
 	} else {
-		rec, err = c.readRecord(offset, dirty)
+		rec, err = readRecord(offset)
 		if err != nil {
 			return 0, err
 		}
 	}
+	if cpRec := c.seekIndex(key, rec, level, dirty); cpRec != nil {
+		rec = cpRec
+		offset = rec.Offset
+	}
 
 	for rec != nil {
 		rec.lock.RLock()
-		if (!equal && rec.Key == key) || rec.Key > key {
+		if (!equal && rec.Key == key) || c.compare(rec.Key, key) > 0 {
 			rec.lock.RUnlock()
 			break
 		}
 		offset = rec.Offset
 		oldRec := rec
-		rec, err = c.nextRecord(oldRec, level, dirty)
+		rec = nil
+		if next := atomic.LoadInt64(&oldRec.Next[level]); next != 0 {
+			rec, err = readRecord(next)
+		}
 		if err != nil {
 			return 0, err
 		}
@@ -104,19 +154,191 @@ func (c *Collection) findLastLessThanOrEqual(key string, startingOffset int64, l
 	return offset, nil
 }
 
+// resolveMerges returns the keys and values to set for wb, applying its
+// merge functions to the current values. writeLock must be held.
+func (c *Collection) resolveMerges(wb *WriteBatch) (map[string]string, error) {
+	if len(wb.merges) == 0 {
+		return wb.sets, nil
+	}
+
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+
+	sets := make(map[string]string, len(wb.sets)+len(wb.merges))
+	for key, value := range wb.sets {
+		sets[key] = value
+	}
+	for key, fns := range wb.merges {
+		value, existed := sets[key]
+		if !existed {
+			rec, err := c.get(key)
+			if err != nil {
+				return nil, err
+			}
+			if rec != nil {
+				value, err = c.recordValue(rec)
+				if err != nil {
+					return nil, err
+				}
+				existed = true
+			}
+		}
+		for _, fn := range fns {
+			value, existed = fn(value, existed), true
+		}
+		sets[key] = value
+	}
+	return sets, nil
+}
+
+// elideUnchanged returns sets without the SetIfChanged keys of wb whose
+// values are unchanged, and the number of keys it removed.
+func (c *Collection) elideUnchanged(wb *WriteBatch, sets map[string]string) (map[string]string, int, error) {
+	if len(wb.ifChanged) == 0 {
+		return sets, 0, nil
+	}
+
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+
+	elided := map[string]bool{}
+	for key := range wb.ifChanged {
+		value, ok := sets[key]
+		if !ok {
+			continue
+		}
+		rec, err := c.get(key)
+		if err != nil {
+			return nil, 0, err
+		}
+		if rec == nil || rec.ExpiresAt != 0 {
+			continue
+		}
+		current, err := c.recordValue(rec)
+		if err != nil {
+			return nil, 0, err
+		}
+		if current == value {
+			elided[key] = true
+		}
+	}
+	if len(elided) == 0 {
+		return sets, 0, nil
+	}
+	changed := make(map[string]string, len(sets)-len(elided))
+	for key, value := range sets {
+		if !elided[key] {
+			changed[key] = value
+		}
+	}
+	return changed, len(elided), nil
+}
+
 // Update atomically and durably applies a WriteBatch (a set of updates) to the collection.
 // It returns the new version (on success) and an error.
 // The error may be a RollbackError; use IsRollbackError to check.
+// ErrKeyTooLong or ErrValueTooLong is returned, and nothing is written,
+// if a key or value in wb is too long to store.
+// ErrQuotaExceeded is returned, and nothing is written, if wb would grow
+// the data file past Options.MaxFileSize.
+// Whether a successful Update survives an operating system crash depends on
+// Options.Sync: with SyncAlways (the default) it does, with SyncInterval
+// updates since the last background sync may be lost, and with SyncNever
+// any update not yet written back by the operating system may be lost.
+// With Options.GroupCommit, wb may be made durable together with other
+// concurrent batches, but it's still committed on its own and gets a
+// version of its own.
+// Update doesn't modify wb, so it can be retried or applied to other
+// collections.
 func (c *Collection) Update(wb *WriteBatch) (int64, error) {
+	if c.options.GroupCommit {
+		return c.groupUpdate(wb)
+	}
+	return c.update(context.Background(), wb)
+}
+
+// UpdateContext is like Update but stops early if ctx is canceled.
+// ctx is checked while the records to modify are located and before anything
+// is written. If it is canceled by then, ctx.Err() is returned and the
+// collection is left untouched. Once records have been written to the data
+// file the update runs to completion regardless of ctx.
+// UpdateContext doesn't take part in group commit.
+func (c *Collection) UpdateContext(ctx context.Context, wb *WriteBatch) (int64, error) {
+	return c.update(ctx, wb)
+}
+
+// UpdateChunked applies wb as a series of Updates, each appending about
+// maxBytesPerCommit bytes or less, as estimated by EstimatedBytes, so that
+// a very large batch isn't buffered in memory all at once. Keys are
+// applied in key order, and a key larger than maxBytesPerCommit gets a
+// commit of its own. Each commit is atomic, but the batch as a whole
+// isn't: if an error is returned, the chunks for the returned versions
+// have been applied and the rest haven't.
+func (c *Collection) UpdateChunked(wb *WriteBatch, maxBytesPerCommit int) ([]int64, error) {
+	versions := []int64{}
+	for _, chunk := range wb.split(maxBytesPerCommit, c.compare) {
+		version, err := c.Update(chunk)
+		if err != nil {
+			return versions, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+func (c *Collection) update(ctx context.Context, wb *WriteBatch) (int64, error) {
 	c.writeLock.Lock()
 	defer c.writeLock.Unlock()
+	return c.apply(ctx, wb)
+}
 
+// apply applies wb to the collection. writeLock must be held.
+func (c *Collection) apply(ctx context.Context, wb *WriteBatch) (int64, error) {
+	versions, err := c.applyBatches(ctx, []*WriteBatch{wb})
+	if err != nil {
+		return 0, err
+	}
+	return versions[0], nil
+}
+
+// pendingCommit is what applyBatches keeps track of while it appends
+// the records of its batches.
+type pendingCommit struct {
+	// appended is true once records or a sentinel may have been
+	// appended to the data file.
+	appended bool
+	// blobStart is the end of the blob file before anything was
+	// appended to it, if blobs is true.
+	blobStart int64
+	blobs     bool
+
+	dirtyOffsets []int64
+	// checkpoints are added to the index once they're committed.
+	checkpoints []checkpoint
+	inserted    int
+	elided      int
+}
+
+// applyBatches applies wbs in order, each as a commit of its own, and
+// returns their versions. The commits are made durable together: each
+// batch's records are appended with a sentinel after them, and then the
+// data file is synced, a single WAL entry links them all, and it's
+// applied, so the data file and WAL are synced as often as for a single
+// commit. If a batch fails, none of them is applied. The WAL entry has
+// the tag of the first batch, and only the first batch's prepared hook is
+// called. writeLock must be held.
+func (c *Collection) applyBatches(ctx context.Context, wbs []*WriteBatch) ([]int64, error) {
+	if c.readOnly {
+		return nil, ErrReadOnly
+	}
 	if atomic.LoadUint32(&c.internalState) != 0 {
-		return 0, ErrInternal
+		return nil, ErrInternal
 	}
 
-	c.metaLock.Lock()
-	defer c.metaLock.Unlock()
+	// Readers only see c.fileHeader and committed records, so they can
+	// keep going while new records are appended. The header of the
+	// pending commit is kept in c.dirtyHeader until it's applied.
+	c.dirtyHeader = c.fileHeader
 
 	c.dirtyLock.Lock()
 	c.dirty = map[int64]*record{}
@@ -126,15 +348,161 @@ func (c *Collection) Update(wb *WriteBatch) (int64, error) {
 		c.dirty = nil
 		c.dirtyLock.Unlock()
 	}()
-	dirtyOffsets := []int64{}
 
-	// Clean up WriteBatch.
-	wb.cleanup()
+	p := &pendingCommit{inserted: c.indexCount}
+	versions := []int64{}
+	for _, wb := range wbs {
+		version, rollback, err := c.stageBatch(ctx, wb, p)
+		if err == errSimulatedCrash {
+			return nil, err
+		}
+		if err != nil && (rollback || p.appended) {
+			return nil, c.rollback(p, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	if !p.appended {
+		// Nothing is left to commit.
+		c.stats.incSetsElided(uint64(p.elided))
+		return versions, nil
+	}
+
+	// fsync data file.
+	err := c.syncData()
+	if err != nil {
+		return nil, c.rollback(p, err)
+	}
+	if c.crashed(crashAfterSentinel) {
+		return nil, errSimulatedCrash
+	}
+
+	walEntry := newWALEntry()
+	walEntry.tag = wbs[0].tag
+	c.dirtyLock.Lock()
+	for _, dirtyRec := range c.dirty {
+		walEntry.Push(newWALRecord(dirtyRec.Offset, dirtyRec.recordHeader.bytes()))
+	}
+	c.dirtyLock.Unlock()
+	walEntry.Push(newWALRecord(0, c.dirtyHeader.bytes()))
+	if prepared := wbs[0].prepared; prepared != nil {
+		err = prepared(walEntry, c.LastCommit, c.dirtyHeader.LastCommit)
+		if err != nil {
+			return nil, c.rollback(p, err)
+		}
+		if c.crashed(crashAfterPrepared) {
+			return nil, errSimulatedCrash
+		}
+	}
+	_, err = c.wal.Append(walEntry)
+	if err != nil {
+		if wbs[0].prepared != nil {
+			// The entry is committed by the UpdateAll transaction log,
+			// so the appended records have to be kept.
+			return nil, c.markInconsistent(err)
+		}
+		return nil, c.rollback(p, err)
+	}
+	if c.crashed(crashAfterWAL) {
+		return nil, errSimulatedCrash
+	}
 
+	// Apply the WAL entry to the data file. Readers are blocked from
+	// here on so that they can't see records that are partially linked
+	// or cache records that are about to change.
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+
+	// Update + fsync data file header.
+	for _, walRec := range walEntry.records {
+		_, err := c.writeAt(walRec.Data, walRec.Offset)
+		if err != nil {
+			return nil, c.markInconsistent(Error{Op: "write", Offset: walRec.Offset, Err: err})
+		}
+		if c.crashed(crashDuringApply) {
+			return nil, errSimulatedCrash
+		}
+	}
+
+	err = c.syncData()
+	if err != nil {
+		return nil, c.markInconsistent(err)
+	}
+	if c.crashed(crashAfterApply) {
+		return nil, errSimulatedCrash
+	}
+
+	c.cache.flushOffsets(p.dirtyOffsets)
+	if c.shipper.active() {
+		c.shipCommit(c.LastCommit, c.dirtyHeader.LastCommit, walEntry)
+	}
+	c.LastCommit = c.dirtyHeader.LastCommit
+	c.DeadBytes = c.dirtyHeader.DeadBytes
+	c.lastCommitInfo = walEntry.commitInfo(c.LastCommit)
+	for i, v := range c.dirtyHeader.Next {
+		atomic.StoreInt64(&c.fileHeader.Next[i], v)
+	}
+	c.indexCount = p.inserted
+	if len(p.checkpoints) > 0 {
+		c.index = c.index.add(p.checkpoints, c.compare)
+		c.indexDirty = true
+	}
+	c.stats.incSetsElided(uint64(p.elided))
+	c.maybeAutoCompact()
+
+	return versions, nil
+}
+
+// rollback drops what applyBatches appended for p and returns err as a
+// RollbackError. Nothing has been linked into the committed records yet,
+// so dropping the appended data is enough.
+func (c *Collection) rollback(p *pendingCommit, err error) error {
+	c.wal.Truncate()
+	c.f.Truncate(c.LastCommit)
+	if p.blobs {
+		c.blobs.truncate(p.blobStart)
+	}
+
+	c.cache.reset()
+
+	if IsRollbackError(err) {
+		return err
+	}
+	return RollbackError{
+		Err: err,
+	}
+}
+
+// stageBatch appends the records of wb and a sentinel to the data file
+// for applyBatches, and marks the records it deletes or overwrites, and
+// returns its version. The modified records are kept in c.dirty and the
+// header in c.dirtyHeader. If an error is returned, rollback is true if
+// the data file may have been modified.
+func (c *Collection) stageBatch(ctx context.Context, wb *WriteBatch, p *pendingCommit) (version int64, rollback bool, err error) {
+	sets, err := c.resolveMerges(wb)
+	if err != nil {
+		return 0, false, err
+	}
+	for key, value := range sets {
+		if err := checkRecordSize(key, value); err != nil {
+			return 0, false, err
+		}
+	}
+	sets, elided, err := c.elideUnchanged(wb, sets)
+	if err != nil {
+		return 0, false, err
+	}
+	p.elided += elided
+	if len(sets) == 0 && len(wb.deletes) == 0 && elided > 0 {
+		// Nothing is left to commit.
+		return c.dirtyHeader.LastCommit, false, nil
+	}
 	// Find and load records that will be modified into the cache.
 
 	mergedSetDeleteKeys := map[string]struct{}{}
-	for key := range wb.sets {
+	for key := range sets {
 		mergedSetDeleteKeys[key] = struct{}{}
 	}
 	keys := []string{}
@@ -143,37 +511,66 @@ func (c *Collection) Update(wb *WriteBatch) (int64, error) {
 	}
 
 	// Sort keys to be inserted or deleted.
-	sort.Strings(keys)
+	sort.Slice(keys, func(i, j int) bool {
+		return c.compare(keys[i], keys[j]) < 0
+	})
 
-	walEntry := newWALEntry()
 	appendBuf := bytes.NewBuffer(nil)
 	currentOffset, err := c.f.Seek(0, 2)
 	if err != nil {
-		atomic.StoreUint32(&c.internalState, 1)
-		return 0, errors.New("lm2: couldn't get current file offset")
+		return 0, false, c.markInconsistent(errors.New("lm2: couldn't get current file offset"))
 	}
 
-	previousFileHeader := c.fileHeader
 	overwrittenRecords := []int64{}
+	deadBytes := uint64(0)
 	startingOffsets := [maxLevels]int64{}
 
+	// Values stored out of line are appended to the blob file
+	// before the records that refer to them.
+	blobBuf := bytes.NewBuffer(nil)
+	blobStart := int64(0)
+	if c.options.BlobThreshold > 0 || len(wb.blobs) > 0 {
+		blobStart, err = c.blobs.end()
+		if err != nil {
+			return 0, false, err
+		}
+	}
+
 	var rollbackErr error
 
 KEYS_LOOP:
 	for _, key := range keys {
-		value := wb.sets[key]
+		if err := ctx.Err(); err != nil {
+			return 0, false, err
+		}
+		value := sets[key]
 		level := generateLevel()
 		newRecordOffset := currentOffset + int64(appendBuf.Len())
 		rec := &record{
 			recordHeader: recordHeader{
 				Next: [maxLevels]int64{},
 			},
-			Offset: newRecordOffset,
-			Key:    key,
-			Value:  value,
+			Offset:    newRecordOffset,
+			Key:       key,
+			Value:     value,
+			ExpiresAt: wb.expires[key],
+		}
+		if ref, ok := wb.blobs[key]; ok {
+			rec.Flags |= recordFlagBlob
+			rec.blob = ref
+			rec.Value = ""
+		} else if max := c.options.BlobThreshold; max > 0 && len(value) > max {
+			rec.Flags |= recordFlagBlob
+			rec.blob = blobRef{Offset: blobStart + int64(blobBuf.Len()), Len: int64(len(value))}
+			rec.Value = ""
+			blobBuf.WriteString(value)
 		}
 		c.setDirty(newRecordOffset, rec)
-		dirtyOffsets = append(dirtyOffsets, newRecordOffset)
+		p.dirtyOffsets = append(p.dirtyOffsets, newRecordOffset)
+		if c.indexes(p.inserted) {
+			p.checkpoints = append(p.checkpoints, checkpoint{offset: newRecordOffset, key: key})
+		}
+		p.inserted++
 		for i := maxLevels - 1; i > level; i-- {
 			offset, err := c.findLastLessThanOrEqual(key, startingOffsets[i], i, true, true)
 			if err != nil {
@@ -196,8 +593,8 @@ KEYS_LOOP:
 			}
 			if offset == 0 {
 				// Insert at head
-				atomic.StoreInt64(&rec.Next[level], c.fileHeader.Next[level])
-				atomic.StoreInt64(&c.fileHeader.Next[level], newRecordOffset)
+				atomic.StoreInt64(&rec.Next[level], c.dirtyHeader.Next[level])
+				c.dirtyHeader.Next[level] = newRecordOffset
 			} else {
 				// Have a previous record
 				prevRec := &record{}
@@ -216,11 +613,10 @@ KEYS_LOOP:
 				atomic.StoreInt64(&rec.Next[level], prevRec.Next[level])
 				atomic.StoreInt64(&prevRec.Next[level], newRecordOffset)
 				c.setDirty(prevRec.Offset, prevRec)
-				dirtyOffsets = append(dirtyOffsets, prevRec.Offset)
-				walEntry.Push(newWALRecord(prevRec.Offset, prevRec.recordHeader.bytes()))
+				p.dirtyOffsets = append(p.dirtyOffsets, prevRec.Offset)
 
 				if prevRec.Key == key && prevRec.Deleted == 0 {
-					if !wb.allowOverwrite {
+					if !wb.allowOverwrite && !prevRec.expired() {
 						rollbackErr = RollbackError{
 							DuplicateKey:  true,
 							ConflictedKey: key,
@@ -245,32 +641,53 @@ KEYS_LOOP:
 		}
 	}
 
-	_, err = io.Copy(c.f, appendBuf)
-	if err != nil {
-		rollbackErr = fmt.Errorf("lm2: appending records failed (%s)", err)
+	if rollbackErr != nil {
 		goto ROLLBACK
 	}
 
-	// Write sentinel record.
-	currentOffset, err = c.writeSentinel()
+	// The sentinel takes up another 12 bytes.
+	if max := c.options.MaxFileSize; max > 0 && appendBuf.Len() > 0 &&
+		currentOffset+int64(appendBuf.Len())+12 > max {
+		return 0, false, ErrQuotaExceeded
+	}
+
+	// Last chance to cancel before the data file is modified.
+	if err := ctx.Err(); err != nil {
+		return 0, false, err
+	}
+
+	if blobBuf.Len() > 0 {
+		if !p.blobs {
+			p.blobStart = blobStart
+			p.blobs = true
+		}
+		err = c.blobs.append(blobBuf.Bytes())
+		if err == nil && c.options.Sync == SyncAlways {
+			err = c.blobs.sync()
+		}
+		if err != nil {
+			rollbackErr = err
+			goto ROLLBACK
+		}
+	}
+
+	p.appended = true
+	_, err = io.Copy(c.f, appendBuf)
 	if err != nil {
-		rollbackErr = err
+		rollbackErr = Error{Op: "append records", Offset: currentOffset, Err: err}
 		goto ROLLBACK
 	}
+	if c.crashed(crashAfterAppend) {
+		return 0, false, errSimulatedCrash
+	}
 
-	// fsync data file.
-	err = c.f.Sync()
+	// Write sentinel record.
+	currentOffset, err = c.writeSentinel()
 	if err != nil {
 		rollbackErr = err
 		goto ROLLBACK
 	}
 
-	c.dirtyLock.Lock()
-	for _, dirtyRec := range c.dirty {
-		walEntry.Push(newWALRecord(dirtyRec.Offset, dirtyRec.recordHeader.bytes()))
-	}
-	c.dirtyLock.Unlock()
-
 	for key := range wb.deletes {
 		offset := int64(0)
 		for level := maxLevels - 1; level >= 0; level-- {
@@ -296,13 +713,14 @@ KEYS_LOOP:
 			*rec = *readRec
 			readRec.lock.RUnlock()
 		}
-		if rec.Key != key {
+		if rec.Key != key || rec.Deleted != 0 {
+			// Missing or already deleted.
 			continue
 		}
 		rec.Deleted = currentOffset
+		deadBytes += rec.size()
 		c.setDirty(rec.Offset, rec)
-		dirtyOffsets = append(dirtyOffsets, rec.Offset)
-		walEntry.Push(newWALRecord(rec.Offset, rec.recordHeader.bytes()))
+		p.dirtyOffsets = append(p.dirtyOffsets, rec.Offset)
 	}
 
 	for _, offset := range overwrittenRecords {
@@ -319,59 +737,20 @@ KEYS_LOOP:
 			*rec = *readRec
 			readRec.lock.RUnlock()
 		}
+		if rec.Deleted != 0 {
+			// Already marked at another level.
+			continue
+		}
 		atomic.StoreInt64(&rec.Deleted, currentOffset)
+		deadBytes += rec.size()
 		c.setDirty(rec.Offset, rec)
-		dirtyOffsets = append(dirtyOffsets, rec.Offset)
-		walEntry.Push(newWALRecord(rec.Offset, rec.recordHeader.bytes()))
+		p.dirtyOffsets = append(p.dirtyOffsets, rec.Offset)
 	}
 
-	c.LastCommit = currentOffset
-	walEntry.Push(newWALRecord(0, c.fileHeader.bytes()))
-	_, err = c.wal.Append(walEntry)
-	if err != nil {
-		rollbackErr = err
-		goto ROLLBACK
-	}
+	c.dirtyHeader.LastCommit = currentOffset
+	c.dirtyHeader.DeadBytes += int64(deadBytes)
+	return currentOffset, false, nil
 
 ROLLBACK:
-	if rollbackErr != nil {
-		// Do a rollback
-		c.wal.Truncate()
-		c.fileHeader.LastCommit = previousFileHeader.LastCommit
-		for i, v := range previousFileHeader.Next {
-			atomic.StoreInt64(&c.fileHeader.Next[i], v)
-		}
-		c.f.Truncate(c.LastCommit)
-
-		c.cache.flushOffsets(dirtyOffsets)
-		c.cache.lock.Lock()
-		c.cache.cache = map[int64]*record{}
-		c.cache.lock.Unlock()
-
-		if IsRollbackError(rollbackErr) {
-			return 0, rollbackErr
-		}
-		return 0, RollbackError{
-			Err: rollbackErr,
-		}
-	}
-
-	// Update + fsync data file header.
-	for _, walRec := range walEntry.records {
-		_, err := c.writeAt(walRec.Data, walRec.Offset)
-		if err != nil {
-			atomic.StoreUint32(&c.internalState, 1)
-			return 0, fmt.Errorf("lm2: partial write (%s)", err)
-		}
-	}
-
-	err = c.f.Sync()
-	if err != nil {
-		atomic.StoreUint32(&c.internalState, 1)
-		return 0, err
-	}
-
-	c.cache.flushOffsets(dirtyOffsets)
-
-	return c.LastCommit, nil
+	return 0, true, rollbackErr
 }
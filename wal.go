@@ -1,19 +1,40 @@
 package lm2
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"io"
 	"os"
+	"time"
 )
 
 const (
-	walMagic       = sentinelMagic
+	// walMagic starts entries written before entries had metadata.
+	walMagic = sentinelMagic
+	// walMagicMeta starts entries with a walEntryMeta and a tag
+	// between the header and the records.
+	walMagicMeta   = walMagic + 1
 	walFooterMagic = ^uint32(walMagic)
 )
 
+// wal holds the entry of the most recent commit. Each entry replaces
+// the previous one at the start of the file, so the WAL never holds more
+// than one commit and needs no rotation. Recovery still reads entries
+// that follow the first, in order, and replays those that commit at or
+// after the data file's last commit, so a WAL holding the entries of
+// several commits is replayed from the last one that was applied, and
+// what's left of an older entry after a newer one is ignored.
 type wal struct {
 	f *os.File
+
+	// noSync disables syncing after each append.
+	noSync bool
+	// size is the size of the file.
+	size int64
+	// timeout, if positive, is how long writes and syncs may take.
+	timeout time.Duration
 }
 
 type walEntryHeader struct {
@@ -22,12 +43,20 @@ type walEntryHeader struct {
 	NumRecords uint32
 }
 
+type walEntryMeta struct {
+	// Timestamp is when the entry was created, in Unix nanoseconds.
+	Timestamp int64
+	TagLen    uint32
+}
+
 type walEntryFooter struct {
 	Magic uint32
 }
 
 type walEntry struct {
 	walEntryHeader
+	walEntryMeta
+	tag     []byte
 	records []walRecord
 	walEntryFooter
 }
@@ -45,15 +74,28 @@ type walRecordHeader struct {
 func newWALEntry() *walEntry {
 	return &walEntry{
 		walEntryHeader: walEntryHeader{
-			Magic:      sentinelMagic,
+			Magic:      walMagicMeta,
 			NumRecords: 0,
 		},
+		walEntryMeta: walEntryMeta{
+			Timestamp: time.Now().UnixNano(),
+		},
 		walEntryFooter: walEntryFooter{
 			Magic: walFooterMagic,
 		},
 	}
 }
 
+// commitInfo returns the CommitInfo of the commit that e creates,
+// which has version version.
+func (e *walEntry) commitInfo(version int64) CommitInfo {
+	info := CommitInfo{Version: version, Tag: e.tag}
+	if e.Timestamp != 0 {
+		info.Time = time.Unix(0, e.Timestamp)
+	}
+	return info
+}
+
 func newWALRecord(offset int64, data []byte) walRecord {
 	return walRecord{
 		walRecordHeader: walRecordHeader{
@@ -81,18 +123,31 @@ func openWAL(filename string) (*wal, error) {
 	if err != nil {
 		return nil, err
 	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
 
 	return &wal{
-		f: f,
+		f:    f,
+		size: fi.Size(),
 	}, nil
 }
 
-func newWAL(filename string) (*wal, error) {
+// newWAL creates an empty WAL. If perm is set, the file gets exactly
+// those permission bits, and otherwise it's created with 0600.
+func newWAL(filename string, perm os.FileMode) (*wal, error) {
 	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
 		return nil, err
 	}
-	err = f.Truncate(0)
+	if perm != 0 {
+		err = f.Chmod(perm.Perm())
+	}
+	if err == nil {
+		err = f.Truncate(0)
+	}
 	if err != nil {
 		f.Close()
 		return nil, err
@@ -102,20 +157,33 @@ func newWAL(filename string) (*wal, error) {
 	}, nil
 }
 
-func (w *wal) Append(entry *walEntry) (int64, error) {
+// Bytes returns the encoded entry, setting its length.
+func (e *walEntry) Bytes() []byte {
 	buf := bytes.NewBuffer(nil)
-	for _, rec := range entry.records {
+	for _, rec := range e.records {
 		buf.Write(rec.Bytes())
 	}
-	entry.Length = int64(buf.Len())
+	e.Length = int64(buf.Len())
 
-	binary.Write(buf, binary.LittleEndian, entry.walEntryFooter)
+	binary.Write(buf, binary.LittleEndian, e.walEntryFooter)
 
 	headerBuf := bytes.NewBuffer(nil)
-	binary.Write(headerBuf, binary.LittleEndian, entry.walEntryHeader)
-	entryBytes := append(headerBuf.Bytes(), buf.Bytes()...)
+	binary.Write(headerBuf, binary.LittleEndian, e.walEntryHeader)
+	e.TagLen = uint32(len(e.tag))
+	binary.Write(headerBuf, binary.LittleEndian, e.walEntryMeta)
+	headerBuf.Write(e.tag)
+	return append(headerBuf.Bytes(), buf.Bytes()...)
+}
 
-	n, err := w.f.WriteAt(entryBytes, 0)
+func (w *wal) Append(entry *walEntry) (int64, error) {
+	entryBytes := entry.Bytes()
+
+	n := 0
+	err := withTimeout(w.timeout, func() error {
+		var err error
+		n, err = w.f.WriteAt(entryBytes, 0)
+		return err
+	})
 	if err != nil {
 		w.Truncate()
 		return 0, err
@@ -126,55 +194,124 @@ func (w *wal) Append(entry *walEntry) (int64, error) {
 		return 0, errors.New("lm2: incomplete WAL write")
 	}
 
-	err = w.f.Sync()
-	if err != nil {
-		w.Truncate()
-		return 0, err
+	// Drop what's left of a larger previous entry, so the WAL
+	// doesn't stay as large as the largest commit.
+	if w.size > int64(len(entryBytes)) && withTimeout(w.timeout, func() error {
+		return w.f.Truncate(int64(len(entryBytes)))
+	}) == nil {
+		w.size = int64(len(entryBytes))
+	}
+	if w.size < int64(len(entryBytes)) {
+		w.size = int64(len(entryBytes))
+	}
+
+	if !w.noSync {
+		err = w.sync()
+		if err != nil {
+			w.Truncate()
+			return 0, err
+		}
 	}
 
 	return 0, nil
 }
 
 func (w *wal) ReadLastEntry() (*walEntry, error) {
+	entries, err := w.ReadEntries()
+	if err != nil {
+		return nil, err
+	}
+	return entries[len(entries)-1], nil
+}
+
+// ReadEntries reads the entries in the WAL in order. Entries are read
+// until one can't be, which ends the WAL, so an error is only returned
+// if the first one can't be read.
+func (w *wal) ReadEntries() ([]*walEntry, error) {
 	_, err := w.f.Seek(0, 0)
 	if err != nil {
 		return nil, errors.New("lm2: error seeking to WAL entry start")
 	}
 
-	return w.readEntry()
+	r := bufio.NewReader(w.f)
+	entry, err := readWALEntry(r)
+	if err != nil {
+		return nil, err
+	}
+	entries := []*walEntry{entry}
+	for {
+		entry, err = readWALEntry(r)
+		if err != nil {
+			return entries, nil
+		}
+		entries = append(entries, entry)
+	}
 }
 
 func (w *wal) readEntry() (*walEntry, error) {
+	return readWALEntry(w.f)
+}
+
+// version returns the last commit set by the entry's file header
+// record, or 0 if it doesn't have one.
+func (e *walEntry) version() int64 {
+	for _, rec := range e.records {
+		if rec.Offset != 0 {
+			continue
+		}
+		header, err := decodeFileHeader(rec.Data)
+		if err == nil {
+			return header.LastCommit
+		}
+	}
+	return 0
+}
+
+// readWALEntry reads an encoded entry from r.
+func readWALEntry(r io.Reader) (*walEntry, error) {
 	entry := newWALEntry()
 
-	err := binary.Read(w.f, binary.LittleEndian, &entry.walEntryHeader)
+	err := binary.Read(r, binary.LittleEndian, &entry.walEntryHeader)
 	if err != nil {
 		return nil, errors.New("lm2: error reading WAL entry header")
 	}
-	if entry.walEntryHeader.Magic != walMagic {
+	switch entry.walEntryHeader.Magic {
+	case walMagic:
+		entry.walEntryMeta = walEntryMeta{}
+	case walMagicMeta:
+		err = binary.Read(r, binary.LittleEndian, &entry.walEntryMeta)
+		if err != nil {
+			return nil, errors.New("lm2: error reading WAL entry header")
+		}
+		entry.tag = make([]byte, int(entry.TagLen))
+		_, err = io.ReadFull(r, entry.tag)
+		if err != nil {
+			return nil, errors.New("lm2: error reading WAL entry tag")
+		}
+	default:
 		return nil, errors.New("lm2: invalid WAL header magic")
 	}
 
 	b := make([]byte, int(entry.walEntryHeader.Length))
-	n, err := w.f.Read(b)
-	if err != nil {
+	n, err := io.ReadFull(r, b)
+	if err != nil && n == 0 {
 		return nil, errors.New("lm2: error reading WAL body")
 	}
 	if n != len(b) {
 		return nil, errors.New("lm2: partial read")
 	}
 
-	r := bytes.NewReader(b)
+	body := bytes.NewReader(b)
 	numRecords := int(entry.walEntryHeader.NumRecords)
 	entry.walEntryHeader.NumRecords = 0
 	for i := 0; i < numRecords; i++ {
 		recHeader := walRecordHeader{}
-		err = binary.Read(r, binary.LittleEndian, &recHeader)
+		err = binary.Read(body, binary.LittleEndian, &recHeader)
 		if err != nil {
 			return nil, errors.New("lm2: error reading WAL record header")
 		}
 		walRecordBytes := make([]byte, int(recHeader.Size))
-		n, err := r.Read(walRecordBytes)
+		n, err := body.Read(walRecordBytes)
 		if err != nil {
 			return nil, errors.New("lm2: error reading WAL record body")
 		}
@@ -185,7 +322,7 @@ func (w *wal) readEntry() (*walEntry, error) {
 		entry.Push(newWALRecord(recHeader.Offset, walRecordBytes))
 	}
 
-	err = binary.Read(w.f, binary.LittleEndian, &entry.walEntryFooter)
+	err = binary.Read(r, binary.LittleEndian, &entry.walEntryFooter)
 	if err != nil {
 		return nil, err
 	}
@@ -197,8 +334,19 @@ func (w *wal) readEntry() (*walEntry, error) {
 	return entry, nil
 }
 
+// sync syncs the file.
+func (w *wal) sync() error {
+	return withTimeout(w.timeout, w.f.Sync)
+}
+
 func (w *wal) Truncate() error {
-	return w.f.Truncate(0)
+	err := withTimeout(w.timeout, func() error {
+		return w.f.Truncate(0)
+	})
+	if err == nil {
+		w.size = 0
+	}
+	return err
 }
 
 func (w *wal) Close() {
@@ -2,11 +2,12 @@ package lm2
 
 import (
 	"bytes"
+	"encoding/binary"
 	"testing"
 )
 
 func TestWAL(t *testing.T) {
-	wal, err := newWAL("/tmp/test.wal")
+	wal, err := newWAL("/tmp/test.wal", 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -42,3 +43,72 @@ func TestWAL(t *testing.T) {
 		t.Errorf("expected record data %v, got %v", []byte("test record"), rec.Data)
 	}
 }
+
+func TestWALShrinks(t *testing.T) {
+	wal, err := newWAL("/tmp/test_shrink.wal", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Destroy()
+
+	large := newWALEntry()
+	large.Push(newWALRecord(1, bytes.Repeat([]byte("x"), 1000)))
+	if _, err = wal.Append(large); err != nil {
+		t.Fatal(err)
+	}
+	small := newWALEntry()
+	small.Push(newWALRecord(2, []byte("y")))
+	if _, err = wal.Append(small); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := wal.f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := int64(len(small.Bytes())); fi.Size() != expected {
+		t.Errorf("expected WAL size %d, got %d", expected, fi.Size())
+	}
+	entry, err := wal.ReadLastEntry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entry.records) != 1 || entry.records[0].Offset != 2 {
+		t.Errorf("expected the small entry, got %+v", entry.records)
+	}
+}
+
+func TestWALEntryWithoutMeta(t *testing.T) {
+	entry := newWALEntry()
+	entry.Push(newWALRecord(4321, []byte("test record")))
+	entry.tag = []byte("tag")
+	b := entry.Bytes()
+
+	read, err := readWALEntry(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(read.tag) != "tag" || read.Timestamp != entry.Timestamp {
+		t.Errorf("expected tag and timestamp to be read, got %q, %d", read.tag, read.Timestamp)
+	}
+
+	// Entries written before metadata existed have no meta or tag.
+	legacy := bytes.NewBuffer(nil)
+	binary.Write(legacy, binary.LittleEndian, walEntryHeader{
+		Magic:      walMagic,
+		Length:     read.Length,
+		NumRecords: 1,
+	})
+	size := binary.Size(walEntryHeader{}) + binary.Size(walEntryMeta{}) + len(entry.tag)
+	legacy.Write(b[size:])
+	read, err = readWALEntry(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read.records) != 1 || string(read.records[0].Data) != "test record" {
+		t.Errorf("unexpected records %v", read.records)
+	}
+	if read.tag != nil || read.Timestamp != 0 {
+		t.Errorf("expected no tag or timestamp, got %q, %d", read.tag, read.Timestamp)
+	}
+}
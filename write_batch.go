@@ -1,10 +1,25 @@
 package lm2
 
+import (
+	"sort"
+	"time"
+)
+
 // WriteBatch represents a set of modifications.
 type WriteBatch struct {
-	sets           map[string]string
-	deletes        map[string]struct{}
+	sets      map[string]string
+	deletes   map[string]struct{}
+	merges    map[string][]func(existing string, existed bool) string
+	expires   map[string]int64
+	ifChanged map[string]struct{}
+	// blobs holds the keys set by setBlob. It's nil until then.
+	blobs map[string]blobRef
+	// prepared, if set, is called by Update with the WAL entry and the
+	// last commit before and after it once the batch is written to the
+	// data file. The batch is rolled back if it returns an error.
+	prepared       func(entry *walEntry, base, end int64) error
 	allowOverwrite bool
+	tag            []byte
 }
 
 // NewWriteBatch returns a new WriteBatch.
@@ -12,6 +27,9 @@ func NewWriteBatch() *WriteBatch {
 	return &WriteBatch{
 		sets:           map[string]string{},
 		deletes:        map[string]struct{}{},
+		merges:         map[string][]func(string, bool) string{},
+		expires:        map[string]int64{},
+		ifChanged:      map[string]struct{}{},
 		allowOverwrite: true,
 	}
 }
@@ -19,13 +37,96 @@ func NewWriteBatch() *WriteBatch {
 // Set adds key => value to the WriteBatch.
 // Note: If a key is passed to Delete and Set,
 // then the Set will be ignored.
+// Set replaces any earlier Merge of the same key.
+// Keys and values can hold any bytes, including zero bytes. Keys can be
+// at most MaxKeyLen bytes and values at most MaxValueLen bytes, or
+// Update fails.
 func (wb *WriteBatch) Set(key, value string) {
+	if _, ok := wb.deletes[key]; ok {
+		return
+	}
 	wb.sets[key] = value
+	delete(wb.merges, key)
+	delete(wb.expires, key)
+	delete(wb.ifChanged, key)
+	delete(wb.blobs, key)
+}
+
+// SetIfChanged is like Set, but Update skips the key, keeping its record
+// and the version it was set at, if it already has exactly this value
+// and no expiration time. Skipped keys are counted in Stats.SetsElided.
+// If every key of the batch is skipped, Update commits nothing and
+// returns the current version.
+func (wb *WriteBatch) SetIfChanged(key, value string) {
+	if _, ok := wb.deletes[key]; ok {
+		return
+	}
+	wb.Set(key, value)
+	wb.ifChanged[key] = struct{}{}
+}
+
+// SetWithTTL is like Set but the key expires ttl after SetWithTTL is
+// called. Expired keys are treated as missing by cursors and lookups.
+// Expiration is lazy: expired records stay in the data file until
+// the collection is compacted.
+func (wb *WriteBatch) SetWithTTL(key, value string, ttl time.Duration) {
+	wb.setExpiresAt(key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// setExpiresAt sets key to value with an expiration time in Unix nanoseconds.
+func (wb *WriteBatch) setExpiresAt(key, value string, expiresAt int64) {
+	if _, ok := wb.deletes[key]; ok {
+		return
+	}
+	wb.Set(key, value)
+	wb.expires[key] = expiresAt
+}
+
+// setBlob sets key to the value at ref in the blob file of the collection
+// wb is applied to, without reading the value. expiresAt is as for
+// setExpiresAt, or 0. It's used by compaction, which keeps the blob file.
+func (wb *WriteBatch) setBlob(key string, ref blobRef, expiresAt int64) {
+	if _, ok := wb.deletes[key]; ok {
+		return
+	}
+	wb.Set(key, "")
+	if expiresAt != 0 {
+		wb.expires[key] = expiresAt
+	}
+	if wb.blobs == nil {
+		wb.blobs = map[string]blobRef{}
+	}
+	wb.blobs[key] = ref
+}
+
+// SetTag sets an opaque tag that's stored with the commit in the WAL,
+// for example to identify the node or transaction a replicated commit
+// came from. Tags are shipped with commits by StreamWAL and reported
+// by LastCommitInfo. They aren't kept in the data file.
+func (wb *WriteBatch) SetTag(tag []byte) {
+	wb.tag = append([]byte(nil), tag...)
 }
 
 // Delete marks a key for deletion.
 func (wb *WriteBatch) Delete(key string) {
 	wb.deletes[key] = struct{}{}
+	delete(wb.sets, key)
+	delete(wb.merges, key)
+	delete(wb.expires, key)
+	delete(wb.ifChanged, key)
+	delete(wb.blobs, key)
+}
+
+// Merge sets key to the result of fn, which is called during Update
+// with the current value of key and whether it exists. If key was
+// already Set or Merged in this batch, fn receives that result instead,
+// so calls are applied in the order they were made. As with Set,
+// a Delete of the same key takes precedence.
+func (wb *WriteBatch) Merge(key string, fn func(existing string, existed bool) string) {
+	if _, ok := wb.deletes[key]; ok {
+		return
+	}
+	wb.merges[key] = append(wb.merges[key], fn)
 }
 
 // AllowOverwrite determines whether keys will be overwritten.
@@ -35,8 +136,151 @@ func (wb *WriteBatch) AllowOverwrite(allow bool) {
 	wb.allowOverwrite = allow
 }
 
-func (wb *WriteBatch) cleanup() {
+// Clone returns a copy of wb that can be modified independently.
+// Merge functions are shared between the two.
+func (wb *WriteBatch) Clone() *WriteBatch {
+	clone := NewWriteBatch()
+	for key, value := range wb.sets {
+		clone.sets[key] = value
+	}
 	for key := range wb.deletes {
-		delete(wb.sets, key)
+		clone.deletes[key] = struct{}{}
+	}
+	for key, fns := range wb.merges {
+		clone.merges[key] = append([]func(string, bool) string(nil), fns...)
+	}
+	for key, expiresAt := range wb.expires {
+		clone.expires[key] = expiresAt
+	}
+	for key := range wb.ifChanged {
+		clone.ifChanged[key] = struct{}{}
+	}
+	clone.allowOverwrite = wb.allowOverwrite
+	clone.tag = wb.tag
+	return clone
+}
+
+// Len returns the number of distinct keys that wb sets, merges or deletes.
+func (wb *WriteBatch) Len() int {
+	n := len(wb.deletes) + len(wb.sets)
+	for key := range wb.merges {
+		if _, ok := wb.sets[key]; !ok {
+			n++
+		}
+	}
+	return n
+}
+
+// ForEach calls set for each key that wb sets and del for each key that
+// it deletes. Keys are always in byte order, even for a collection with
+// a custom Comparator. Sets of deleted keys are skipped. Merges aren't
+// included since their values aren't known until Update. Either function
+// may be nil.
+func (wb *WriteBatch) ForEach(set func(key, value string), del func(key string)) {
+	if set != nil {
+		keys := make([]string, 0, len(wb.sets))
+		for key := range wb.sets {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			set(key, wb.sets[key])
+		}
+	}
+	if del != nil {
+		keys := make([]string, 0, len(wb.deletes))
+		for key := range wb.deletes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			del(key)
+		}
+	}
+}
+
+// EstimatedBytes returns an estimate of the number of bytes Update
+// appends to the data file for wb's sets. Merged values aren't known
+// until Update, so only their keys are counted.
+func (wb *WriteBatch) EstimatedBytes() int {
+	n := 0
+	for key, value := range wb.sets {
+		n += recordHeaderSize + len(key) + len(value)
+		if _, ok := wb.expires[key]; ok {
+			n += 8
+		}
+	}
+	for key := range wb.merges {
+		if _, ok := wb.sets[key]; !ok {
+			n += recordHeaderSize + len(key)
+		}
+	}
+	return n
+}
+
+// split divides wb into batches in key order, ordered by compare, that
+// each have EstimatedBytes of at most maxBytes unless they hold a single
+// key. Deletes don't append records, so they take up no room.
+func (wb *WriteBatch) split(maxBytes int, compare func(a, b string) int) []*WriteBatch {
+	keys := make([]string, 0, wb.Len())
+	for key := range wb.sets {
+		keys = append(keys, key)
+	}
+	for key := range wb.deletes {
+		keys = append(keys, key)
+	}
+	for key := range wb.merges {
+		if _, ok := wb.sets[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return compare(keys[i], keys[j]) < 0
+	})
+
+	batches := []*WriteBatch{}
+	batch := NewWriteBatch()
+	batch.allowOverwrite = wb.allowOverwrite
+	batch.tag = wb.tag
+	size := 0
+	for _, key := range keys {
+		keySize := 0
+		if value, ok := wb.sets[key]; ok {
+			keySize = recordHeaderSize + len(key) + len(value)
+			if _, ok := wb.expires[key]; ok {
+				keySize += 8
+			}
+		} else if _, ok := wb.merges[key]; ok {
+			keySize = recordHeaderSize + len(key)
+		}
+		if batch.Len() > 0 && size+keySize > maxBytes {
+			batches = append(batches, batch)
+			batch = NewWriteBatch()
+			batch.allowOverwrite = wb.allowOverwrite
+			batch.tag = wb.tag
+			size = 0
+		}
+		size += keySize
+
+		if _, ok := wb.deletes[key]; ok {
+			batch.deletes[key] = struct{}{}
+			continue
+		}
+		if value, ok := wb.sets[key]; ok {
+			batch.sets[key] = value
+		}
+		if fns, ok := wb.merges[key]; ok {
+			batch.merges[key] = fns
+		}
+		if expiresAt, ok := wb.expires[key]; ok {
+			batch.expires[key] = expiresAt
+		}
+		if _, ok := wb.ifChanged[key]; ok {
+			batch.ifChanged[key] = struct{}{}
+		}
+	}
+	if batch.Len() > 0 {
+		batches = append(batches, batch)
 	}
+	return batches
 }